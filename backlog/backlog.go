@@ -1,8 +1,7 @@
 package backlog
 
 import (
-	"encoding/binary"
-	"hash/crc32"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -16,28 +15,47 @@ import (
 	"github.com/rs/zerolog"
 	"nginx-log-collector/clickhouse"
 	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
 	"nginx-log-collector/utils"
-	"gopkg.in/alexcesaro/statsd.v2"
 )
 
 const (
 	backlogSuffix             = ".backlog"
 	writeSuffix               = ".writing"
+	targetPrefix              = "target:"
 	checkInterval             = 30 * time.Second
 	maxConcurrentHttpRequests = 32
+	defaultCompression        = clickhouse.CompressionZstd
 )
 
 type Backlog struct {
-	dir string
+	dir         string
+	compression string
 
 	logger  zerolog.Logger
-	metrics *statsd.Client
+	metrics metrics.Metrics
 	makeMu  *sync.Mutex
 	wg      *sync.WaitGroup
 	limiter utils.Limiter
+
+	targetsMu *sync.RWMutex
+	targets   map[string]*clickhouse.Cluster
+
+	quota      *quota
+	filesMu    *sync.Mutex
+	files      map[string]*fileInfo // index of backlog files, so writes don't scan the directory
+	inFlightMu *sync.Mutex
+	inFlight   map[string]bool
+
+	replayLimiter    *utils.RateLimiter
+	replayMaxBackoff time.Duration
+	replayMu         *sync.Mutex
+	replayStates     map[string]*replayState
+	quarantineDir    string
+	quarantineAfter  int
 }
 
-func New(cfg config.Backlog, metrics *statsd.Client, logger *zerolog.Logger) (*Backlog, error) {
+func New(cfg config.Backlog, metrics metrics.Metrics, logger *zerolog.Logger) (*Backlog, error) {
 	err := os.MkdirAll(cfg.Dir, 0755)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to create backlog directory")
@@ -57,6 +75,35 @@ func New(cfg config.Backlog, metrics *statsd.Client, logger *zerolog.Logger) (*B
 			}
 		}
 	}
+	if err := removeOrphanReplayStates(cfg.Dir); err != nil {
+		return nil, errors.Wrap(err, "unable to remove replay states")
+	}
+
+	compression := defaultCompression
+	if cfg.Compression != "" {
+		compression = cfg.Compression
+	}
+	if err := clickhouse.ValidateCompression(compression); err != nil {
+		return nil, errors.Wrap(err, "invalid backlog compression")
+	}
+
+	q, err := newQuota(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid backlog quota")
+	}
+
+	replayMaxBackoff := defaultReplayMaxBackoff
+	if cfg.ReplayMaxBackoff > 0 {
+		replayMaxBackoff = cfg.ReplayMaxBackoff
+	}
+	quarantineDir := filepath.Join(cfg.Dir, quarantineDirName)
+	if cfg.QuarantineDir != "" {
+		quarantineDir = cfg.QuarantineDir
+	}
+	quarantineAfter := defaultQuarantineAfter
+	if cfg.QuarantineAfter > 0 {
+		quarantineAfter = cfg.QuarantineAfter
+	}
 
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
@@ -67,14 +114,47 @@ func New(cfg config.Backlog, metrics *statsd.Client, logger *zerolog.Logger) (*B
 
 	}
 
-	return &Backlog{
-		dir:     cfg.Dir,
-		makeMu:  &sync.Mutex{},
-		wg:      wg,
-		metrics: metrics.Clone(statsd.Prefix("backlog")),
-		logger:  logger.With().Str("component", "backlog").Logger(),
-		limiter: utils.NewLimiter(requestsLimit),
-	}, nil
+	b := &Backlog{
+		dir:         cfg.Dir,
+		compression: compression,
+		makeMu:      &sync.Mutex{},
+		wg:          wg,
+		metrics:     metrics.Clone("backlog"),
+		logger:      logger.With().Str("component", "backlog").Logger(),
+		limiter:     utils.NewLimiter(requestsLimit),
+
+		targetsMu: &sync.RWMutex{},
+		targets:   make(map[string]*clickhouse.Cluster),
+
+		quota:      q,
+		filesMu:    &sync.Mutex{},
+		files:      make(map[string]*fileInfo),
+		inFlightMu: &sync.Mutex{},
+		inFlight:   make(map[string]bool),
+
+		replayLimiter:    utils.NewRateLimiter(cfg.ReplayRateLimit),
+		replayMaxBackoff: replayMaxBackoff,
+		replayMu:         &sync.Mutex{},
+		replayStates:     make(map[string]*replayState),
+		quarantineDir:    quarantineDir,
+		quarantineAfter:  quarantineAfter,
+	}
+	if err := b.syncIndex(); err != nil {
+		return nil, errors.Wrap(err, "unable to read backlog directory")
+	}
+	return b, nil
+}
+
+// ValidateConfig checks backlog settings without creating backlog directory
+func ValidateConfig(cfg config.Backlog) error {
+	if cfg.Dir == "" {
+		return errors.New("dir should be set")
+	}
+	if err := clickhouse.ValidateCompression(cfg.Compression); err != nil {
+		return err
+	}
+	_, err := newQuota(cfg)
+	return err
 }
 
 func (b *Backlog) Start(done <-chan struct{}) {
@@ -102,6 +182,61 @@ func (b *Backlog) Stop() {
 	b.wg.Wait()
 }
 
+// UnknownTargetError is returned for backlog files whose target isn't configured anymore,
+// such files are never uploaded and go to quarantine
+type UnknownTargetError struct {
+	Target string
+}
+
+func (e *UnknownTargetError) Error() string {
+	return fmt.Sprintf("unknown upload target: %s", e.Target)
+}
+
+// HasTargetFiles reports whether backlog files of the target are waiting for replay
+func (b *Backlog) HasTargetFiles(target string) bool {
+	b.makeMu.Lock()
+	defer b.makeMu.Unlock()
+	for _, f := range b.listFiles() {
+		if b.fileHeader(f).Target == targetPrefix+target {
+			return true
+		}
+	}
+	return false
+}
+
+// SetTargets sets upload targets used to replay backlog files
+func (b *Backlog) SetTargets(targets map[string]*clickhouse.Cluster) {
+	b.targetsMu.Lock()
+	b.targets = targets
+	b.targetsMu.Unlock()
+}
+
+// targetQuery returns insert query of the target stored in backlog files, so they can be replayed without config
+func (b *Backlog) targetQuery(name string) string {
+	b.targetsMu.RLock()
+	defer b.targetsMu.RUnlock()
+	if cluster, found := b.targets[name]; found {
+		return cluster.Query()
+	}
+	return ""
+}
+
+func (b *Backlog) upload(header *Header, payload io.Reader) error {
+	if !strings.HasPrefix(header.Target, targetPrefix) {
+		// files created by previous versions contain plain upload url
+		return clickhouse.UploadReader(header.Target, payload)
+	}
+	name := strings.TrimPrefix(header.Target, targetPrefix)
+
+	b.targetsMu.RLock()
+	cluster, found := b.targets[name]
+	b.targetsMu.RUnlock()
+	if !found {
+		return &UnknownTargetError{Target: name}
+	}
+	return cluster.UploadCompressed(payload, header.Compression)
+}
+
 func (b *Backlog) processFile(filename string) {
 	b.logger.Info().Str("file", filename).Msg("starting backlog job")
 	b.metrics.Increment("job_start")
@@ -112,43 +247,89 @@ func (b *Backlog) processFile(filename string) {
 		b.metrics.Increment("open_error")
 		return
 	}
-	if !checkCrc(file) {
+	header, err := readHeader(file)
+	if err == errInvalidCrc {
 		file.Close()
-		b.logger.Error().Msg("invalid crc32 checksum")
+		b.logger.Error().Str("file", filename).Msg("invalid crc32 checksum")
 		if err = os.Remove(path); err != nil {
 			b.logger.Fatal().Err(err).Msg("unable to remove invalid backlog file")
 			b.metrics.Increment("remove_error")
 		}
+		b.removeFile(filename)
+		b.forgetFile(filename)
+		return
+	} else if err != nil {
+		file.Close()
+		b.logger.Error().Str("file", filename).Err(err).Msg("unable to read backlog file header")
+		b.metrics.Increment("header_error")
+		b.handleFailure(filename, false)
 		return
 	}
 
-	file.Seek(4, 0) // crc offset
-	url := readUrl(file)
-
-	err = clickhouse.UploadReader(url, file)
+	err = b.upload(header, utils.NewRateLimitedReader(file, b.replayLimiter))
 
 	file.Close()
 
 	if err != nil {
-		b.logger.Error().Err(err).Msg("unable to upload backlog file")
+		b.logger.Error().Str("file", filename).Err(err).Msg("unable to upload backlog file")
 		b.metrics.Increment("upload_error")
+		b.handleFailure(filename, b.isRetryable(header, err))
 	} else {
 		if err = os.Remove(path); err != nil {
 			b.logger.Fatal().Err(err).Msg("unable to remove finished backlog file")
 			b.metrics.Increment("upload_remove_error")
 		}
+		b.removeFile(filename)
+		b.forgetFile(filename)
 	}
 
 }
 
+// handleFailure delays the next attempt and quarantines files failing with permanent errors
+func (b *Backlog) handleFailure(filename string, retryable bool) {
+	attempts := b.recordFailure(filename)
+	if retryable || attempts < b.quarantineAfter {
+		return
+	}
+	quarantined, err := b.quarantine(filename)
+	if err != nil {
+		b.logger.Error().Str("file", filename).Err(err).Msg("unable to quarantine backlog file")
+		b.metrics.Increment("quarantine_error")
+		return
+	}
+	if !quarantined {
+		return
+	}
+	b.logger.Warn().Str("file", filename).Int("attempts", attempts).Str("dir", b.quarantineDir).Msg("backlog file quarantined")
+	b.metrics.Increment("quarantined")
+}
+
 func (b *Backlog) check(done <-chan struct{}) {
 	b.logger.Debug().Msg("starting backlog check")
-	files, err := ioutil.ReadDir(b.dir)
+
+	b.makeMu.Lock()
+	err := b.syncIndex()
+	if err == nil {
+		b.enforceQuota(0, "")
+	}
+	b.makeMu.Unlock()
 	if err != nil {
 		b.logger.Error().Err(err).Msg("unable to read backlog directory")
 		return
 	}
 
+	// files are sorted oldest first
+	files := b.listFiles()
+	b.forgetMissing(files)
+
+	var totalBytes int64
+	for _, f := range files {
+		totalBytes += f.size
+	}
+	b.metrics.Gauge("files", len(files))
+	b.metrics.Gauge("bytes", totalBytes)
+
+	now := time.Now()
 	wg := &sync.WaitGroup{}
 	for _, f := range files {
 		select {
@@ -156,48 +337,119 @@ func (b *Backlog) check(done <-chan struct{}) {
 			return
 		default:
 		}
-		if !strings.HasSuffix(f.Name(), backlogSuffix) {
+		if !b.shouldReplay(f.name, now) {
+			b.metrics.Increment("backoff_skip")
 			continue
 		}
 
 		b.limiter.Enter()
 		wg.Add(1)
+		b.setInFlight(f.name, true)
 		go func(name string) {
 			b.processFile(name)
+			b.setInFlight(name, false)
 			b.limiter.Leave()
 			wg.Done()
-		}(f.Name())
+		}(f.name)
 	}
 	wg.Wait()
 	return
 }
 
-func (b *Backlog) MakeNewBacklogJob(url string, data []byte) error {
+// MakeNewBacklogJob stores data to be uploaded later to the named target
+func (b *Backlog) MakeNewBacklogJob(target, tag string, lines int, data []byte) error {
+	payload, err := clickhouse.Compress(b.compression, data)
+	if err != nil {
+		b.metrics.Increment("compress_error")
+		return errors.Wrap(err, "unable to compress backlog data")
+	}
+
+	b.makeMu.Lock()
+	defer b.makeMu.Unlock()
+
+	if !b.enforceQuota(int64(len(payload)), tag) {
+		b.logger.Warn().Str("tag", tag).Int("lines", lines).Msg("backlog quota exceeded; dropping new backlog job")
+		b.reportDropped(tag, int64(len(payload)), lines, "quota")
+		return nil
+	}
+
+	f, err := b.writeJob(b.dir, target, tag, lines, payload)
+	if err != nil {
+		return err
+	}
+	b.addFile(f)
+	b.metrics.Increment("backlog_job_created")
+	b.metrics.Count("raw_bytes", len(data))
+	b.metrics.Count("compressed_bytes", len(payload))
+	return nil
+}
+
+// MakeQuarantineJob stores data failed with permanent error to quarantine, it's never replayed automatically
+func (b *Backlog) MakeQuarantineJob(target, tag string, lines int, data []byte) error {
+	payload, err := clickhouse.Compress(b.compression, data)
+	if err != nil {
+		b.metrics.Increment("compress_error")
+		return errors.Wrap(err, "unable to compress backlog data")
+	}
+	if err := os.MkdirAll(b.quarantineDir, 0755); err != nil {
+		return errors.Wrap(err, "unable to create quarantine directory")
+	}
+
 	b.makeMu.Lock()
 	defer b.makeMu.Unlock()
-	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
-	file, err := ioutil.TempFile(b.dir, timestamp+"_*"+writeSuffix)
+
+	if !b.admitQuarantine(int64(len(payload))) {
+		b.logger.Warn().Str("tag", tag).Int("lines", lines).Msg("quarantine quota exceeded; dropping batch")
+		b.reportDropped(tag, int64(len(payload)), lines, "quarantine_quota")
+		return nil
+	}
+	if _, err := b.writeJob(b.quarantineDir, target, tag, lines, payload); err != nil {
+		return err
+	}
+	b.metrics.Increment("quarantined", metrics.Tag(tag))
+	return nil
+}
+
+// writeJob writes backlog file to the dir through temporary file
+func (b *Backlog) writeJob(dir, target, tag string, lines int, payload []byte) (*fileInfo, error) {
+	now := time.Now()
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	file, err := ioutil.TempFile(dir, timestamp+"_*"+writeSuffix)
 	if err != nil {
 		b.metrics.Increment("tmp_file_create_error")
-		return errors.Wrap(err, "unable to create tmp file")
+		return nil, errors.Wrap(err, "unable to create tmp file")
 	}
 	defer file.Close()
 
-	serializedUrl := serializeString(url)
-	crcBuf := calcCrc(serializedUrl, data)
-
-	file.Write(crcBuf)
-	file.Write(serializedUrl)
-	file.Write(data)
+	header := Header{
+		Tag:         tag,
+		Target:      targetPrefix + target,
+		Query:       b.targetQuery(target),
+		Compression: b.compression,
+		Lines:       uint32(lines),
+		CreatedAt:   now,
+	}
+	if err := writeFile(file, header, payload); err != nil {
+		b.metrics.Increment("write_error")
+		return nil, errors.Wrap(err, "unable to write backlog file")
+	}
 
 	file.Sync()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to stat backlog file")
+	}
 
 	if err := b.Rename(file.Name()); err != nil {
 		b.metrics.Increment("tmp_file_rename_error")
-		return errors.Wrap(err, "unable to finish backlog job")
+		return nil, errors.Wrap(err, "unable to finish backlog job")
 	}
-	b.metrics.Increment("backlog_job_created")
-	return nil
+	return &fileInfo{
+		name:      filepath.Base(baseFileName(file.Name()) + backlogSuffix),
+		size:      stat.Size(),
+		createdAt: time.Unix(now.Unix(), 0),
+		header:    &header,
+	}, nil
 }
 
 func (b *Backlog) Rename(oldPath string) error {
@@ -209,42 +461,6 @@ func (b *Backlog) GetLimiter() utils.Limiter {
 	return b.limiter
 }
 
-func serializeString(s string) []byte {
-	b := make([]byte, len(s)+4)
-	binary.BigEndian.PutUint32(b, uint32(len(s)))
-	copy(b[4:], s)
-	return b
-}
-
-func calcCrc(serializedUrl []byte, data []byte) []byte {
-	h := crc32.NewIEEE()
-	h.Write(serializedUrl)
-	h.Write(data)
-	crcBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(crcBuf, h.Sum32())
-	return crcBuf
-}
-
-func readUrl(file *os.File) string {
-	strLenBuf := make([]byte, 4)
-	file.Read(strLenBuf)
-	strLen := binary.BigEndian.Uint32(strLenBuf)
-
-	urlBuf := make([]byte, strLen)
-	file.Read(urlBuf)
-	return string(urlBuf)
-}
-
-func checkCrc(file *os.File) bool {
-	crcBuf := make([]byte, 4)
-	file.Read(crcBuf)
-	expectedCrc := binary.BigEndian.Uint32(crcBuf)
-	h := crc32.NewIEEE()
-
-	io.Copy(h, file)
-	return expectedCrc == h.Sum32()
-}
-
 func baseFileName(path string) string {
 	for i := len(path) - 1; i >= 0 && !os.IsPathSeparator(path[i]); i-- {
 		if path[i] == '.' {
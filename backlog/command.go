@@ -0,0 +1,322 @@
+package backlog
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"nginx-log-collector/clickhouse"
+)
+
+const defaultCommandDir = "/var/lib/nginx-log-collector/backlog/"
+
+const commandUsage = `usage: nginx-log-collector backlog <command> [flags] [files]
+
+commands:
+  ls       list backlog files with target, size, line count and crc status
+  cat      dump payload of backlog files as JSONEachRow to stdout
+  verify   check crc of backlog files; exits non-zero if any file is broken
+  replay   upload backlog files to clickhouse: replay -to DSN [-table TABLE] [-remove] files
+  rm       remove backlog files: rm -older-than DURATION
+
+files default to every backlog file in -dir`
+
+// FileStat describes single backlog file for inspection tools
+type FileStat struct {
+	Path   string
+	Size   int64
+	Header *Header
+	Lines  int
+	CrcOK  bool
+	Err    error
+}
+
+// Stat reads file header, checks crc and counts lines of legacy files
+func Stat(path string) FileStat {
+	stat := FileStat{Path: path}
+	file, err := os.Open(path)
+	if err != nil {
+		stat.Err = err
+		return stat
+	}
+	defer file.Close()
+
+	if fi, err := file.Stat(); err == nil {
+		stat.Size = fi.Size()
+	}
+
+	header, err := readHeader(file)
+	if err == errInvalidCrc {
+		if header, err = peekHeader(file); err == nil {
+			stat.Header = header
+		}
+		return stat
+	} else if err != nil {
+		stat.Err = err
+		return stat
+	}
+	stat.Header = header
+	stat.CrcOK = true
+	stat.Lines = int(header.Lines)
+
+	if header.Version == legacyVersion {
+		stat.Lines, stat.Err = countLines(file)
+	}
+	return stat
+}
+
+// RunCommand runs backlog inspection subcommand
+func RunCommand(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(commandUsage)
+	}
+
+	fs := flag.NewFlagSet("backlog "+args[0], flag.ContinueOnError)
+	dir := fs.String("dir", defaultCommandDir, "Backlog directory")
+	to := fs.String("to", "", "ClickHouse DSN to replay files to")
+	table := fs.String("table", "", "ClickHouse table to replay files to; taken from the file if empty")
+	remove := fs.Bool("remove", false, "Remove files replayed successfully")
+	olderThan := fs.Duration("older-than", 0, "Remove files created earlier than given duration ago")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	paths := fs.Args()
+	if len(paths) == 0 {
+		var err error
+		if paths, err = listPaths(*dir); err != nil {
+			return err
+		}
+	}
+
+	switch args[0] {
+	case "ls":
+		return commandLs(paths, stdout)
+	case "cat":
+		return commandCat(paths, stdout)
+	case "verify":
+		return commandVerify(paths, stdout)
+	case "replay":
+		if *to == "" {
+			return errors.New("-to flag should be set")
+		}
+		return commandReplay(paths, *to, *table, *remove, stdout)
+	case "rm":
+		if *olderThan <= 0 {
+			return errors.New("-older-than flag should be set")
+		}
+		return commandRm(paths, *olderThan, stdout)
+	default:
+		return fmt.Errorf("unknown command: %s\n%s", args[0], commandUsage)
+	}
+}
+
+func listPaths(dir string) ([]string, error) {
+	files, err := scanFiles(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read backlog directory")
+	}
+	paths := make([]string, 0, len(files))
+	for _, f := range files {
+		paths = append(paths, filepath.Join(dir, f.name))
+	}
+	return paths, nil
+}
+
+func commandLs(paths []string, stdout io.Writer) error {
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tVERSION\tTAG\tTARGET\tCOMPRESSION\tLINES\tSIZE\tCREATED\tCRC")
+	for _, path := range paths {
+		stat := Stat(path)
+		if stat.Err != nil && stat.Header == nil {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\t-\t%d\t-\terror: %s\n", path, stat.Size, stat.Err)
+			continue
+		}
+		h := stat.Header
+		created := "-"
+		if !h.CreatedAt.IsZero() {
+			created = h.CreatedAt.Format(time.RFC3339)
+		}
+		crc := "ok"
+		if !stat.CrcOK {
+			crc = "BAD"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%d\t%d\t%s\t%s\n",
+			path, h.Version, orDash(h.Tag), h.Target, orDash(h.Compression), stat.Lines, stat.Size, created, crc)
+	}
+	return w.Flush()
+}
+
+func commandCat(paths []string, stdout io.Writer) error {
+	for _, path := range paths {
+		if err := catFile(path, stdout); err != nil {
+			return errors.Wrap(err, path)
+		}
+	}
+	return nil
+}
+
+func catFile(path string, stdout io.Writer) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	header, err := readHeader(file)
+	if err != nil {
+		return err
+	}
+	payload, err := clickhouse.NewDecompressReader(header.Compression, file)
+	if err != nil {
+		return err
+	}
+	defer payload.Close()
+	_, err = io.Copy(stdout, payload)
+	return err
+}
+
+func commandVerify(paths []string, stdout io.Writer) error {
+	broken := 0
+	for _, path := range paths {
+		stat := Stat(path)
+		switch {
+		case stat.Err != nil:
+			broken++
+			fmt.Fprintf(stdout, "%s: error: %s\n", path, stat.Err)
+		case !stat.CrcOK:
+			broken++
+			fmt.Fprintf(stdout, "%s: invalid crc32 checksum\n", path)
+		default:
+			fmt.Fprintf(stdout, "%s: ok\n", path)
+		}
+	}
+	if broken > 0 {
+		return fmt.Errorf("%d of %d files are broken", broken, len(paths))
+	}
+	return nil
+}
+
+func commandReplay(paths []string, dsn, table string, remove bool, stdout io.Writer) error {
+	for _, path := range paths {
+		if err := replayFile(path, dsn, table); err != nil {
+			return errors.Wrap(err, path)
+		}
+		fmt.Fprintf(stdout, "%s: uploaded\n", path)
+		if remove {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			_ = os.Remove(path + replayStateSuffix)
+		}
+	}
+	return nil
+}
+
+func replayFile(path, dsn, table string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	header, err := readHeader(file)
+	if err != nil {
+		return err
+	}
+	uploadUrl, err := replayUrl(header, dsn, table)
+	if err != nil {
+		return err
+	}
+	return clickhouse.UploadEncoded(uploadUrl, file, clickhouse.ContentEncoding(header.Compression))
+}
+
+// replayUrl builds upload url for alternate clickhouse endpoint keeping the stored query and settings,
+// table overrides the stored table
+func replayUrl(header *Header, dsn, table string) (string, error) {
+	stored := header.Query
+	if !strings.HasPrefix(header.Target, targetPrefix) {
+		// legacy file url already contains the query
+		u, err := url.Parse(header.Target)
+		if err != nil {
+			return "", errors.Wrap(err, "unable to parse stored url")
+		}
+		stored = u.RawQuery
+	}
+	if stored == "" { // files of version 2 store target name only
+		if table == "" {
+			return "", fmt.Errorf("-table flag should be set to replay file of target %s", strings.TrimPrefix(header.Target, targetPrefix))
+		}
+		return clickhouse.MakeUrl(dsn, table, true, 0)
+	}
+
+	params, err := url.ParseQuery(stored)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to parse stored query")
+	}
+	if table != "" {
+		params.Set("query", clickhouse.InsertQuery(table))
+	}
+	if !strings.HasSuffix(dsn, "/") {
+		dsn += "/"
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to parse dsn")
+	}
+	q := u.Query()
+	for name, values := range params {
+		q[name] = values
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func commandRm(paths []string, olderThan time.Duration, stdout io.Writer) error {
+	threshold := time.Now().Add(-olderThan)
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !fileCreatedAt(filepath.Base(path), fi.ModTime()).Before(threshold) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		_ = os.Remove(path + replayStateSuffix)
+		fmt.Fprintf(stdout, "%s: removed\n", path)
+	}
+	return nil
+}
+
+func countLines(r io.Reader) (int, error) {
+	lines := 0
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		lines += bytes.Count(buf[:n], []byte{'\n'})
+		if err == io.EOF {
+			return lines, nil
+		} else if err != nil {
+			return lines, err
+		}
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,95 @@
+package backlog
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"nginx-log-collector/config"
+)
+
+func TestCommandCatAndVerify(t *testing.T) {
+	b := newTestBacklog(t, config.Backlog{Compression: "gzip"})
+	defer os.RemoveAll(b.dir)
+
+	data := []byte(`{"status":200}` + "\n" + `{"status":404}` + "\n")
+	assert.Nil(t, b.MakeNewBacklogJob("nginx:", "nginx:", 2, data))
+
+	out := &bytes.Buffer{}
+	assert.Nil(t, RunCommand([]string{"cat", "-dir", b.dir}, out))
+	assert.Equal(t, data, out.Bytes())
+
+	out.Reset()
+	assert.Nil(t, RunCommand([]string{"verify", "-dir", b.dir}, out))
+
+	paths, err := listPaths(b.dir)
+	assert.Nil(t, err)
+	assert.Len(t, paths, 1)
+	stat := Stat(paths[0])
+	assert.True(t, stat.CrcOK)
+	assert.Equal(t, 2, stat.Lines)
+	assert.Equal(t, "nginx:", stat.Header.Tag)
+
+	f, err := os.OpenFile(paths[0], os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	f.Write([]byte("garbage"))
+	f.Close()
+	assert.NotNil(t, RunCommand([]string{"verify", "-dir", b.dir}, out))
+}
+
+func TestCommandRm(t *testing.T) {
+	b := newTestBacklog(t, config.Backlog{})
+	defer os.RemoveAll(b.dir)
+
+	writeTestFile(t, b, "100_a.backlog", "nginx:")
+	assert.Nil(t, b.MakeNewBacklogJob("nginx:", "nginx:", 1, []byte("{}\n")))
+
+	assert.Nil(t, RunCommand([]string{"rm", "-dir", b.dir, "-older-than", "1h"}, &bytes.Buffer{}))
+	assert.Nil(t, b.syncIndex()) // removed behind the backlog's back
+	names := listNames(t, b)
+	assert.Len(t, names, 1)
+	assert.NotEqual(t, "100_a.backlog", names[0])
+	_, err := os.Stat(filepath.Join(b.dir, "100_a.backlog"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestReplayUrl(t *testing.T) {
+	table := []struct {
+		header   Header
+		table    string
+		expected string
+	}{
+		{
+			Header{Target: "http://old:8123/?query=INSERT+INTO+db.t+FORMAT+JSONEachRow"},
+			"",
+			"http://new:8123/?query=INSERT+INTO+db.t+FORMAT+JSONEachRow",
+		},
+		{
+			Header{Target: "target:nginx:"},
+			"db.table",
+			"http://new:8123/?input_format_skip_unknown_fields=1&query=INSERT+INTO+db.table+FORMAT+JSONEachRow",
+		},
+		{
+			Header{Target: "target:nginx:", Query: "input_format_allow_errors_ratio=5&query=INSERT+INTO+db.t+FORMAT+JSONEachRow"},
+			"",
+			"http://new:8123/?input_format_allow_errors_ratio=5&query=INSERT+INTO+db.t+FORMAT+JSONEachRow",
+		},
+		{
+			Header{Target: "target:nginx:", Query: "input_format_allow_errors_ratio=5&query=INSERT+INTO+db.t+FORMAT+JSONEachRow"},
+			"db.table",
+			"http://new:8123/?input_format_allow_errors_ratio=5&query=INSERT+INTO+db.table+FORMAT+JSONEachRow",
+		},
+	}
+
+	for _, p := range table {
+		u, err := replayUrl(&p.header, "http://new:8123", p.table)
+		assert.Nil(t, err)
+		assert.Equal(t, p.expected, u)
+	}
+
+	_, err := replayUrl(&Header{Target: "target:nginx:"}, "http://new:8123/", "")
+	assert.NotNil(t, err)
+}
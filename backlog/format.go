@@ -0,0 +1,194 @@
+package backlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Backlog file layouts.
+// legacy (version 1): crc32 | len | url | raw data
+// version 2: magic | version | crc32 | len | tag | len | target | len | compression | lines | created | payload
+// version 3: magic | version | crc32 | len | tag | len | target | len | query | len | compression | lines | created | payload
+// crc32 covers everything after itself; integers are big endian, created is unix timestamp
+const (
+	legacyVersion  = 1
+	queryVersion   = 3 // the first version storing query of the target
+	currentVersion = 3
+
+	maxStringLength = 64 * 1024 // header strings are short, longer prefix means corrupted file
+)
+
+var (
+	magic = []byte("NLCB")
+
+	errInvalidCrc = errors.New("invalid crc32 checksum")
+)
+
+// Header describes backlog file contents
+type Header struct {
+	Version     uint8
+	Tag         string
+	Target      string // upload target name or plain url for legacy files
+	Query       string // url parameters of the target insert query, empty before version 3
+	Compression string
+	Lines       uint32
+	CreatedAt   time.Time
+}
+
+// writeFile serializes header and already compressed payload
+func writeFile(w io.Writer, header Header, payload []byte) error {
+	fields := &bytes.Buffer{}
+	fields.Write(serializeString(header.Tag))
+	fields.Write(serializeString(header.Target))
+	fields.Write(serializeString(header.Query))
+	fields.Write(serializeString(header.Compression))
+	binary.Write(fields, binary.BigEndian, header.Lines)
+	binary.Write(fields, binary.BigEndian, header.CreatedAt.Unix())
+
+	buf := &bytes.Buffer{}
+	buf.Write(magic)
+	buf.WriteByte(currentVersion)
+	buf.Write(calcCrc(fields.Bytes(), payload))
+	buf.Write(fields.Bytes())
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// readHeader checks crc and reads header of any supported version.
+// On success r is positioned at the beginning of payload
+func readHeader(r io.ReadSeeker) (*Header, error) {
+	return parseHeader(r, true)
+}
+
+// peekHeader reads header without reading the whole file to check crc
+func peekHeader(r io.ReadSeeker) (*Header, error) {
+	return parseHeader(r, false)
+}
+
+func parseHeader(r io.ReadSeeker, verifyCrc bool) (*Header, error) {
+	prefix := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, errors.Wrap(err, "unable to read header")
+	}
+
+	if !bytes.Equal(prefix[:len(magic)], magic) {
+		return parseLegacyHeader(r, verifyCrc)
+	}
+
+	version := prefix[len(magic)]
+	if version <= legacyVersion || version > currentVersion {
+		return nil, fmt.Errorf("unsupported backlog file version: %d", version)
+	}
+
+	crcOffset := int64(len(prefix))
+	if verifyCrc && !checkCrc(r) {
+		return nil, errInvalidCrc
+	}
+	if _, err := r.Seek(crcOffset+4, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	header := &Header{Version: version}
+	var created int64
+	var err error
+	if header.Tag, err = readString(r); err != nil {
+		return nil, errors.Wrap(err, "unable to read tag")
+	}
+	if header.Target, err = readString(r); err != nil {
+		return nil, errors.Wrap(err, "unable to read target")
+	}
+	if version >= queryVersion {
+		if header.Query, err = readString(r); err != nil {
+			return nil, errors.Wrap(err, "unable to read query")
+		}
+	}
+	if header.Compression, err = readString(r); err != nil {
+		return nil, errors.Wrap(err, "unable to read compression")
+	}
+	if err := binary.Read(r, binary.BigEndian, &header.Lines); err != nil {
+		return nil, errors.Wrap(err, "unable to read lines count")
+	}
+	if err := binary.Read(r, binary.BigEndian, &created); err != nil {
+		return nil, errors.Wrap(err, "unable to read creation time")
+	}
+	header.CreatedAt = time.Unix(created, 0)
+	return header, nil
+}
+
+func parseLegacyHeader(r io.ReadSeeker, verifyCrc bool) (*Header, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if verifyCrc && !checkCrc(r) {
+		return nil, errInvalidCrc
+	}
+	if _, err := r.Seek(4, io.SeekStart); err != nil { // crc offset
+		return nil, err
+	}
+	url, err := readUrl(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read url")
+	}
+	return &Header{
+		Version: legacyVersion,
+		Target:  url,
+	}, nil
+}
+
+func serializeString(s string) []byte {
+	b := make([]byte, len(s)+4)
+	binary.BigEndian.PutUint32(b, uint32(len(s)))
+	copy(b[4:], s)
+	return b
+}
+
+func calcCrc(serializedUrl []byte, data []byte) []byte {
+	h := crc32.NewIEEE()
+	h.Write(serializedUrl)
+	h.Write(data)
+	crcBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(crcBuf, h.Sum32())
+	return crcBuf
+}
+
+func readUrl(r io.Reader) (string, error) {
+	return readString(r)
+}
+
+// readString reads length prefixed string, the length is bounded to not allocate much for corrupted files
+func readString(r io.Reader) (string, error) {
+	strLenBuf := make([]byte, 4)
+	if _, err := io.ReadFull(r, strLenBuf); err != nil {
+		return "", err
+	}
+	strLen := binary.BigEndian.Uint32(strLenBuf)
+	if strLen > maxStringLength {
+		return "", fmt.Errorf("string length %d exceeds %d", strLen, maxStringLength)
+	}
+
+	strBuf := make([]byte, strLen)
+	if _, err := io.ReadFull(r, strBuf); err != nil {
+		return "", err
+	}
+	return string(strBuf), nil
+}
+
+func checkCrc(r io.Reader) bool {
+	crcBuf := make([]byte, 4)
+	io.ReadFull(r, crcBuf)
+	expectedCrc := binary.BigEndian.Uint32(crcBuf)
+	h := crc32.NewIEEE()
+
+	io.Copy(h, r)
+	return expectedCrc == h.Sum32()
+}
@@ -0,0 +1,116 @@
+package backlog
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadHeader(t *testing.T) {
+	payload := []byte(`{"status":200}` + "\n")
+	created := time.Unix(1540000000, 0)
+	expected := Header{
+		Version:     currentVersion,
+		Tag:         "nginx:",
+		Target:      "target:nginx:",
+		Query:       "query=INSERT+INTO+db.t+FORMAT+JSONEachRow",
+		Compression: "none",
+		Lines:       1,
+		CreatedAt:   created,
+	}
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, writeFile(buf, expected, payload))
+
+	r := bytes.NewReader(buf.Bytes())
+	header, err := readHeader(r)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, *header)
+
+	rest, _ := ioutil.ReadAll(r)
+	assert.Equal(t, payload, rest)
+}
+
+func TestReadHeaderVersion2(t *testing.T) {
+	payload := []byte(`{"status":200}` + "\n")
+	fields := &bytes.Buffer{}
+	fields.Write(serializeString("nginx:"))
+	fields.Write(serializeString("target:nginx:"))
+	fields.Write(serializeString("none"))
+	fields.Write([]byte{0, 0, 0, 1})                         // lines
+	fields.Write([]byte{0, 0, 0, 0, 0x5b, 0xc8, 0x1c, 0x80}) // created
+
+	buf := &bytes.Buffer{}
+	buf.Write(magic)
+	buf.WriteByte(2)
+	buf.Write(calcCrc(fields.Bytes(), payload))
+	buf.Write(fields.Bytes())
+	buf.Write(payload)
+
+	r := bytes.NewReader(buf.Bytes())
+	header, err := readHeader(r)
+	assert.Nil(t, err)
+	assert.Equal(t, Header{
+		Version:     2,
+		Tag:         "nginx:",
+		Target:      "target:nginx:",
+		Compression: "none",
+		Lines:       1,
+		CreatedAt:   time.Unix(1539841152, 0),
+	}, *header)
+
+	rest, _ := ioutil.ReadAll(r)
+	assert.Equal(t, payload, rest)
+}
+
+func TestReadLegacyHeader(t *testing.T) {
+	payload := []byte(`{"status":200}` + "\n")
+	url := "http://localhost:8123/?query=INSERT"
+	serializedUrl := serializeString(url)
+
+	buf := &bytes.Buffer{}
+	buf.Write(calcCrc(serializedUrl, payload))
+	buf.Write(serializedUrl)
+	buf.Write(payload)
+
+	r := bytes.NewReader(buf.Bytes())
+	header, err := readHeader(r)
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(legacyVersion), header.Version)
+	assert.Equal(t, url, header.Target)
+
+	rest, _ := ioutil.ReadAll(r)
+	assert.Equal(t, payload, rest)
+}
+
+func TestReadHeaderInvalidCrc(t *testing.T) {
+	buf := &bytes.Buffer{}
+	assert.Nil(t, writeFile(buf, Header{Target: "target:nginx:"}, []byte("data")))
+	data := buf.Bytes()
+	data[len(data)-1] = 'X'
+
+	_, err := readHeader(bytes.NewReader(data))
+	assert.Equal(t, errInvalidCrc, err)
+}
+
+func TestPeekHeaderCorrupted(t *testing.T) {
+	buf := &bytes.Buffer{}
+	assert.Nil(t, writeFile(buf, Header{Tag: "nginx:", Target: "target:nginx:"}, []byte("data")))
+	valid := buf.Bytes()
+
+	hugeLength := append([]byte{}, valid...)
+	copy(hugeLength[len(magic)+1+4:], []byte{0xff, 0xff, 0xff, 0xff}) // tag length
+	_, err := peekHeader(bytes.NewReader(hugeLength))
+	assert.Error(t, err)
+
+	truncated := valid[:len(magic)+1+4+4+2] // in the middle of tag
+	_, err = peekHeader(bytes.NewReader(truncated))
+	assert.Error(t, err)
+
+	legacy := []byte{0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff}
+	_, err = peekHeader(bytes.NewReader(legacy))
+	assert.Error(t, err)
+}
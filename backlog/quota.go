@@ -0,0 +1,355 @@
+package backlog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+const (
+	EvictDropOldest  = "drop-oldest"
+	EvictDropNewest  = "drop-newest"
+	EvictTagPriority = "tag-priority"
+
+	defaultHighWaterRatio = 0.9
+)
+
+type quota struct {
+	maxBytes       int64
+	maxFiles       int
+	maxAge         time.Duration
+	policy         string
+	tagPriority    map[string]int
+	highWaterRatio float64
+
+	quarantineMaxBytes int64
+	quarantineMaxFiles int
+
+	aboveHighWater bool
+}
+
+type fileInfo struct {
+	name      string
+	size      int64
+	createdAt time.Time
+
+	header *Header // loaded lazily
+}
+
+func newQuota(cfg config.Backlog) (*quota, error) {
+	q := &quota{
+		maxBytes:       cfg.MaxBytes,
+		maxFiles:       cfg.MaxFiles,
+		maxAge:         cfg.MaxAge,
+		policy:         cfg.EvictionPolicy,
+		tagPriority:    cfg.TagPriority,
+		highWaterRatio: cfg.HighWaterRatio,
+
+		quarantineMaxBytes: cfg.QuarantineMaxBytes,
+		quarantineMaxFiles: cfg.QuarantineMaxFiles,
+	}
+	if q.quarantineMaxBytes == 0 {
+		q.quarantineMaxBytes = q.maxBytes
+	}
+	if q.quarantineMaxFiles == 0 {
+		q.quarantineMaxFiles = q.maxFiles
+	}
+	switch q.policy {
+	case "":
+		q.policy = EvictDropOldest
+	case EvictDropOldest, EvictDropNewest, EvictTagPriority:
+	default:
+		return nil, fmt.Errorf("unknown eviction policy: %s", q.policy)
+	}
+	if q.highWaterRatio == 0 {
+		q.highWaterRatio = defaultHighWaterRatio
+	}
+	if q.highWaterRatio < 0 || q.highWaterRatio > 1 {
+		return nil, fmt.Errorf("high_water_ratio must be in (0, 1], got %v", q.highWaterRatio)
+	}
+	return q, nil
+}
+
+// quarantineExceeded reports whether quarantine with given totals is over its limits
+func (q *quota) quarantineExceeded(bytes int64, files int) bool {
+	return (q.quarantineMaxBytes > 0 && bytes > q.quarantineMaxBytes) || (q.quarantineMaxFiles > 0 && files > q.quarantineMaxFiles)
+}
+
+func (q *quota) enabled() bool {
+	return q.maxBytes > 0 || q.maxFiles > 0 || q.maxAge > 0
+}
+
+func (q *quota) exceeded(bytes int64, files int) bool {
+	return (q.maxBytes > 0 && bytes > q.maxBytes) || (q.maxFiles > 0 && files > q.maxFiles)
+}
+
+func (q *quota) highWater(bytes int64, files int) bool {
+	return (q.maxBytes > 0 && float64(bytes) >= q.highWaterRatio*float64(q.maxBytes)) ||
+		(q.maxFiles > 0 && float64(files) >= q.highWaterRatio*float64(q.maxFiles))
+}
+
+// scanFiles returns finished backlog files of the dir sorted by creation time, oldest first
+func scanFiles(dir string) ([]*fileInfo, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]*fileInfo, 0, len(entries))
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), backlogSuffix) {
+			continue
+		}
+		files = append(files, &fileInfo{
+			name:      e.Name(),
+			size:      e.Size(),
+			createdAt: fileCreatedAt(e.Name(), e.ModTime()),
+		})
+	}
+	sortFiles(files)
+	return files, nil
+}
+
+func sortFiles(files []*fileInfo) {
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].createdAt.Equal(files[j].createdAt) {
+			return files[i].name < files[j].name
+		}
+		return files[i].createdAt.Before(files[j].createdAt)
+	})
+}
+
+// listFiles returns indexed backlog files sorted by creation time, oldest first
+func (b *Backlog) listFiles() []*fileInfo {
+	b.filesMu.Lock()
+	files := make([]*fileInfo, 0, len(b.files))
+	for _, f := range b.files {
+		files = append(files, f)
+	}
+	b.filesMu.Unlock()
+	sortFiles(files)
+	return files
+}
+
+// syncIndex rescans backlog directory, so files removed or added by backlog commands are noticed.
+// Headers of already indexed files aren't read again. XXX makeMu should be taken
+func (b *Backlog) syncIndex() error {
+	files, err := scanFiles(b.dir)
+	if err != nil {
+		return err
+	}
+	index := make(map[string]*fileInfo, len(files))
+	var added []string
+	b.filesMu.Lock()
+	for _, f := range files {
+		if known, found := b.files[f.name]; found {
+			f = known
+		} else {
+			added = append(added, f.name)
+		}
+		index[f.name] = f
+	}
+	b.files = index
+	b.filesMu.Unlock()
+	b.loadReplayStates(added)
+	return nil
+}
+
+func (b *Backlog) addFile(f *fileInfo) {
+	b.filesMu.Lock()
+	b.files[f.name] = f
+	b.filesMu.Unlock()
+}
+
+func (b *Backlog) removeFile(name string) {
+	b.filesMu.Lock()
+	delete(b.files, name)
+	b.filesMu.Unlock()
+}
+
+// fileCreatedAt extracts creation timestamp from file name made by MakeNewBacklogJob
+func fileCreatedAt(name string, modTime time.Time) time.Time {
+	p := strings.IndexByte(name, '_')
+	if p <= 0 {
+		return modTime
+	}
+	ts, err := strconv.ParseInt(name[:p], 10, 64)
+	if err != nil {
+		return modTime
+	}
+	return time.Unix(ts, 0)
+}
+
+// enforceQuota removes files violating the quota. incomingSize and incomingTag describe the file
+// which is going to be written; false is returned if it should be dropped instead.
+// XXX makeMu should be taken
+func (b *Backlog) enforceQuota(incomingSize int64, incomingTag string) bool {
+	q := b.quota
+	if !q.enabled() {
+		return true
+	}
+	files := b.listFiles()
+
+	now := time.Now()
+	var totalBytes int64
+	kept := files[:0]
+	for _, f := range files {
+		if q.maxAge > 0 && now.Sub(f.createdAt) > q.maxAge && !b.isInFlight(f.name) {
+			b.dropFile(f, "max_age")
+			continue
+		}
+		kept = append(kept, f)
+		totalBytes += f.size
+	}
+	files = kept
+	totalFiles := len(files)
+	if incomingSize > 0 {
+		totalBytes += incomingSize
+		totalFiles++
+	}
+
+	b.checkHighWater(totalBytes, totalFiles)
+
+	for q.exceeded(totalBytes, totalFiles) {
+		victim := b.pickVictim(files, incomingSize > 0, incomingTag)
+		if victim < 0 {
+			return incomingSize == 0
+		}
+		f := files[victim]
+		files = append(files[:victim], files[victim+1:]...)
+		if b.dropFile(f, "quota") {
+			totalBytes -= f.size
+			totalFiles--
+		}
+	}
+	return true
+}
+
+// pickVictim returns index of the file to drop or -1 if the incoming file should be dropped
+func (b *Backlog) pickVictim(files []*fileInfo, hasIncoming bool, incomingTag string) int {
+	candidates := make([]int, 0, len(files))
+	for i, f := range files {
+		if !b.isInFlight(f.name) {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return -1
+	}
+
+	switch b.quota.policy {
+	case EvictDropNewest:
+		if hasIncoming {
+			return -1
+		}
+		return candidates[len(candidates)-1]
+	case EvictTagPriority:
+		victim, lowest := -1, 0
+		for _, i := range candidates { // oldest first, so the oldest file wins among equal priorities
+			priority := b.quota.tagPriority[b.fileHeader(files[i]).Tag]
+			if victim < 0 || priority < lowest {
+				victim, lowest = i, priority
+			}
+		}
+		if hasIncoming && b.quota.tagPriority[incomingTag] < lowest {
+			return -1
+		}
+		return victim
+	default:
+		return candidates[0]
+	}
+}
+
+// fileHeader returns header of indexed file, it's read from disk at most once.
+// XXX makeMu should be taken
+func (b *Backlog) fileHeader(f *fileInfo) *Header {
+	if f.header != nil {
+		return f.header
+	}
+	f.header = &Header{}
+	file, err := os.Open(filepath.Join(b.dir, f.name))
+	if err != nil {
+		return f.header
+	}
+	defer file.Close()
+	if header, err := peekHeader(file); err == nil {
+		f.header = header
+	}
+	return f.header
+}
+
+// dropFile removes backlog file because of the quota
+func (b *Backlog) dropFile(f *fileInfo, reason string) bool {
+	header := b.fileHeader(f)
+	if err := os.Remove(filepath.Join(b.dir, f.name)); err != nil {
+		if os.IsNotExist(err) {
+			b.removeFile(f.name)
+		}
+		b.logger.Error().Err(err).Str("file", f.name).Msg("unable to remove backlog file")
+		b.metrics.Increment("remove_error")
+		return false
+	}
+	b.removeFile(f.name)
+	b.logger.Warn().Str("file", f.name).Str("tag", header.Tag).Str("reason", reason).Msg("backlog file dropped")
+	b.reportDropped(header.Tag, f.size, int(header.Lines), reason)
+	return true
+}
+
+// admitQuarantine reports whether a file of the size fits quarantine limits; quarantined files are never
+// evicted, so the incoming one is dropped instead. XXX makeMu should be taken
+func (b *Backlog) admitQuarantine(size int64) bool {
+	files, err := scanFiles(b.quarantineDir)
+	if err != nil && !os.IsNotExist(err) {
+		b.logger.Error().Err(err).Msg("unable to read quarantine directory")
+		return false
+	}
+	totalBytes := size
+	for _, f := range files {
+		totalBytes += f.size
+	}
+	return !b.quota.quarantineExceeded(totalBytes, len(files)+1)
+}
+
+func (b *Backlog) reportDropped(tag string, size int64, lines int, reason string) {
+	b.metrics.Increment("dropped.files", metrics.Label{Name: "reason", Value: reason})
+	b.metrics.Count("dropped.bytes", size, metrics.Tag(tag))
+	b.metrics.Count("dropped.lines", lines, metrics.Tag(tag))
+}
+
+func (b *Backlog) checkHighWater(bytes int64, files int) {
+	q := b.quota
+
+	above := q.highWater(bytes, files)
+	if above && !q.aboveHighWater {
+		b.logger.Warn().Int64("bytes", bytes).Int("files", files).
+			Int64("max_bytes", q.maxBytes).Int("max_files", q.maxFiles).
+			Msg("backlog crossed high-water mark")
+		b.metrics.Increment("high_water")
+	} else if !above && q.aboveHighWater {
+		b.logger.Info().Int64("bytes", bytes).Int("files", files).Msg("backlog is below high-water mark")
+	}
+	q.aboveHighWater = above
+}
+
+func (b *Backlog) isInFlight(name string) bool {
+	b.inFlightMu.Lock()
+	defer b.inFlightMu.Unlock()
+	return b.inFlight[name]
+}
+
+func (b *Backlog) setInFlight(name string, inFlight bool) {
+	b.inFlightMu.Lock()
+	defer b.inFlightMu.Unlock()
+	if inFlight {
+		b.inFlight[name] = true
+	} else {
+		delete(b.inFlight, name)
+	}
+}
@@ -0,0 +1,93 @@
+package backlog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+func newTestBacklog(t *testing.T, cfg config.Backlog) *Backlog {
+	dir, err := ioutil.TempDir("", "backlog")
+	assert.Nil(t, err)
+	cfg.Dir = dir
+	logger := zerolog.Nop()
+	b, err := New(cfg, metrics.Nop(), &logger)
+	assert.Nil(t, err)
+	return b
+}
+
+func writeTestFile(t *testing.T, b *Backlog, name, tag string) {
+	file, err := os.Create(filepath.Join(b.dir, name))
+	assert.Nil(t, err)
+	defer file.Close()
+	assert.Nil(t, writeFile(file, Header{Tag: tag, Target: targetPrefix + tag, Lines: 1}, []byte("{}\n")))
+	assert.Nil(t, b.syncIndex())
+}
+
+func listNames(t *testing.T, b *Backlog) []string {
+	files := b.listFiles()
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		names = append(names, f.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestEnforceQuota(t *testing.T) {
+	table := []struct {
+		policy         string
+		incomingTag    string
+		expectedAdmit  bool
+		expectedRemain []string
+	}{
+		{EvictDropOldest, "nginx:", true, []string{"200_b.backlog", "300_c.backlog"}},
+		{EvictDropNewest, "nginx:", false, []string{"100_a.backlog", "200_b.backlog", "300_c.backlog"}},
+		{EvictTagPriority, "nginx:", true, []string{"100_a.backlog", "300_c.backlog"}},
+		{EvictTagPriority, "debug:", false, []string{"100_a.backlog", "200_b.backlog", "300_c.backlog"}},
+	}
+
+	for _, p := range table {
+		b := newTestBacklog(t, config.Backlog{
+			MaxFiles:       3,
+			EvictionPolicy: p.policy,
+			TagPriority:    map[string]int{"nginx:": 10, "nginx_error:": 5, "debug:": 0},
+		})
+		writeTestFile(t, b, "100_a.backlog", "nginx:")
+		writeTestFile(t, b, "200_b.backlog", "nginx_error:")
+		writeTestFile(t, b, "300_c.backlog", "nginx:")
+
+		b.makeMu.Lock()
+		admit := b.enforceQuota(10, p.incomingTag)
+		b.makeMu.Unlock()
+
+		assert.Equal(t, p.expectedAdmit, admit, p.policy)
+		assert.Equal(t, p.expectedRemain, listNames(t, b), p.policy)
+		os.RemoveAll(b.dir)
+	}
+}
+
+func TestEnforceQuotaMaxAge(t *testing.T) {
+	b := newTestBacklog(t, config.Backlog{MaxAge: time.Hour})
+	defer os.RemoveAll(b.dir)
+
+	writeTestFile(t, b, "100_a.backlog", "nginx:")
+	writeTestFile(t, b, "100_b.backlog", "nginx:")
+	b.setInFlight("100_b.backlog", true)
+
+	b.makeMu.Lock()
+	assert.True(t, b.enforceQuota(0, ""))
+	b.makeMu.Unlock()
+
+	// files being uploaded are never removed
+	assert.Equal(t, []string{"100_b.backlog"}, listNames(t, b))
+}
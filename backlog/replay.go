@@ -0,0 +1,200 @@
+package backlog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"nginx-log-collector/clickhouse"
+	"nginx-log-collector/config"
+)
+
+const (
+	defaultReplayMaxBackoff = 30 * time.Minute
+	defaultQuarantineAfter  = 5
+	quarantineDirName       = "quarantine"
+	replayStateSuffix       = ".replay" // state of backlog file is stored next to it, e.g. 100_a.backlog.replay
+)
+
+// replayState keeps failed attempts of a single backlog file, it's persisted so restarts don't reset backoff
+type replayState struct {
+	Attempts      int       `json:"attempts"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+}
+
+var defaultRetryPolicy, _ = clickhouse.NewRetryPolicy(config.Retry{})
+
+// shouldReplay reports whether backoff of the file is over
+func (b *Backlog) shouldReplay(name string, now time.Time) bool {
+	b.replayMu.Lock()
+	defer b.replayMu.Unlock()
+	state, found := b.replayStates[name]
+	return !found || !now.Before(state.NextAttemptAt)
+}
+
+// recordFailure increments file attempts and returns their number
+func (b *Backlog) recordFailure(name string) int {
+	b.replayMu.Lock()
+	defer b.replayMu.Unlock()
+	state, found := b.replayStates[name]
+	if !found {
+		state = &replayState{}
+		b.replayStates[name] = state
+	}
+	state.Attempts++
+	state.NextAttemptAt = time.Now().Add(b.replayBackoff(state.Attempts))
+	if err := b.saveReplayState(name, state); err != nil {
+		b.logger.Error().Err(err).Str("file", name).Msg("unable to save replay state")
+		b.metrics.Increment("replay_state_error")
+	}
+	return state.Attempts
+}
+
+func (b *Backlog) forgetFile(name string) {
+	b.replayMu.Lock()
+	delete(b.replayStates, name)
+	b.replayMu.Unlock()
+	b.removeReplayState(name)
+}
+
+// saveReplayState atomically replaces state file of the backlog file. XXX replayMu should be taken
+func (b *Backlog) saveReplayState(name string, state *replayState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(b.dir, name+replayStateSuffix)
+	if err := ioutil.WriteFile(path+writeSuffix, data, 0644); err != nil {
+		return errors.Wrap(err, "unable to write replay state")
+	}
+	return errors.Wrap(os.Rename(path+writeSuffix, path), "unable to replace replay state")
+}
+
+// loadReplayStates reads persisted states of newly indexed files
+func (b *Backlog) loadReplayStates(names []string) {
+	b.replayMu.Lock()
+	defer b.replayMu.Unlock()
+	for _, name := range names {
+		if _, found := b.replayStates[name]; found {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(b.dir, name+replayStateSuffix))
+		if os.IsNotExist(err) {
+			continue
+		}
+		state := &replayState{}
+		if err == nil {
+			err = json.Unmarshal(data, state)
+		}
+		if err != nil {
+			// the file is replayed as a new one
+			b.logger.Warn().Err(err).Str("file", name).Msg("unable to load replay state")
+			b.metrics.Increment("replay_state_error")
+			continue
+		}
+		b.replayStates[name] = state
+	}
+}
+
+func (b *Backlog) removeReplayState(name string) {
+	if err := os.Remove(filepath.Join(b.dir, name+replayStateSuffix)); err != nil && !os.IsNotExist(err) {
+		b.logger.Warn().Err(err).Str("file", name).Msg("unable to remove replay state")
+	}
+}
+
+// removeOrphanReplayStates removes states of backlog files removed while the collector was stopped
+func removeOrphanReplayStates(dir string) error {
+	states, err := filepath.Glob(filepath.Join(dir, "*"+backlogSuffix+replayStateSuffix))
+	if err != nil {
+		return err
+	}
+	for _, path := range states {
+		if _, err := os.Stat(strings.TrimSuffix(path, replayStateSuffix)); os.IsNotExist(err) {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// forgetMissing drops states of files which are gone
+func (b *Backlog) forgetMissing(files []*fileInfo) {
+	present := make(map[string]bool, len(files))
+	for _, f := range files {
+		present[f.name] = true
+	}
+	var missing []string
+	b.replayMu.Lock()
+	for name := range b.replayStates {
+		if !present[name] {
+			delete(b.replayStates, name)
+			missing = append(missing, name)
+		}
+	}
+	b.replayMu.Unlock()
+	for _, name := range missing {
+		b.removeReplayState(name)
+	}
+}
+
+// replayBackoff returns exponential delay after given number of failed attempts
+func (b *Backlog) replayBackoff(attempts int) time.Duration {
+	delay := checkInterval
+	for i := 1; i < attempts && delay < b.replayMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > b.replayMaxBackoff {
+		delay = b.replayMaxBackoff
+	}
+	return delay
+}
+
+// retryPolicy returns retry policy of the file upload target
+func (b *Backlog) retryPolicy(header *Header) clickhouse.RetryPolicy {
+	b.targetsMu.RLock()
+	defer b.targetsMu.RUnlock()
+	if cluster, found := b.targets[strings.TrimPrefix(header.Target, targetPrefix)]; found {
+		return cluster.Retry()
+	}
+	return defaultRetryPolicy
+}
+
+// isRetryable reports whether the file upload may succeed later
+func (b *Backlog) isRetryable(header *Header, err error) bool {
+	if _, ok := errors.Cause(err).(*UnknownTargetError); ok {
+		return false
+	}
+	return b.retryPolicy(header).IsRetryable(err)
+}
+
+// quarantine moves file which can't be uploaded out of the replay queue,
+// the file is dropped if quarantine is full; false is returned then
+func (b *Backlog) quarantine(name string) (bool, error) {
+	if err := os.MkdirAll(b.quarantineDir, 0755); err != nil {
+		return false, errors.Wrap(err, "unable to create quarantine directory")
+	}
+
+	b.makeMu.Lock()
+	defer b.makeMu.Unlock()
+
+	b.filesMu.Lock()
+	f, found := b.files[name]
+	b.filesMu.Unlock()
+	if found && !b.admitQuarantine(f.size) {
+		b.dropFile(f, "quarantine_quota")
+		b.forgetFile(name)
+		return false, nil
+	}
+	if err := os.Rename(filepath.Join(b.dir, name), filepath.Join(b.quarantineDir, name)); err != nil {
+		return false, errors.Wrap(err, "unable to move file to quarantine")
+	}
+	b.removeFile(name)
+	b.forgetFile(name)
+	return true, nil
+}
@@ -0,0 +1,166 @@
+package backlog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+
+	"nginx-log-collector/clickhouse"
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+func TestReplayBackoff(t *testing.T) {
+	b := &Backlog{replayMaxBackoff: 5 * time.Minute}
+
+	table := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, checkInterval},
+		{2, 2 * checkInterval},
+		{3, 4 * checkInterval},
+		{10, 5 * time.Minute},
+	}
+
+	for _, p := range table {
+		assert.Equal(t, p.expected, b.replayBackoff(p.attempts))
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	b := newTestBacklog(t, config.Backlog{QuarantineAfter: 2})
+	defer os.RemoveAll(b.dir)
+
+	logger := zerolog.Nop()
+	cluster, err := clickhouse.NewCluster("nginx:", config.Upload{DSN: server.URL, Table: "db.table"}, 0, metrics.Nop(), &logger)
+	assert.Nil(t, err)
+	b.SetTargets(map[string]*clickhouse.Cluster{"nginx:": cluster})
+
+	writeTestFile(t, b, "100_a.backlog", "nginx:")
+
+	b.processFile("100_a.backlog")
+	assert.False(t, b.shouldReplay("100_a.backlog", time.Now()))
+	assert.Equal(t, []string{"100_a.backlog"}, listNames(t, b))
+
+	b.processFile("100_a.backlog")
+	assert.Equal(t, []string{}, listNames(t, b))
+	_, err = os.Stat(filepath.Join(b.dir, quarantineDirName, "100_a.backlog"))
+	assert.Nil(t, err)
+}
+
+func TestQuarantineUnknownTarget(t *testing.T) {
+	b := newTestBacklog(t, config.Backlog{QuarantineAfter: 1})
+	defer os.RemoveAll(b.dir)
+
+	writeTestFile(t, b, "100_a.backlog", "removed:")
+
+	b.processFile("100_a.backlog")
+	assert.Equal(t, []string{}, listNames(t, b))
+	_, err := os.Stat(filepath.Join(b.dir, quarantineDirName, "100_a.backlog"))
+	assert.Nil(t, err)
+}
+
+func TestMakeQuarantineJob(t *testing.T) {
+	b := newTestBacklog(t, config.Backlog{})
+	defer os.RemoveAll(b.dir)
+
+	assert.Nil(t, b.MakeQuarantineJob("nginx:", "nginx:", 1, []byte("{}\n")))
+	assert.Equal(t, []string{}, listNames(t, b))
+
+	files, err := filepath.Glob(filepath.Join(b.quarantineDir, "*"+backlogSuffix))
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+	stat := Stat(files[0])
+	assert.Nil(t, stat.Err)
+	assert.True(t, stat.CrcOK)
+	assert.Equal(t, "nginx:", stat.Header.Tag)
+}
+
+func TestHasTargetFiles(t *testing.T) {
+	b := newTestBacklog(t, config.Backlog{})
+	defer os.RemoveAll(b.dir)
+
+	assert.False(t, b.HasTargetFiles("nginx:"))
+	assert.Nil(t, b.MakeNewBacklogJob("nginx:", "nginx:", 1, []byte("{}\n")))
+	assert.True(t, b.HasTargetFiles("nginx:"))
+	assert.False(t, b.HasTargetFiles("nginx_error:"))
+}
+
+func TestQuarantineQuota(t *testing.T) {
+	b := newTestBacklog(t, config.Backlog{QuarantineAfter: 1, QuarantineMaxFiles: 1})
+	defer os.RemoveAll(b.dir)
+
+	assert.Nil(t, b.MakeQuarantineJob("nginx:", "nginx:", 1, []byte("{}\n")))
+	// quarantine is full, so the batch is dropped
+	assert.Nil(t, b.MakeQuarantineJob("nginx:", "nginx:", 1, []byte("{}\n")))
+	files, err := filepath.Glob(filepath.Join(b.quarantineDir, "*"+backlogSuffix))
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+
+	// and so is the backlog file failed with permanent error
+	writeTestFile(t, b, "100_a.backlog", "removed:")
+	b.processFile("100_a.backlog")
+	assert.Equal(t, []string{}, listNames(t, b))
+	_, err = os.Stat(filepath.Join(b.dir, "100_a.backlog"))
+	assert.True(t, os.IsNotExist(err))
+	files, err = filepath.Glob(filepath.Join(b.quarantineDir, "*"+backlogSuffix))
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestQuarantineQuotaDefaults(t *testing.T) {
+	q, err := newQuota(config.Backlog{MaxBytes: 100, MaxFiles: 10, QuarantineMaxFiles: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), q.quarantineMaxBytes)
+	assert.Equal(t, 2, q.quarantineMaxFiles)
+	assert.True(t, q.quarantineExceeded(101, 1))
+	assert.True(t, q.quarantineExceeded(10, 3))
+	assert.False(t, q.quarantineExceeded(100, 2))
+}
+
+func TestReplayStatePersisted(t *testing.T) {
+	b := newTestBacklog(t, config.Backlog{})
+	defer os.RemoveAll(b.dir)
+
+	writeTestFile(t, b, "100_a.backlog", "nginx:")
+	assert.Equal(t, 1, b.recordFailure("100_a.backlog"))
+	assert.Equal(t, 2, b.recordFailure("100_a.backlog"))
+
+	// attempts and backoff survive restart
+	logger := zerolog.Nop()
+	restarted, err := New(config.Backlog{Dir: b.dir}, metrics.Nop(), &logger)
+	assert.Nil(t, err)
+	assert.False(t, restarted.shouldReplay("100_a.backlog", time.Now()))
+	assert.Equal(t, 3, restarted.recordFailure("100_a.backlog"))
+
+	// state is removed along with the file
+	restarted.forgetFile("100_a.backlog")
+	_, err = os.Stat(filepath.Join(b.dir, "100_a.backlog"+replayStateSuffix))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRemoveOrphanReplayStates(t *testing.T) {
+	b := newTestBacklog(t, config.Backlog{})
+	defer os.RemoveAll(b.dir)
+
+	writeTestFile(t, b, "100_a.backlog", "nginx:")
+	b.recordFailure("100_a.backlog")
+	b.recordFailure("200_b.backlog") // removed by backlog rm while stopped
+
+	assert.Nil(t, removeOrphanReplayStates(b.dir))
+	states, err := filepath.Glob(filepath.Join(b.dir, "*"+replayStateSuffix))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{filepath.Join(b.dir, "100_a.backlog"+replayStateSuffix)}, states)
+}
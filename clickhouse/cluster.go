@@ -0,0 +1,325 @@
+package clickhouse
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+const (
+	StrategyRoundRobin     = "round-robin"
+	StrategyRandom         = "random"
+	StrategyFirstAvailable = "first-available"
+	StrategyLeastErrors    = "least-errors"
+
+	defaultEjectAfter    = 3
+	defaultEjectDuration = 30 * time.Second
+)
+
+var metricNameReplacer = strings.NewReplacer(".", "_", ":", "_")
+
+type endpoint struct {
+	url  string
+	host string // url without credentials, safe for logging
+
+	consecutiveFailures int
+	ejectedUntil        time.Time
+}
+
+// Cluster is a logical upload target consisting of one or more clickhouse replicas
+type Cluster struct {
+	name          string
+	query         string // insert query and settings without dsn credentials
+	endpoints     []*endpoint
+	strategy      string
+	compression   string
+	retry         RetryPolicy
+	ejectAfter    int
+	ejectDuration time.Duration
+
+	mu   *sync.Mutex
+	next int
+
+	logger  zerolog.Logger
+	metrics metrics.Metrics
+}
+
+func NewCluster(name string, cfg config.Upload, allowErrorRatio int, metrics metrics.Metrics, logger *zerolog.Logger) (*Cluster, error) {
+	dsnList := cfg.DSNs
+	if cfg.DSN != "" {
+		dsnList = append([]string{cfg.DSN}, dsnList...)
+	}
+	if len(dsnList) == 0 {
+		return nil, errors.New("no dsn configured")
+	}
+
+	endpoints := make([]*endpoint, 0, len(dsnList))
+	for _, dsn := range dsnList {
+		uploadUrl, err := MakeUrl(dsn, cfg.Table, true, allowErrorRatio)
+		if err != nil {
+			return nil, err
+		}
+		u, _ := url.Parse(uploadUrl)
+		endpoints = append(endpoints, &endpoint{url: uploadUrl, host: u.Host})
+	}
+
+	strategy := cfg.Strategy
+	if strategy == "" {
+		strategy = StrategyRoundRobin
+	}
+	if err := ValidateStrategy(strategy); err != nil {
+		return nil, err
+	}
+
+	compression := cfg.Compression
+	if compression == "" {
+		compression = CompressionNone
+	}
+	if err := ValidateCompression(compression); err != nil {
+		return nil, err
+	}
+
+	retry, err := NewRetryPolicy(cfg.Retry)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid retry policy")
+	}
+
+	ejectAfter := defaultEjectAfter
+	if cfg.EjectAfter > 0 {
+		ejectAfter = cfg.EjectAfter
+	}
+	ejectDuration := defaultEjectDuration
+	if cfg.EjectDuration > 0 {
+		ejectDuration = cfg.EjectDuration
+	}
+
+	return &Cluster{
+		name:          name,
+		query:         MakeQuery(cfg.Table, true, allowErrorRatio).Encode(),
+		endpoints:     endpoints,
+		strategy:      strategy,
+		compression:   compression,
+		retry:         retry,
+		ejectAfter:    ejectAfter,
+		ejectDuration: ejectDuration,
+		mu:            &sync.Mutex{},
+		logger:        logger.With().Str("target", name).Logger(),
+		metrics:       metrics,
+	}, nil
+}
+
+// ValidateStrategy checks that replica selection strategy is known
+func ValidateStrategy(strategy string) error {
+	switch strategy {
+	case "", StrategyRoundRobin, StrategyRandom, StrategyFirstAvailable, StrategyLeastErrors:
+		return nil
+	default:
+		return fmt.Errorf("unknown upload strategy: %s", strategy)
+	}
+}
+
+// Name returns logical target name which is stored in backlog files instead of url
+func (c *Cluster) Name() string {
+	return c.name
+}
+
+// Query returns url parameters of the insert query, they're stored in backlog files to replay them elsewhere
+func (c *Cluster) Query() string {
+	return c.query
+}
+
+func (c *Cluster) Retry() RetryPolicy {
+	return c.retry
+}
+
+// Upload sends data to one of the replicas retrying temporary errors on other replicas
+func (c *Cluster) Upload(data []byte) error {
+	body, err := Compress(c.compression, data)
+	if err != nil {
+		return errors.Wrap(err, "unable to compress data")
+	}
+	c.metrics.Count("upload_raw_bytes", len(data))
+	c.metrics.Count("upload_compressed_bytes", len(body))
+
+	tried := make(map[*endpoint]bool, len(c.endpoints))
+	for attempt := 1; ; attempt++ {
+		e := c.pick(tried)
+		tried[e] = true
+		err := c.report(e, UploadEncoded(e.url, bytes.NewReader(body), ContentEncoding(c.compression)))
+		if err == nil {
+			return nil
+		}
+		if !c.retry.IsRetryable(err) {
+			c.metrics.Increment("upload_permanent_error")
+			return err
+		}
+		if attempt >= c.retry.MaxAttempts {
+			c.metrics.Increment("upload_retries_exhausted")
+			return errors.Wrapf(err, "upload failed after %d attempts", attempt)
+		}
+		c.metrics.Increment("upload_retry")
+		if len(tried) == len(c.endpoints) {
+			tried = make(map[*endpoint]bool, len(c.endpoints))
+		}
+		time.Sleep(c.retry.Delay(attempt))
+	}
+}
+
+// UploadReader sends data to one of the replicas without retries.
+// Data is compressed on the fly so the whole batch is never loaded into memory
+func (c *Cluster) UploadReader(data io.Reader) error {
+	e := c.pick(nil)
+	if c.compression == CompressionNone {
+		return c.report(e, UploadReader(e.url, data))
+	}
+
+	// counters are owned by the compressing goroutine until it's done
+	raw := &countingReader{r: data}
+	pr, pw := io.Pipe()
+	compressed := &countingWriter{w: pw}
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		w, err := NewCompressWriter(c.compression, compressed)
+		if err == nil {
+			_, err = io.Copy(w, raw)
+			if closeErr := w.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+
+	err := c.report(e, UploadEncoded(e.url, pr, ContentEncoding(c.compression)))
+	pr.Close() // unblocks compressing goroutine if request fails early
+	<-done
+	c.metrics.Count("upload_raw_bytes", raw.n)
+	c.metrics.Count("upload_compressed_bytes", compressed.n)
+	return err
+}
+
+// pick selects endpoint according to the strategy skipping ejected and already tried ones if possible
+func (c *Cluster) pick(tried map[*endpoint]bool) *endpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	candidates := make([]*endpoint, 0, len(c.endpoints))
+	for _, e := range c.endpoints {
+		if !tried[e] && now.After(e.ejectedUntil) {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		// every replica is unhealthy; try them anyway rather than fail without a request
+		for _, e := range c.endpoints {
+			if !tried[e] {
+				candidates = append(candidates, e)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = c.endpoints
+	}
+
+	switch c.strategy {
+	case StrategyRandom:
+		return candidates[rand.Intn(len(candidates))]
+	case StrategyFirstAvailable:
+		return candidates[0]
+	case StrategyLeastErrors:
+		best := candidates[0]
+		for _, e := range candidates[1:] {
+			if e.consecutiveFailures < best.consecutiveFailures {
+				best = e
+			}
+		}
+		return best
+	default:
+		c.next++
+		return candidates[c.next%len(candidates)]
+	}
+}
+
+// report updates endpoint health and returns err annotated with the endpoint host
+func (c *Cluster) report(e *endpoint, err error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err == nil {
+		e.consecutiveFailures = 0
+		return nil
+	}
+
+	if c.retry.IsRetryable(err) { // permanent errors are caused by data, not by replica
+		e.consecutiveFailures++
+		metrics.StatsdOnly(c.metrics).Increment(fmt.Sprintf("endpoint.%s.error", metricName(e.host)))
+		metrics.PrometheusOnly(c.metrics).Increment("endpoint_error", metrics.Label{Name: "endpoint", Value: e.host})
+		if e.consecutiveFailures >= c.ejectAfter {
+			e.ejectedUntil = time.Now().Add(c.ejectDuration)
+			// give the endpoint a single chance after ejection expires
+			e.consecutiveFailures = c.ejectAfter - 1
+			metrics.StatsdOnly(c.metrics).Increment(fmt.Sprintf("endpoint.%s.ejected", metricName(e.host)))
+			metrics.PrometheusOnly(c.metrics).Increment("endpoint_ejected", metrics.Label{Name: "endpoint", Value: e.host})
+			c.logger.Warn().Str("endpoint", e.host).Dur("duration", c.ejectDuration).Msg("endpoint ejected")
+		}
+	}
+	return errors.Wrapf(err, "endpoint %s", e.host)
+}
+
+func metricName(s string) string {
+	return metricNameReplacer.Replace(s)
+}
+
+// UploadCompressed sends data compressed with the codec to one of the replicas without retries.
+// Data is sent as is if the codec matches cluster compression and recompressed otherwise
+func (c *Cluster) UploadCompressed(data io.Reader, codec string) error {
+	if codec == "" {
+		codec = CompressionNone
+	}
+	if codec == c.compression {
+		e := c.pick(nil)
+		return c.report(e, UploadEncoded(e.url, data, ContentEncoding(codec)))
+	}
+
+	decompressed, err := NewDecompressReader(codec, data)
+	if err != nil {
+		return errors.Wrap(err, "unable to decompress data")
+	}
+	defer decompressed.Close()
+	return c.UploadReader(decompressed)
+}
+
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+	return n, err
+}
@@ -0,0 +1,119 @@
+package clickhouse
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+func newTestCluster(t *testing.T, cfg config.Upload) *Cluster {
+	logger := zerolog.Nop()
+	cluster, err := NewCluster("test:", cfg, 0, metrics.Nop(), &logger)
+	assert.Nil(t, err)
+	return cluster
+}
+
+func TestClusterFailover(t *testing.T) {
+	var brokenHits, healthyHits int32
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&brokenHits, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&healthyHits, 1)
+	}))
+	defer healthy.Close()
+
+	cluster := newTestCluster(t, config.Upload{
+		Table:      "db.table",
+		DSNs:       []string{broken.URL, healthy.URL},
+		Strategy:   StrategyFirstAvailable,
+		EjectAfter: 2,
+		Retry:      config.Retry{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+	})
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, cluster.Upload([]byte("{}\n")))
+	}
+	// broken endpoint is ejected after two consecutive failures
+	assert.Equal(t, int32(2), atomic.LoadInt32(&brokenHits))
+	assert.Equal(t, int32(5), atomic.LoadInt32(&healthyHits))
+}
+
+func TestClusterPermanentError(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	cluster := newTestCluster(t, config.Upload{Table: "db.table", DSN: server.URL})
+
+	err := cluster.Upload([]byte("{}\n"))
+	assert.NotNil(t, err)
+	assert.False(t, cluster.Retry().IsRetryable(err))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+}
+
+func TestClusterUnknownStrategy(t *testing.T) {
+	logger := zerolog.Nop()
+	_, err := NewCluster("test:", config.Upload{DSN: "http://localhost", Strategy: "foo"}, 0, metrics.Nop(), &logger)
+	assert.NotNil(t, err)
+}
+
+func TestClusterCompression(t *testing.T) {
+	data := []byte(`{"status":200}` + "\n")
+	var received []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := NewDecompressReader(r.Header.Get("Content-Encoding"), r.Body)
+		assert.Nil(t, err)
+		received, err = ioutil.ReadAll(body)
+		assert.Nil(t, err)
+	}))
+	defer server.Close()
+
+	for _, codec := range []string{CompressionNone, CompressionGzip, CompressionZstd} {
+		cluster := newTestCluster(t, config.Upload{Table: "db.table", DSN: server.URL, Compression: codec})
+
+		received = nil
+		assert.Nil(t, cluster.Upload(data), codec)
+		assert.Equal(t, data, received, codec)
+
+		received = nil
+		assert.Nil(t, cluster.UploadReader(bytes.NewReader(data)), codec)
+		assert.Equal(t, data, received, codec)
+
+		for _, payloadCodec := range []string{CompressionNone, CompressionGzip} {
+			payload, err := Compress(payloadCodec, data)
+			assert.Nil(t, err)
+
+			received = nil
+			assert.Nil(t, cluster.UploadCompressed(bytes.NewReader(payload), payloadCodec), codec)
+			assert.Equal(t, data, received, codec)
+		}
+	}
+}
+
+func TestClusterUploadReaderEarlyFailure(t *testing.T) {
+	// server fails without reading the body while data is still being compressed
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	cluster := newTestCluster(t, config.Upload{Table: "db.table", DSN: server.URL, Compression: CompressionGzip})
+	data := bytes.Repeat([]byte(`{"status":200}`+"\n"), 1<<20)
+	assert.NotNil(t, cluster.UploadReader(bytes.NewReader(data)))
+}
@@ -0,0 +1,112 @@
+package clickhouse
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionLz4  = "lz4"
+)
+
+// ValidateCompression checks that codec is supported by both collector and clickhouse http interface
+func ValidateCompression(codec string) error {
+	switch codec {
+	case "", CompressionNone, CompressionGzip, CompressionZstd, CompressionLz4:
+		return nil
+	default:
+		return fmt.Errorf("unknown compression: %s", codec)
+	}
+}
+
+// ContentEncoding returns value of Content-Encoding header for the codec
+func ContentEncoding(codec string) string {
+	if codec == CompressionNone {
+		return ""
+	}
+	return codec
+}
+
+// NewCompressWriter returns writer compressing data with the codec
+func NewCompressWriter(codec string, w io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case "", CompressionNone:
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	case CompressionLz4:
+		return lz4.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unknown compression: %s", codec)
+	}
+}
+
+// NewDecompressReader returns reader decompressing data compressed with the codec
+func NewDecompressReader(codec string, r io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case "", CompressionNone:
+		return nopReadCloser{r}, nil
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zstdReadCloser{d}, nil
+	case CompressionLz4:
+		return nopReadCloser{lz4.NewReader(r)}, nil
+	default:
+		return nil, fmt.Errorf("unknown compression: %s", codec)
+	}
+}
+
+// Compress compresses whole data with the codec
+func Compress(codec string, data []byte) ([]byte, error) {
+	if codec == "" || codec == CompressionNone {
+		return data, nil
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, len(data)/4))
+	w, err := NewCompressWriter(codec, buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+type nopReadCloser struct {
+	io.Reader
+}
+
+func (nopReadCloser) Close() error { return nil }
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
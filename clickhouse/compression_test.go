@@ -0,0 +1,31 @@
+package clickhouse
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"event_datetime":"2018-10-10 10:10:10","status":200}`+"\n"), 100)
+
+	for _, codec := range []string{CompressionNone, CompressionGzip, CompressionZstd, CompressionLz4} {
+		compressed, err := Compress(codec, data)
+		assert.Nil(t, err, codec)
+
+		r, err := NewDecompressReader(codec, bytes.NewReader(compressed))
+		assert.Nil(t, err, codec)
+		decompressed, err := ioutil.ReadAll(r)
+		assert.Nil(t, err, codec)
+		assert.Nil(t, r.Close(), codec)
+		assert.Equal(t, data, decompressed, codec)
+	}
+}
+
+func TestValidateCompression(t *testing.T) {
+	assert.Nil(t, ValidateCompression(""))
+	assert.Nil(t, ValidateCompression(CompressionZstd))
+	assert.NotNil(t, ValidateCompression("brotli"))
+}
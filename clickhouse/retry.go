@@ -0,0 +1,93 @@
+package clickhouse
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"nginx-log-collector/config"
+)
+
+const (
+	defaultMaxAttempts = 3
+	defaultBaseDelay   = 500 * time.Millisecond
+	defaultMaxDelay    = 10 * time.Second
+	defaultJitter      = 0.2
+)
+
+// RetryPolicy describes how failed uploads are retried before giving up
+type RetryPolicy struct {
+	MaxAttempts       int
+	BaseDelay         time.Duration
+	MaxDelay          time.Duration
+	Jitter            float64
+	RetryableStatuses map[int]bool // empty means 5xx and 429
+}
+
+func NewRetryPolicy(cfg config.Retry) (RetryPolicy, error) {
+	p := RetryPolicy{
+		MaxAttempts: cfg.MaxAttempts,
+		BaseDelay:   cfg.BaseDelay,
+		MaxDelay:    cfg.MaxDelay,
+		Jitter:      defaultJitter,
+	}
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaultMaxAttempts
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = defaultBaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = defaultMaxDelay
+	}
+	if p.MaxDelay < p.BaseDelay {
+		return p, fmt.Errorf("max_delay %s is less than base_delay %s", p.MaxDelay, p.BaseDelay)
+	}
+	if cfg.Jitter != nil {
+		p.Jitter = *cfg.Jitter
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return p, fmt.Errorf("jitter must be in [0, 1], got %v", p.Jitter)
+	}
+	if len(cfg.RetryableStatuses) > 0 {
+		p.RetryableStatuses = make(map[int]bool, len(cfg.RetryableStatuses))
+		for _, s := range cfg.RetryableStatuses {
+			p.RetryableStatuses[s] = true
+		}
+	}
+	return p, nil
+}
+
+// IsRetryable reports whether upload error is temporary.
+// Network errors are always retryable, http statuses are checked against the policy
+func (p RetryPolicy) IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	statusErr, ok := errors.Cause(err).(*StatusError)
+	if !ok {
+		return true
+	}
+	if len(p.RetryableStatuses) > 0 {
+		return p.RetryableStatuses[statusErr.StatusCode]
+	}
+	return statusErr.StatusCode >= 500 || statusErr.StatusCode == 429
+}
+
+// Delay returns backoff duration before given retry attempt (starting from 1)
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		delta := p.Jitter * float64(delay)
+		delay = time.Duration(float64(delay) - delta + rand.Float64()*2*delta)
+	}
+	return delay
+}
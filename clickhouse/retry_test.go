@@ -0,0 +1,70 @@
+package clickhouse
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"nginx-log-collector/config"
+)
+
+func TestIsRetryable(t *testing.T) {
+	defaultPolicy, err := NewRetryPolicy(config.Retry{})
+	assert.Nil(t, err)
+	customPolicy, err := NewRetryPolicy(config.Retry{RetryableStatuses: []int{503}})
+	assert.Nil(t, err)
+
+	table := []struct {
+		policy   RetryPolicy
+		err      error
+		expected bool
+	}{
+		{defaultPolicy, errors.New("connection refused"), true},
+		{defaultPolicy, &StatusError{StatusCode: 500}, true},
+		{defaultPolicy, &StatusError{StatusCode: 429}, true},
+		{defaultPolicy, &StatusError{StatusCode: 400}, false},
+		{customPolicy, &StatusError{StatusCode: 503}, true},
+		{customPolicy, &StatusError{StatusCode: 500}, false},
+	}
+
+	for _, p := range table {
+		assert.Equal(t, p.expected, p.policy.IsRetryable(p.err))
+	}
+}
+
+func TestDelay(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+
+	table := []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{10, 5 * time.Second},
+	}
+
+	for _, p := range table {
+		assert.Equal(t, p.expected, policy.Delay(p.attempt))
+	}
+}
+
+func TestRetryPolicyJitter(t *testing.T) {
+	policy, err := NewRetryPolicy(config.Retry{})
+	assert.Nil(t, err)
+	assert.Equal(t, defaultJitter, policy.Jitter)
+
+	noJitter := 0.0
+	policy, err = NewRetryPolicy(config.Retry{Jitter: &noJitter})
+	assert.Nil(t, err)
+	assert.Equal(t, 0.0, policy.Jitter)
+	assert.Equal(t, policy.BaseDelay, policy.Delay(1))
+
+	invalid := 1.5
+	_, err = NewRetryPolicy(config.Retry{Jitter: &invalid})
+	assert.Error(t, err)
+}
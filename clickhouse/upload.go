@@ -13,12 +13,33 @@ import (
 
 const TIMEOUT = time.Minute * 5
 
+// StatusError is returned when clickhouse responds with non-200 status
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("clickhouse response status %d: %s", e.StatusCode, e.Body)
+}
+
 func Upload(uploadUrl string, data []byte) error {
 	return UploadReader(uploadUrl, bytes.NewReader(data))
 }
 
 func UploadReader(uploadUrl string, data io.Reader) error {
+	return UploadEncoded(uploadUrl, data, "")
+}
+
+// UploadEncoded uploads data which is already compressed according to contentEncoding
+func UploadEncoded(uploadUrl string, data io.Reader, contentEncoding string) error {
 	req, err := http.NewRequest("POST", uploadUrl, data)
+	if err != nil {
+		return errors.Wrap(err, "unable to create upload request")
+	}
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
 	client := &http.Client{Timeout: TIMEOUT}
 	resp, err := client.Do(req)
 	if err != nil {
@@ -29,7 +50,7 @@ func UploadReader(uploadUrl string, data io.Reader) error {
 	body, _ := ioutil.ReadAll(resp.Body)
 
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("clickhouse response status %d: %s", resp.StatusCode, string(body))
+		return &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
 	return nil
 }
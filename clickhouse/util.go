@@ -19,14 +19,28 @@ func MakeUrl(dsn, table string, skipUnknownFields bool, allowErrorRatio int) (st
 	}
 
 	q := u.Query()
-	q.Set("query", fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", table))
+	for name, values := range MakeQuery(table, skipUnknownFields, allowErrorRatio) {
+		q[name] = values
+	}
+
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// MakeQuery returns url parameters of insert query and input format settings, dsn parameters aren't included
+func MakeQuery(table string, skipUnknownFields bool, allowErrorRatio int) url.Values {
+	q := url.Values{}
+	q.Set("query", InsertQuery(table))
 	if skipUnknownFields {
 		q.Set("input_format_skip_unknown_fields", "1")
 	}
 	if allowErrorRatio > 0 {
 		q.Set("input_format_allow_errors_ratio", strconv.Itoa(allowErrorRatio))
 	}
+	return q
+}
 
-	u.RawQuery = q.Encode()
-	return u.String(), nil
+// InsertQuery returns query inserting JSONEachRow data into the table
+func InsertQuery(table string) string {
+	return fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", table)
 }
@@ -1,12 +1,30 @@
 package config
 
 import (
+	"time"
+
 	"nginx-log-collector/processor/functions"
 )
 
 type Backlog struct {
 	Dir                       string `yaml:"dir"`
 	MaxConcurrentHttpRequests int    `yaml:"max_concurrent_http_requests"`
+	Compression               string `yaml:"compression"` // none | gzip | zstd | lz4
+
+	MaxBytes       int64          `yaml:"max_bytes"`
+	MaxFiles       int            `yaml:"max_files"`
+	MaxAge         time.Duration  `yaml:"max_age"`
+	EvictionPolicy string         `yaml:"eviction_policy"` // drop-oldest | drop-newest | tag-priority
+	TagPriority    map[string]int `yaml:"tag_priority"`    // higher priority is evicted later
+	HighWaterRatio float64        `yaml:"high_water_ratio"`
+
+	ReplayRateLimit  int64         `yaml:"replay_rate_limit"` // bytes per second
+	ReplayMaxBackoff time.Duration `yaml:"replay_max_backoff"`
+	QuarantineDir    string        `yaml:"quarantine_dir"`
+	QuarantineAfter  int           `yaml:"quarantine_after"` // attempts failed with permanent errors
+
+	QuarantineMaxBytes int64 `yaml:"quarantine_max_bytes"` // max_bytes by default
+	QuarantineMaxFiles int   `yaml:"quarantine_max_files"` // max_files by default
 }
 
 type CollectedLog struct {
@@ -21,9 +39,80 @@ type CollectedLog struct {
 	Audit bool `yaml:"audit"` // debug feature
 }
 
+type FileReceiver struct {
+	Enabled      bool          `yaml:"enabled"`
+	StateFile    string        `yaml:"state_file"`
+	PollInterval time.Duration `yaml:"poll_interval"`
+	RotateWait   time.Duration `yaml:"rotate_wait"` // how long rotated file is read after it stops matching
+	MaxLineSize  int           `yaml:"max_line_size"`
+	Inputs       []FileInput   `yaml:"inputs"`
+}
+
+type FileInput struct {
+	Path     string `yaml:"path"` // glob pattern
+	Tag      string `yaml:"tag"`
+	Hostname string `yaml:"hostname"`
+}
+
+type ForwardReceiver struct {
+	Enabled        bool           `yaml:"enabled"`
+	Addr           string         `yaml:"addr"`
+	MaxMessageSize int            `yaml:"max_message_size"`
+	HostnameKey    string         `yaml:"hostname_key"` // record field, nested keys are separated by dots
+	Routes         []ForwardRoute `yaml:"routes"`
+}
+
+type ForwardRoute struct {
+	Match      string `yaml:"match"` // fluent tag pattern
+	Tag        string `yaml:"tag"`
+	MessageKey string `yaml:"message_key"` // record field with raw log line, whole record is sent as json if empty
+}
+
 type HttpReceiver struct {
-	Enabled bool   `yaml:"enabled"`
-	Url     string `yaml:"url"`
+	Enabled       bool         `yaml:"enabled"`
+	Url           string       `yaml:"url"`
+	TLS           TLS          `yaml:"tls"`
+	Parsers       []LineParser `yaml:"parsers"`
+	DefaultParser string       `yaml:"default_parser"`
+	Loki          LokiPush     `yaml:"loki"`
+	OTLP          OTLPLogs     `yaml:"otlp"`
+	Elastic       ElasticBulk  `yaml:"elasticsearch"`
+	Auth          HttpAuth     `yaml:"auth"`
+}
+
+type HttpAuth struct {
+	Enabled        bool          `yaml:"enabled"`
+	KeysFile       string        `yaml:"keys_file"`
+	ReloadInterval time.Duration `yaml:"reload_interval"` // keys file is reloaded once changed
+	MaxClockSkew   time.Duration `yaml:"max_clock_skew"`  // of hmac signed requests
+}
+
+type LineParser struct {
+	Name            string            `yaml:"name"`
+	Tag             string            `yaml:"tag"`
+	Pattern         string            `yaml:"pattern"`
+	DatetimeLayouts []string          `yaml:"datetime_layouts"`
+	Continuation    string            `yaml:"continuation"`
+	Fields          map[string]string `yaml:"fields"`
+}
+
+type LokiPush struct {
+	Enabled       bool              `yaml:"enabled"`
+	HostnameLabel string            `yaml:"hostname_label"`
+	TagLabel      string            `yaml:"tag_label"`
+	Fields        map[string]string `yaml:"fields"` // json field to stream label
+}
+
+type ElasticBulk struct {
+	Enabled       bool           `yaml:"enabled"`
+	Version       string         `yaml:"version"` // reported to shippers on handshake
+	HostnameField string         `yaml:"hostname_field"`
+	Indices       []ElasticIndex `yaml:"indices"`
+}
+
+type ElasticIndex struct {
+	Match string `yaml:"match"` // glob of index name
+	Tag   string `yaml:"tag"`
 }
 
 type Logging struct {
@@ -31,6 +120,12 @@ type Logging struct {
 	Path  string `yaml:"path"`
 }
 
+type OTLPLogs struct {
+	Enabled           bool   `yaml:"enabled"`
+	TagAttribute      string `yaml:"tag_attribute"`
+	HostnameAttribute string `yaml:"hostname_attribute"`
+}
+
 type PProf struct {
 	Addr    string `yaml:"addr"`
 	Enabled bool   `yaml:"enabled"`
@@ -40,6 +135,21 @@ type Processor struct {
 	Workers int `yaml:"workers"`
 }
 
+type Prometheus struct {
+	Addr      string `yaml:"addr"`
+	Enabled   bool   `yaml:"enabled"`
+	Path      string `yaml:"path"`
+	Namespace string `yaml:"namespace"`
+}
+
+type Retry struct {
+	MaxAttempts       int           `yaml:"max_attempts"`
+	BaseDelay         time.Duration `yaml:"base_delay"`
+	MaxDelay          time.Duration `yaml:"max_delay"`
+	Jitter            *float64      `yaml:"jitter"` // unset means default, 0 disables jitter
+	RetryableStatuses []int         `yaml:"retryable_statuses"`
+}
+
 type Statsd struct {
 	Addr    string `yaml:"addr"`
 	Enabled bool   `yaml:"enabled"`
@@ -47,22 +157,87 @@ type Statsd struct {
 }
 
 type TCPReceiver struct {
-	Addr string `yaml:"addr"`
+	Addr           string `yaml:"addr"`
+	Format         string `yaml:"format"`
+	MaxMessageSize int    `yaml:"max_message_size"`
+	TLS            TLS    `yaml:"tls"`
+
+	OverloadPolicy     string `yaml:"overload_policy"`
+	OverloadSampleRate int    `yaml:"overload_sample_rate"`
+	RateLimit          int64  `yaml:"rate_limit"`      // bytes per second for all connections
+	ConnRateLimit      int64  `yaml:"conn_rate_limit"` // bytes per second per connection
+
+	ProxyProtocol ProxyProtocol `yaml:"proxy_protocol"`
+}
+
+type ProxyProtocol struct {
+	Enabled      bool     `yaml:"enabled"`
+	TrustedCIDRs []string `yaml:"trusted_cidrs"` // balancers allowed to send the header
+	SourceField  string   `yaml:"source_field"`  // json field for the real source address
+
+	SourceMetricsCIDRs []string `yaml:"source_metrics_cidrs"` // label values of per-source metrics, off if empty
+}
+
+type TLS struct {
+	Enabled           bool              `yaml:"enabled"`
+	Cert              string            `yaml:"cert"`
+	Key               string            `yaml:"key"`
+	ClientCA          string            `yaml:"client_ca"`
+	MinVersion        string            `yaml:"min_version"`
+	RequireClientCert bool              `yaml:"require_client_cert"`
+	HostnameFromCN    bool              `yaml:"hostname_from_cn"`
+	CNHostnames       map[string]string `yaml:"cn_hostnames"`
+}
+
+type UDPReceiver struct {
+	Enabled        bool   `yaml:"enabled"`
+	Addr           string `yaml:"addr"`
+	ReadBufferSize int    `yaml:"read_buffer_size"`
+	Workers        int    `yaml:"workers"`
+	MaxMessageSize int    `yaml:"max_message_size"`
+}
+
+type UnixReceiver struct {
+	Enabled        bool   `yaml:"enabled"`
+	Network        string `yaml:"network"`
+	Path           string `yaml:"path"`
+	Mode           string `yaml:"mode"`
+	Owner          string `yaml:"owner"`
+	Group          string `yaml:"group"`
+	Format         string `yaml:"format"`
+	MaxMessageSize int    `yaml:"max_message_size"`
+}
+
+type ZmqReceiver struct {
+	Enabled bool   `yaml:"enabled"`
+	Addr    string `yaml:"addr"`
 }
 
 type Upload struct {
-	Table string `yaml:"table"`
-	DSN   string `yaml:"dsn"`
+	Table         string        `yaml:"table"`
+	DSN           string        `yaml:"dsn"`
+	DSNs          []string      `yaml:"dsns"`     // replicas of the same cluster
+	Strategy      string        `yaml:"strategy"` // round-robin | random | first-available | least-errors
+	EjectAfter    int           `yaml:"eject_after"`
+	EjectDuration time.Duration `yaml:"eject_duration"`
+	Compression   string        `yaml:"compression"` // none | gzip | zstd | lz4
+	Retry         Retry         `yaml:"retry"`
 }
 
 type Config struct {
-	Backlog       Backlog        `yaml:"backlog"`
-	CollectedLogs []CollectedLog `yaml:"collected_logs"`
-	HttpReceiver  HttpReceiver   `yaml:"httpReceiver"`
-	Logging       Logging        `yaml:"logging"`
-	PProf         PProf          `yaml:"pprof"`
-	Processor     Processor      `yaml:"processor"`
-	TCPReceiver   TCPReceiver    `yaml:"tcpReceiver"`
-	Statsd        Statsd         `yaml:"statsd"`
-	GoMaxProcs    int            `yaml:"gomaxprocs"`
+	Backlog         Backlog         `yaml:"backlog"`
+	CollectedLogs   []CollectedLog  `yaml:"collected_logs"`
+	FileReceiver    FileReceiver    `yaml:"fileReceiver"`
+	ForwardReceiver ForwardReceiver `yaml:"forwardReceiver"`
+	HttpReceiver    HttpReceiver    `yaml:"httpReceiver"`
+	Logging         Logging         `yaml:"logging"`
+	PProf           PProf           `yaml:"pprof"`
+	Processor       Processor       `yaml:"processor"`
+	Prometheus      Prometheus      `yaml:"prometheus"`
+	TCPReceiver     TCPReceiver     `yaml:"tcpReceiver"`
+	UDPReceiver     UDPReceiver     `yaml:"udpReceiver"`
+	UnixReceiver    UnixReceiver    `yaml:"unixReceiver"`
+	ZmqReceiver     ZmqReceiver     `yaml:"zmqReceiver"`
+	Statsd          Statsd          `yaml:"statsd"`
+	GoMaxProcs      int             `yaml:"gomaxprocs"`
 }
@@ -7,8 +7,11 @@ require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/goreleaser/nfpm v0.9.5
 	github.com/imdario/mergo v0.3.6 // indirect
+	github.com/klauspost/compress v1.11.13
 	github.com/kr/pretty v0.1.0 // indirect
 	github.com/mattn/go-zglob v0.0.0-20180803001819-2ea3427bfa53 // indirect
+	github.com/pebbe/zmq4 v1.2.1
+	github.com/pierrec/lz4 v2.6.1+incompatible
 	github.com/pkg/errors v0.8.0
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/rs/zerolog v1.9.1
@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"strings"
+)
+
+// Label is a metric dimension. Statsd appends label values to the bucket name,
+// prometheus exports them as labels
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Metrics is implemented by every metrics backend
+type Metrics interface {
+	Increment(name string, labels ...Label)
+	Count(name string, n interface{}, labels ...Label)
+	Gauge(name string, value interface{}, labels ...Label)
+	// Clone returns Metrics with name prefix and labels added to every metric
+	Clone(prefix string, labels ...Label) Metrics
+}
+
+// Tag returns label for collected log tag with trailing colon trimmed
+func Tag(tag string) Label {
+	tag = strings.TrimSuffix(tag, ":")
+	if tag == "" {
+		tag = "unknown"
+	}
+	return Label{Name: "tag", Value: tag}
+}
+
+type multi []Metrics
+
+// Multi sends metrics to every backend
+func Multi(list ...Metrics) Metrics {
+	return multi(list)
+}
+
+// Nop returns Metrics which discards everything
+func Nop() Metrics {
+	return multi(nil)
+}
+
+func (m multi) Increment(name string, labels ...Label) {
+	for _, b := range m {
+		b.Increment(name, labels...)
+	}
+}
+
+func (m multi) Count(name string, n interface{}, labels ...Label) {
+	for _, b := range m {
+		b.Count(name, n, labels...)
+	}
+}
+
+func (m multi) Gauge(name string, value interface{}, labels ...Label) {
+	for _, b := range m {
+		b.Gauge(name, value, labels...)
+	}
+}
+
+func (m multi) Clone(prefix string, labels ...Label) Metrics {
+	clone := make(multi, 0, len(m))
+	for _, b := range m {
+		clone = append(clone, b.Clone(prefix, labels...))
+	}
+	return clone
+}
+
+// StatsdOnly returns Metrics sending to statsd backend only.
+// It's used for legacy bucket names which don't fit prometheus naming
+func StatsdOnly(m Metrics) Metrics {
+	return only(m, func(b Metrics) bool {
+		_, ok := b.(*statsdMetrics)
+		return ok
+	})
+}
+
+// PrometheusOnly returns Metrics sending to prometheus backend only
+func PrometheusOnly(m Metrics) Metrics {
+	return only(m, func(b Metrics) bool {
+		_, ok := b.(*Prometheus)
+		return ok
+	})
+}
+
+func only(m Metrics, keep func(Metrics) bool) Metrics {
+	list, ok := m.(multi)
+	if !ok {
+		list = multi{m}
+	}
+	filtered := make(multi, 0, len(list))
+	for _, b := range list {
+		if nested, ok := b.(multi); ok {
+			filtered = append(filtered, only(nested, keep))
+		} else if keep(b) {
+			filtered = append(filtered, b)
+		}
+	}
+	return filtered
+}
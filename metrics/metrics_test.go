@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/alexcesaro/statsd.v2"
+)
+
+func TestStatsdBucket(t *testing.T) {
+	table := []struct {
+		name     string
+		labels   []Label
+		expected string
+	}{
+		{"upload_error", nil, "upload_error"},
+		{"ok.lines", []Label{Tag("nginx:")}, "ok.lines.nginx"},
+		{"endpoint_error", []Label{{"endpoint", "ch1.local:8123"}}, "endpoint_error.ch1_local_8123"},
+	}
+
+	for _, p := range table {
+		assert.Equal(t, p.expected, statsdBucket(p.name, p.labels))
+	}
+}
+
+func TestPrometheus(t *testing.T) {
+	p := NewPrometheus("nlc")
+	receiver := p.Clone("receiver", Label{"receiver", "tcp"})
+	receiver.Count("lines", 100)
+	receiver.Count("lines", 100)
+	receiver.Gauge("msg_chan_len", 5)
+	receiver.Gauge("msg_chan_len", 3)
+	p.Clone("uploader").Increment("ok.batches", Tag("nginx:"))
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, nil)
+	assert.Equal(t, `# TYPE nlc_receiver_lines_total counter
+nlc_receiver_lines_total{receiver="tcp"} 200
+# TYPE nlc_receiver_msg_chan_len gauge
+nlc_receiver_msg_chan_len{receiver="tcp"} 3
+# TYPE nlc_uploader_ok_batches_total counter
+nlc_uploader_ok_batches_total{tag="nginx"} 1
+`, w.Body.String())
+}
+
+func TestOnly(t *testing.T) {
+	client, err := statsd.New(statsd.Mute(true))
+	assert.Nil(t, err)
+	p := NewPrometheus("nlc")
+	m := Multi(NewStatsd(client), p).Clone("receiver", Label{"receiver", "tcp"})
+	assert.Len(t, StatsdOnly(m), 1)
+	assert.Len(t, StatsdOnly(Nop()), 0)
+
+	PrometheusOnly(m).Gauge("msg_chan_len", 3)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, nil)
+	assert.Equal(t, `# TYPE nlc_receiver_msg_chan_len gauge
+nlc_receiver_msg_chan_len{receiver="tcp"} 3
+`, w.Body.String())
+}
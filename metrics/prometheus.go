@@ -0,0 +1,176 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	kindCounter = "counter"
+	kindGauge   = "gauge"
+)
+
+var (
+	invalidNameChars   = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+	labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+type series struct {
+	name   string
+	kind   string
+	labels []Label
+	value  float64
+}
+
+type registry struct {
+	mu     *sync.Mutex
+	series map[string]*series
+}
+
+// Prometheus keeps metrics in memory and exposes them in prometheus text format
+type Prometheus struct {
+	registry *registry
+	prefix   string
+	labels   []Label
+}
+
+func NewPrometheus(namespace string) *Prometheus {
+	return &Prometheus{
+		registry: &registry{mu: &sync.Mutex{}, series: make(map[string]*series)},
+		prefix:   namespace,
+	}
+}
+
+func (p *Prometheus) Increment(name string, labels ...Label) {
+	p.add(kindCounter, name, 1, labels)
+}
+
+func (p *Prometheus) Count(name string, n interface{}, labels ...Label) {
+	p.add(kindCounter, name, toFloat(n), labels)
+}
+
+func (p *Prometheus) Gauge(name string, value interface{}, labels ...Label) {
+	p.add(kindGauge, name, toFloat(value), labels)
+}
+
+func (p *Prometheus) Clone(prefix string, labels ...Label) Metrics {
+	return &Prometheus{
+		registry: p.registry,
+		prefix:   joinName(p.prefix, prefix),
+		labels:   mergeLabels(p.labels, labels),
+	}
+}
+
+func (p *Prometheus) add(kind, name string, value float64, labels []Label) {
+	fullName := invalidNameChars.ReplaceAllString(joinName(p.prefix, name), "_")
+	if kind == kindCounter {
+		fullName += "_total"
+	}
+	allLabels := mergeLabels(p.labels, labels)
+	key := fullName + formatLabels(allLabels)
+
+	r := p.registry
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, found := r.series[key]
+	if !found {
+		s = &series{name: fullName, kind: kind, labels: allLabels}
+		r.series[key] = s
+	}
+	if kind == kindCounter {
+		s.value += value
+	} else {
+		s.value = value
+	}
+}
+
+// ServeHTTP writes all the metrics in prometheus text exposition format
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	r := p.registry
+	r.mu.Lock()
+	list := make([]series, 0, len(r.series))
+	for _, s := range r.series {
+		list = append(list, *s)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].name != list[j].name {
+			return list[i].name < list[j].name
+		}
+		return formatLabels(list[i].labels) < formatLabels(list[j].labels)
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	var prevName string
+	for _, s := range list {
+		if s.name != prevName {
+			fmt.Fprintf(w, "# TYPE %s %s\n", s.name, s.kind)
+			prevName = s.name
+		}
+		fmt.Fprintf(w, "%s%s %v\n", s.name, formatLabels(s.labels), s.value)
+	}
+}
+
+func joinName(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "_" + name
+}
+
+// mergeLabels returns labels sorted by name; later labels override earlier ones
+func mergeLabels(base, extra []Label) []Label {
+	if len(extra) == 0 {
+		return base
+	}
+	byName := make(map[string]string, len(base)+len(extra))
+	for _, l := range base {
+		byName[l.Name] = l.Value
+	}
+	for _, l := range extra {
+		byName[l.Name] = l.Value
+	}
+	merged := make([]Label, 0, len(byName))
+	for name, value := range byName {
+		merged = append(merged, Label{Name: name, Value: value})
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Name < merged[j].Name })
+	return merged
+}
+
+func formatLabels(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(labels))
+	for _, l := range labels {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, invalidNameChars.ReplaceAllString(l.Name, "_"), labelValueReplacer.Replace(l.Value)))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case uint32:
+		return float64(n)
+	case uint64:
+		return float64(n)
+	case float32:
+		return float64(n)
+	case float64:
+		return n
+	default:
+		return 0
+	}
+}
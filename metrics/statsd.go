@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"strings"
+
+	"gopkg.in/alexcesaro/statsd.v2"
+)
+
+var statsdReplacer = strings.NewReplacer(".", "_", ":", "_", " ", "_", "/", "_")
+
+type statsdMetrics struct {
+	client *statsd.Client
+}
+
+// NewStatsd wraps statsd client; label values become bucket name parts
+func NewStatsd(client *statsd.Client) Metrics {
+	return &statsdMetrics{client: client}
+}
+
+func (s *statsdMetrics) Increment(name string, labels ...Label) {
+	s.client.Increment(statsdBucket(name, labels))
+}
+
+func (s *statsdMetrics) Count(name string, n interface{}, labels ...Label) {
+	s.client.Count(statsdBucket(name, labels), n)
+}
+
+func (s *statsdMetrics) Gauge(name string, value interface{}, labels ...Label) {
+	s.client.Gauge(statsdBucket(name, labels), value)
+}
+
+func (s *statsdMetrics) Clone(prefix string, labels ...Label) Metrics {
+	return &statsdMetrics{client: s.client.Clone(statsd.Prefix(statsdBucket(prefix, labels)))}
+}
+
+func statsdBucket(name string, labels []Label) string {
+	if len(labels) == 0 {
+		return name
+	}
+	parts := make([]string, 0, len(labels)+1)
+	parts = append(parts, name)
+	for _, l := range labels {
+		parts = append(parts, statsdReplacer.Replace(l.Value))
+	}
+	return strings.Join(parts, ".")
+}
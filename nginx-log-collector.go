@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
@@ -13,9 +14,12 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"nginx-log-collector/backlog"
 	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
 	"nginx-log-collector/service"
 	"gopkg.in/alexcesaro/statsd.v2"
 	"gopkg.in/natefinch/lumberjack.v2"
@@ -25,17 +29,87 @@ import (
 // should be filled by go build
 var Version = "0.0.0-devel"
 
+// loadConfig loads startup config, it's validated like -check-config and reload do
 func loadConfig(configFile string) *config.Config {
+	cfg, errs := readConfig(configFile)
+	if cfg != nil {
+		errs = append(errs, service.CheckConfig(cfg)...)
+	}
+	if len(errs) > 0 {
+		log.Fatal().Err(joinErrors(errs)).Msg("unable to load config")
+	}
+	return cfg
+}
+
+// readConfig reads config file for startup, reload and -check-config, see parseConfig
+func readConfig(configFile string) (*config.Config, []error) {
 	data, err := ioutil.ReadFile(configFile)
 	if err != nil {
-		log.Fatal().Err(err).Msg("unable to read config file")
+		return nil, []error{errors.Wrap(err, "unable to read config file")}
 	}
+	return parseConfig(data)
+}
 
+// parseConfig decodes config rejecting unknown fields, every unknown field and type error is returned.
+// The rest of the config is still decoded, so its semantic errors can be reported along with them
+func parseConfig(data []byte) (*config.Config, []error) {
 	cfg := &config.Config{}
-	if err := yaml.Unmarshal(data, cfg); err != nil {
-		log.Fatal().Err(err).Msg("unable to parse config")
+	err := yaml.UnmarshalStrict(data, cfg)
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		errs := make([]error, 0, len(typeErr.Errors))
+		for _, e := range typeErr.Errors {
+			errs = append(errs, errors.New(e))
+		}
+		return cfg, errs
+	} else if err != nil {
+		return nil, []error{errors.Wrap(err, "unable to parse config")}
+	}
+	return cfg, nil
+}
+
+func joinErrors(errs []error) error {
+	messages := make([]string, 0, len(errs))
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return errors.New(strings.Join(messages, "; "))
+}
+
+// checkConfig validates config with unknown fields detection, prints all the errors
+// and returns process exit code
+func checkConfig(configFile string) int {
+	cfg, errs := readConfig(configFile)
+	if cfg != nil {
+		errs = append(errs, service.CheckConfig(cfg)...)
+	}
+
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "%s: %d errors found\n", configFile, len(errs))
+		return 1
+	}
+	fmt.Printf("%s: config ok\n", configFile)
+	return 0
+}
+
+// reloadOnSighup re-reads config on signals of c and applies it to the running service
+func reloadOnSighup(c <-chan os.Signal, configFile string, s *service.Service, logger *zerolog.Logger) {
+	for range c {
+		logger.Info().Msg("got SIGHUP; reloading config")
+		var err error
+		cfg, errs := readConfig(configFile)
+		if len(errs) > 0 {
+			s.ReloadFailed()
+			err = joinErrors(errs)
+		} else {
+			err = s.Reload(cfg)
+		}
+		if err != nil {
+			logger.Error().Err(err).Msg("config reload failed; keeping running config")
+		}
 	}
-	return cfg
 }
 
 func setupLogger(cfg config.Logging) (*zerolog.Logger, error) {
@@ -77,15 +151,55 @@ func setupStatsD(cfg config.Statsd) (*statsd.Client, error) {
 	)
 }
 
+// setupPrometheus starts http server exposing metrics in prometheus format
+func setupPrometheus(cfg config.Prometheus, logger *zerolog.Logger) *metrics.Prometheus {
+	namespace := cfg.Namespace
+	if namespace == "" {
+		namespace = "nginx_log_collector"
+	}
+	path := cfg.Path
+	if path == "" {
+		path = "/metrics"
+	}
+	prom := metrics.NewPrometheus(namespace)
+
+	mux := http.NewServeMux()
+	mux.Handle(path, prom)
+	logger.Info().Str("addr", cfg.Addr).Str("path", path).Msg("starting prometheus metrics server")
+	go func() {
+		logger.Warn().Err(
+			http.ListenAndServe(cfg.Addr, mux),
+		).Msg("prometheus metrics server error")
+	}()
+	return prom
+}
+
 func main() {
 	rand.Seed(time.Now().UnixNano())
 
+	if len(os.Args) > 1 && os.Args[1] == "backlog" {
+		if err := backlog.RunCommand(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	configFile := flag.String("config", "", "Config path")
+	checkConfigOnly := flag.Bool("check-config", false, "Validate config and exit")
 	flag.Parse()
 
 	if *configFile == "" {
 		log.Fatal().Msg("-config flag should be set")
 	}
+	if *checkConfigOnly {
+		os.Exit(checkConfig(*configFile))
+	}
+	// SIGHUP terminates the process by default, so it's caught before the service is started;
+	// signals received meanwhile are handled once the service is ready
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
 	cfg := loadConfig(*configFile)
 
 	logger, err := setupLogger(cfg.Logging)
@@ -100,10 +214,14 @@ func main() {
 		logger.Info().Int("gomaxprocs", cfg.GoMaxProcs).Msg("gomaxprocs set")
 	}
 
-	metrics, err := setupStatsD(cfg.Statsd)
+	statsdClient, err := setupStatsD(cfg.Statsd)
 	if err != nil {
 		logger.Fatal().Err(err).Msg("unable to setup statsd client")
 	}
+	var m metrics.Metrics = metrics.NewStatsd(statsdClient)
+	if cfg.Prometheus.Enabled {
+		m = metrics.Multi(m, setupPrometheus(cfg.Prometheus, logger))
+	}
 
 	done := make(chan struct{}, 1)
 	go func() {
@@ -114,11 +232,13 @@ func main() {
 		close(done)
 	}()
 
-	s, err := service.New(cfg, metrics, logger)
+	s, err := service.New(cfg, m, logger)
 	if err != nil {
 		logger.Fatal().Err(err).Msg("unable to init service")
 	}
 
+	go reloadOnSighup(hup, *configFile, s, logger)
+
 	if cfg.PProf.Enabled {
 		logger.Info().Msg("starting pprof server")
 		go func() {
@@ -8,9 +8,9 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
-	"gopkg.in/alexcesaro/statsd.v2"
 
 	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
 )
 
 const (
@@ -22,12 +22,34 @@ type Result struct {
 	Tag   string
 	Data  []byte
 	Lines int
+	Acks  []func() // of batch lines, see Message
+}
+
+// Ack notifies sources of batch lines that the batch is uploaded, stored to backlog or dropped for good
+func (r Result) Ack() {
+	for _, ack := range r.Acks {
+		ack()
+	}
+}
+
+// Message is a line of the source which commits its read position only once the line is uploaded
+// or stored to backlog, e.g. tailed files. Ack is called once, lines which can't be converted are acked at once
+type Message struct {
+	Data []byte
+	Ack  func()
+}
+
+func (m Message) ack() {
+	if m.Ack != nil {
+		m.Ack()
+	}
 }
 
 type Processor struct {
-	metrics *statsd.Client
+	metrics metrics.Metrics
 
-	tagContexts map[string]TagContext
+	tagContextsMu *sync.RWMutex
+	tagContexts   map[string]TagContext
 
 	resultChan chan Result
 
@@ -41,7 +63,25 @@ type TagContext struct {
 	Converter Converter
 }
 
-func New(cfg config.Processor, logs []config.CollectedLog, metrics *statsd.Client, logger *zerolog.Logger) (*Processor, error) {
+func New(cfg config.Processor, logs []config.CollectedLog, metrics metrics.Metrics, logger *zerolog.Logger) (*Processor, error) {
+	tagContexts, err := NewTagContexts(logs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Processor{
+		tagContextsMu: &sync.RWMutex{},
+		tagContexts:   tagContexts,
+		metrics:       metrics.Clone("processor"),
+		resultChan:    make(chan Result, 1000),
+		wg:            &sync.WaitGroup{},
+		workersCnt:    cfg.Workers,
+		logger:        logger.With().Str("component", "processor").Logger(),
+	}, nil
+}
+
+// NewTagContexts builds converters for every collected log
+func NewTagContexts(logs []config.CollectedLog) (map[string]TagContext, error) {
 	tagContexts := make(map[string]TagContext, len(logs))
 	for _, l := range logs {
 		converter, err := NewConverter(l)
@@ -54,22 +94,28 @@ func New(cfg config.Processor, logs []config.CollectedLog, metrics *statsd.Clien
 		}
 		tagContexts[l.Tag] = TagContext{Config: l, Converter: converter}
 	}
+	return tagContexts, nil
+}
 
-	return &Processor{
-		tagContexts: tagContexts,
-		metrics:     metrics.Clone(statsd.Prefix("processor")),
-		resultChan:  make(chan Result, 1000),
-		wg:          &sync.WaitGroup{},
-		workersCnt:  cfg.Workers,
-		logger:      logger.With().Str("component", "processor").Logger(),
-	}, nil
+// SetTagContexts atomically replaces tag contexts used by workers
+func (p *Processor) SetTagContexts(tagContexts map[string]TagContext) {
+	p.tagContextsMu.Lock()
+	p.tagContexts = tagContexts
+	p.tagContextsMu.Unlock()
+}
+
+func (p *Processor) getTagContexts() map[string]TagContext {
+	p.tagContextsMu.RLock()
+	defer p.tagContextsMu.RUnlock()
+	return p.tagContexts
 }
 
-func (p *Processor) Start(done <-chan struct{}, msgChanList ...chan []byte) {
+// Start runs workers reading messages of all the channels, lines of ackedChanList are acked once stored
+func (p *Processor) Start(done <-chan struct{}, ackedChanList []chan Message, msgChanList ...chan []byte) {
 	p.logger.Info().Msg("starting")
 	for i := 0; i < p.workersCnt; i++ {
 		p.wg.Add(1)
-		go p.Worker(done, p.aggregateChan(msgChanList))
+		go p.Worker(done, p.aggregateChan(ackedChanList, msgChanList))
 	}
 
 	p.wg.Add(1)
@@ -89,31 +135,43 @@ func (p *Processor) ResultChan() chan Result {
 	return p.resultChan
 }
 
-func (p *Processor) Worker(done <-chan struct{}, msgChan <-chan []byte) {
+func (p *Processor) Worker(done <-chan struct{}, msgChan <-chan Message) {
 	defer p.wg.Done()
 
 	tpMap := make(map[string]*tagProcessor)
-	for tag, tagContext := range p.tagContexts {
-		tp := newTagProcessor(tagContext.Config.BufferSize, tag)
-		tpMap[tag] = tp
-		p.wg.Add(1)
-		go tp.flusher(p.resultChan, done, p.wg)
+	getTagProcessor := func(tag string, tagContext TagContext) *tagProcessor {
+		tp, found := tpMap[tag]
+		if !found {
+			// tag was added by config reload
+			tp = newTagProcessor(tagContext.Config.BufferSize, tag)
+			tpMap[tag] = tp
+			p.wg.Add(1)
+			go tp.flusher(p.resultChan, done, p.wg)
+		}
+		tp.bufSize = tagContext.Config.BufferSize // only this worker writes to tp
+		return tp
+	}
+	for tag, tagContext := range p.getTagContexts() {
+		getTagProcessor(tag, tagContext)
 	}
 
-	for rawMsg := range msgChan {
+	for message := range msgChan {
+		rawMsg := message.Data
 		// format is defined in rsyslog
 		s := bytes.SplitN(rawMsg, []byte{'\t'}, 3)
 		if len(s) != 3 {
 			p.logger.Error().Bytes("msg", rawMsg).Int("len", len(s)).Msg("wrong message format")
 			p.metrics.Increment("format_error")
+			message.ack()
 			continue
 		}
 
 		hostname, tag, msg := string(s[0]), string(s[1]), s[2]
-		tagContext, found := p.tagContexts[tag]
+		tagContext, found := p.getTagContexts()[tag]
 		if !found {
 			p.logger.Warn().Str("host", hostname).Str("tag", tag).Msg("wrong tag")
 			p.metrics.Increment("tag_error")
+			message.ack()
 			continue
 		}
 
@@ -125,11 +183,13 @@ func (p *Processor) Worker(done <-chan struct{}, msgChan <-chan []byte) {
 
 			logEvent.Msg("convert error")
 			p.metrics.Increment("convert_error")
+			p.metrics.Increment("tag_convert_error", metrics.Tag(tag))
+			message.ack()
 			continue
 		}
 
-		tp := tpMap[tag]
-		tp.writeLine(converted, p.resultChan)
+		tp := getTagProcessor(tag, tagContext)
+		tp.writeLine(converted, message.Ack, p.resultChan)
 		if tagContext.Config.Audit {
 			p.logger.Error().Str("tag", tag).Msgf("write to buffer: %s", string(converted))
 		}
@@ -145,19 +205,30 @@ func (p *Processor) Worker(done <-chan struct{}, msgChan <-chan []byte) {
 }
 
 // aggregateChan aggregates list of channels to single channel
-func (p *Processor) aggregateChan(msgChanList []chan []byte) chan []byte {
+func (p *Processor) aggregateChan(ackedChanList []chan Message, msgChanList []chan []byte) chan Message {
 	bufferSize := 0
+	for _, msgChan := range ackedChanList {
+		bufferSize += cap(msgChan)
+	}
 	for _, msgChan := range msgChanList {
 		bufferSize += cap(msgChan)
 	}
 
-	aggregate := make(chan []byte, bufferSize)
+	aggregate := make(chan Message, bufferSize)
 	var wg sync.WaitGroup
-	wg.Add(len(msgChanList))
+	wg.Add(len(ackedChanList) + len(msgChanList))
+	for _, msgChan := range ackedChanList {
+		go func(msgChan <-chan Message) {
+			for msg := range msgChan {
+				aggregate <- msg
+			}
+			wg.Done()
+		}(msgChan)
+	}
 	for _, msgChan := range msgChanList {
 		go func(msgChan <-chan []byte) {
 			for msg := range msgChan {
-				aggregate <- msg
+				aggregate <- Message{Data: msg}
 			}
 			wg.Done()
 		}(msgChan)
@@ -180,7 +251,9 @@ func (p *Processor) queueMonitoring(done <-chan struct{}) {
 		select {
 		case <-ticker.C:
 			p.logger.Debug().Int("result_queue_len", len(p.resultChan)).Msg("queue stats")
-			p.metrics.Count("result_queue_len", len(p.resultChan))
+			// statsd keeps the legacy counter
+			metrics.StatsdOnly(p.metrics).Count("result_queue_len", len(p.resultChan))
+			metrics.PrometheusOnly(p.metrics).Gauge("result_queue_len", len(p.resultChan))
 		case <-done:
 			p.logger.Debug().Msg("queueMonitoring exit")
 			return
@@ -13,6 +13,7 @@ type tagProcessor struct {
 	tag         string
 	bufSize     int
 	linesInBuf  int
+	acks        []func() // of buffered lines
 }
 
 func newTagProcessor(bufferSize int, tag string) *tagProcessor {
@@ -40,12 +41,14 @@ func (t *tagProcessor) flush(resultChan chan Result) {
 		Tag:   t.tag,
 		Data:  clone,
 		Lines: t.linesInBuf,
+		Acks:  t.acks,
 	}
 	t.buffer.Reset()
 	t.linesInBuf = 0
+	t.acks = nil
 }
 
-func (t *tagProcessor) writeLine(data []byte, resultChan chan Result) {
+func (t *tagProcessor) writeLine(data []byte, ack func(), resultChan chan Result) {
 	t.mu.Lock()
 
 	if t.buffer.Len()+len(data) > t.bufSize {
@@ -53,6 +56,9 @@ func (t *tagProcessor) writeLine(data []byte, resultChan chan Result) {
 	}
 	t.buffer.Write(data)
 	t.linesInBuf += 1
+	if ack != nil {
+		t.acks = append(t.acks, ack)
+	}
 
 	t.mu.Unlock()
 }
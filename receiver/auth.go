@@ -0,0 +1,364 @@
+package receiver
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+const (
+	authSchemeBearer          = "Bearer"
+	authSchemeBasic           = "Basic"
+	authSchemeHMAC            = "HMAC-SHA256"
+	defaultAuthReloadInterval = 10 * time.Second
+	defaultAuthMaxClockSkew   = 5 * time.Minute
+	authMinSecretLength       = 16
+)
+
+type authContextKey struct{}
+
+// authKey is a secret scoped to hostnames and tags it may write
+type authKey struct {
+	id        string
+	secret    []byte
+	hostnames []string        // globs
+	tags      map[string]bool // trailing colon trimmed
+}
+
+// authKeysFile is the format of keys file
+type authKeysFile struct {
+	Keys []struct {
+		ID        string   `yaml:"id"`
+		Secret    string   `yaml:"secret"`
+		Hostnames []string `yaml:"hostnames"`
+		Tags      []string `yaml:"tags"`
+	} `yaml:"keys"`
+}
+
+// authKeys holds keys loaded from the file, the file is reloaded once changed
+type authKeys struct {
+	path           string
+	reloadInterval time.Duration
+	maxClockSkew   time.Duration
+
+	mu      *sync.RWMutex
+	byID    map[string]*authKey
+	byToken map[[sha256.Size]byte]*authKey
+	modTime time.Time
+	size    int64
+
+	// signatures of accepted HMAC requests until their timestamp leaves the skew window, so they can't be replayed
+	signaturesMu *sync.Mutex
+	signatures   map[string]time.Time
+	purgeAt      time.Time
+}
+
+// newAuthKeys returns nil if authentication is disabled
+func newAuthKeys(cfg config.HttpAuth) (*authKeys, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if cfg.KeysFile == "" {
+		return nil, errors.New("keys_file should be set")
+	}
+	a := &authKeys{
+		path:           cfg.KeysFile,
+		reloadInterval: cfg.ReloadInterval,
+		maxClockSkew:   cfg.MaxClockSkew,
+		mu:             &sync.RWMutex{},
+		signaturesMu:   &sync.Mutex{},
+		signatures:     make(map[string]time.Time),
+	}
+	if a.reloadInterval <= 0 {
+		a.reloadInterval = defaultAuthReloadInterval
+	}
+	if a.maxClockSkew <= 0 {
+		a.maxClockSkew = defaultAuthMaxClockSkew
+	}
+	if _, err := a.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// ValidateAuthConfig checks auth config and the keys file
+func ValidateAuthConfig(cfg config.HttpAuth) error {
+	_, err := newAuthKeys(cfg)
+	return err
+}
+
+// reload loads the keys file if it has changed; running keys are untouched on error
+func (a *authKeys) reload() (bool, error) {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return false, errors.Wrap(err, "unable to stat keys file")
+	}
+	a.mu.RLock()
+	unchanged := info.ModTime().Equal(a.modTime) && info.Size() == a.size
+	a.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return false, errors.Wrap(err, "unable to read keys file")
+	}
+	byID, byToken, err := parseAuthKeys(data)
+	if err != nil {
+		return false, errors.Wrapf(err, "invalid keys file %s", a.path)
+	}
+
+	a.mu.Lock()
+	a.byID, a.byToken = byID, byToken
+	a.modTime, a.size = info.ModTime(), info.Size()
+	a.mu.Unlock()
+	return true, nil
+}
+
+func parseAuthKeys(data []byte) (map[string]*authKey, map[[sha256.Size]byte]*authKey, error) {
+	var file authKeysFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, nil, err
+	}
+	byID := make(map[string]*authKey, len(file.Keys))
+	byToken := make(map[[sha256.Size]byte]*authKey, len(file.Keys))
+	for i, k := range file.Keys {
+		switch {
+		case k.ID == "":
+			return nil, nil, fmt.Errorf("keys[%d]: id should be set", i)
+		case byID[k.ID] != nil:
+			return nil, nil, fmt.Errorf("keys[%d]: duplicate id %s", i, k.ID)
+		case len(k.Secret) < authMinSecretLength:
+			return nil, nil, fmt.Errorf("keys[%d]: secret should be at least %d characters", i, authMinSecretLength)
+		case len(k.Hostnames) == 0 || len(k.Tags) == 0:
+			return nil, nil, fmt.Errorf("keys[%d]: hostnames and tags should be set, use \"*\" to allow any", i)
+		}
+		key := &authKey{id: k.ID, secret: []byte(k.Secret), hostnames: k.Hostnames, tags: make(map[string]bool, len(k.Tags))}
+		for _, pattern := range k.Hostnames {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, nil, fmt.Errorf("keys[%d]: invalid hostname pattern %q", i, pattern)
+			}
+		}
+		for _, tag := range k.Tags {
+			key.tags[strings.TrimSuffix(tag, ":")] = true
+		}
+		token := sha256.Sum256(key.secret)
+		if byToken[token] != nil {
+			return nil, nil, fmt.Errorf("keys[%d]: secret is shared with key %s", i, byToken[token].id)
+		}
+		byID[key.id] = key
+		byToken[token] = key
+	}
+	return byID, byToken, nil
+}
+
+// permits reports whether the key may write logs of the tag for the hostname
+func (k *authKey) permits(hostname, tag string) bool {
+	tag = strings.TrimSuffix(tag, ":")
+	if !k.tags["*"] && !k.tags[tag] {
+		return false
+	}
+	for _, pattern := range k.hostnames {
+		if matched, _ := path.Match(pattern, hostname); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate returns the key of the request:
+// "Authorization: Bearer <secret>", "Authorization: Basic <base64 of id:secret>" for shippers supporting
+// basic auth only or "Authorization: HMAC-SHA256 KeyId=<id>, Timestamp=<unix seconds>, Signature=<hex>",
+// where signature is HMAC-SHA256 of "<method>\n<request uri>\n<timestamp>\n<hex sha256 of body>".
+// Body of signed request is read to verify the signature
+func (a *authKeys) authenticate(w http.ResponseWriter, r *http.Request) (*authKey, error) {
+	scheme, credentials := r.Header.Get("Authorization"), ""
+	if i := strings.IndexByte(scheme, ' '); i > 0 {
+		scheme, credentials = scheme[:i], strings.TrimSpace(scheme[i+1:])
+	}
+
+	switch {
+	case scheme == "":
+		return nil, errors.New("missing authorization")
+	case strings.EqualFold(scheme, authSchemeBearer):
+		a.mu.RLock()
+		key := a.byToken[sha256.Sum256([]byte(credentials))]
+		a.mu.RUnlock()
+		if key == nil {
+			return nil, errors.New("invalid token")
+		}
+		return key, nil
+	case strings.EqualFold(scheme, authSchemeBasic):
+		id, secret, ok := r.BasicAuth()
+		if !ok {
+			return nil, errors.New("invalid basic credentials")
+		}
+		a.mu.RLock()
+		key := a.byToken[sha256.Sum256([]byte(secret))]
+		a.mu.RUnlock()
+		if key == nil || key.id != id {
+			return nil, errors.New("invalid basic credentials")
+		}
+		return key, nil
+	case strings.EqualFold(scheme, authSchemeHMAC):
+		return a.verifySignature(w, r, credentials)
+	default:
+		return nil, fmt.Errorf("unsupported authorization scheme %s", scheme)
+	}
+}
+
+func (a *authKeys) verifySignature(w http.ResponseWriter, r *http.Request, credentials string) (*authKey, error) {
+	params := make(map[string]string, 3)
+	for _, param := range strings.Split(credentials, ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToLower(kv[0])] = kv[1]
+		}
+	}
+
+	a.mu.RLock()
+	key := a.byID[params["keyid"]]
+	a.mu.RUnlock()
+	if key == nil {
+		return nil, fmt.Errorf("unknown key %q", params["keyid"])
+	}
+	timestamp, err := strconv.ParseInt(params["timestamp"], 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid timestamp")
+	}
+	signedAt := time.Unix(timestamp, 0)
+	if skew := time.Since(signedAt); skew > a.maxClockSkew || skew < -a.maxClockSkew {
+		return nil, fmt.Errorf("timestamp is %s off", skew.Round(time.Second))
+	}
+	signature, err := hex.DecodeString(params["signature"])
+	if err != nil {
+		return nil, errors.New("invalid signature")
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, ingestMaxBodySize))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read body")
+	}
+	_ = r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if !hmac.Equal(signature, signRequest(key.secret, r.Method, r.URL.RequestURI(), params["timestamp"], body)) {
+		return nil, errors.New("signature mismatch")
+	}
+	if a.replayed(hex.EncodeToString(signature), signedAt, time.Now()) {
+		return nil, errors.New("signature is already used")
+	}
+	return key, nil
+}
+
+// replayed remembers the signature and reports whether it has been seen within the skew window
+func (a *authKeys) replayed(signature string, signedAt, now time.Time) bool {
+	a.signaturesMu.Lock()
+	defer a.signaturesMu.Unlock()
+	if now.After(a.purgeAt) {
+		for s, expiresAt := range a.signatures {
+			if now.After(expiresAt) {
+				delete(a.signatures, s)
+			}
+		}
+		a.purgeAt = now.Add(a.maxClockSkew)
+	}
+	if _, found := a.signatures[signature]; found {
+		return true
+	}
+	a.signatures[signature] = signedAt.Add(a.maxClockSkew)
+	return false
+}
+
+// signRequest returns HMAC-SHA256 signature of the request
+func signRequest(secret []byte, method, requestURI, timestamp string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	_, _ = fmt.Fprintf(mac, "%s\n%s\n%s\n%s", method, requestURI, timestamp, hex.EncodeToString(bodyHash[:]))
+	return mac.Sum(nil)
+}
+
+// requireAuth rejects requests without valid key, the key is passed to handlers in request context
+func (h *HttpReceiver) requireAuth(next http.Handler) http.Handler {
+	if h.auth == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, err := h.auth.authenticate(w, r)
+		if err != nil {
+			h.logger.Warn().Err(err).Str("peer", r.RemoteAddr).Str("path", r.URL.Path).Msg("unauthorized request")
+			h.metrics.Increment("auth.unauthorized")
+			w.Header().Set("WWW-Authenticate", authSchemeBearer+` realm="nginx-log-collector"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authContextKey{}, key)))
+	})
+}
+
+// permitted reports whether the request key may write logs of the tag for the hostname
+func (h *HttpReceiver) permitted(r *http.Request, hostname, tag string) bool {
+	if h.auth == nil {
+		return true
+	}
+	key, _ := r.Context().Value(authContextKey{}).(*authKey)
+	if key != nil && key.permits(hostname, tag) {
+		return true
+	}
+	keyID := ""
+	if key != nil {
+		keyID = key.id
+	}
+	h.logger.Warn().Str("key", keyID).Str("host", hostname).Str("tag", tag).Msg("forbidden by key scope")
+	h.metrics.Increment("auth.forbidden", metrics.Tag(tag))
+	return false
+}
+
+// writeForbidden writes 403 response for the hostname and tag out of key scope
+func writeForbidden(w http.ResponseWriter, hostname, tag string) {
+	w.WriteHeader(http.StatusForbidden)
+	_, _ = w.Write([]byte(fmt.Sprintf("Key is not allowed to write %s logs of %s", tag, hostname)))
+}
+
+// watchKeys reloads the keys file once changed, so keys can be rotated without restart
+func (h *HttpReceiver) watchKeys(done <-chan struct{}) {
+	defer h.wg.Done()
+
+	ticker := time.NewTicker(h.auth.reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			reloaded, err := h.auth.reload()
+			if err != nil {
+				h.logger.Error().Err(err).Msg("unable to reload keys, running keys are kept")
+				h.metrics.Increment("auth.reload_error")
+			} else if reloaded {
+				h.logger.Info().Str("path", h.auth.path).Msg("keys reloaded")
+				h.metrics.Increment("auth.reloaded")
+			}
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package receiver
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+const testKeys = `
+keys:
+  - id: web
+    secret: web-secret-0123456789
+    hostnames: ["web*.example.com"]
+    tags: ["nginx"]
+  - id: puppet
+    secret: puppet-secret-0123456789
+    hostnames: ["*"]
+    tags: ["*"]
+`
+
+func TestHttpAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	keysPath := filepath.Join(dir, "keys.yaml")
+	assert.Nil(t, ioutil.WriteFile(keysPath, []byte(testKeys), 0600))
+
+	logger := zerolog.Nop()
+	h, err := NewHttpReceiver(&config.HttpReceiver{Auth: config.HttpAuth{Enabled: true, KeysFile: keysPath}}, metrics.Nop(), &logger)
+	assert.Nil(t, err)
+	h.SetTags([]config.CollectedLog{{Tag: "nginx:"}, {Tag: "nginx_error:"}})
+	handler := h.requireAuth(http.HandlerFunc(h.handleIngest))
+
+	hmacAuth := func(secret, timestamp, uri, body string) string {
+		signature := signRequest([]byte(secret), http.MethodPost, uri, timestamp, []byte(body))
+		return fmt.Sprintf("HMAC-SHA256 KeyId=web, Timestamp=%s, Signature=%s", timestamp, hex.EncodeToString(signature))
+	}
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name          string
+		uri           string
+		hostname      string
+		authorization string
+		status        int
+	}{
+		{"bearer", "/ingest/nginx", "web1.example.com", "Bearer web-secret-0123456789", http.StatusOK},
+		{"missing", "/ingest/nginx", "web1.example.com", "", http.StatusUnauthorized},
+		{"invalid token", "/ingest/nginx", "web1.example.com", "Bearer web-secret", http.StatusUnauthorized},
+		{"unsupported scheme", "/ingest/nginx", "web1.example.com", "Digest username=web", http.StatusUnauthorized},
+		{"basic", "/ingest/nginx", "web1.example.com", basicAuth("web", "web-secret-0123456789"), http.StatusOK},
+		{"basic wrong secret", "/ingest/nginx", "web1.example.com", basicAuth("web", "web"), http.StatusUnauthorized},
+		{"basic secret of other key", "/ingest/nginx", "web1.example.com", basicAuth("web", "puppet-secret-0123456789"), http.StatusUnauthorized},
+		{"hostname out of scope", "/ingest/nginx", "db1.example.com", "Bearer web-secret-0123456789", http.StatusForbidden},
+		{"tag out of scope", "/ingest/nginx_error", "web1.example.com", "Bearer web-secret-0123456789", http.StatusForbidden},
+		{"any hostname and tag", "/ingest/nginx_error", "db1.example.com", "Bearer puppet-secret-0123456789", http.StatusOK},
+		{"hmac", "/ingest/nginx", "web1.example.com", hmacAuth("web-secret-0123456789", now, "/ingest/nginx", "{}\n"), http.StatusOK},
+		{"hmac replayed", "/ingest/nginx", "web1.example.com", hmacAuth("web-secret-0123456789", now, "/ingest/nginx", "{}\n"), http.StatusUnauthorized},
+		{"hmac signed other uri", "/ingest/nginx", "web1.example.com", hmacAuth("web-secret-0123456789", now, "/ingest/nginx_error", "{}\n"), http.StatusUnauthorized},
+		{"hmac wrong secret", "/ingest/nginx", "web1.example.com", hmacAuth("puppet-secret-0123456789", now, "/ingest/nginx", "{}\n"), http.StatusUnauthorized},
+		{"hmac stale timestamp", "/ingest/nginx", "web1.example.com", hmacAuth("web-secret-0123456789", stale, "/ingest/nginx", "{}\n"), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.uri, strings.NewReader("{}\n"))
+			r.Header.Set(headerHostname, tt.hostname)
+			r.Header.Set("Authorization", tt.authorization)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			assert.Equal(t, tt.status, w.Code, w.Body.String())
+			if tt.status == http.StatusOK {
+				assert.Equal(t, tt.hostname+"\t"+strings.TrimPrefix(tt.uri, ingestPath)+":\t{}", receiveMsg(t, h.MsgChan()))
+			}
+			assert.Len(t, h.MsgChan(), 0)
+		})
+	}
+
+	// rotation: the old secret stops working once the file is reloaded, invalid file keeps running keys
+	rotated := strings.Replace(testKeys, "web-secret-0123456789", "web-secret-rotated-0123", 1)
+	assert.Nil(t, ioutil.WriteFile(keysPath, []byte(rotated), 0600))
+	reloaded, err := h.auth.reload()
+	assert.Nil(t, err)
+	assert.True(t, reloaded)
+	assert.Nil(t, ioutil.WriteFile(keysPath, []byte("keys: [{id: web}]"), 0600))
+	_, err = h.auth.reload()
+	assert.Error(t, err)
+
+	for secret, status := range map[string]int{"web-secret-0123456789": http.StatusUnauthorized, "web-secret-rotated-0123": http.StatusOK} {
+		r := httptest.NewRequest(http.MethodPost, "/ingest/nginx", strings.NewReader("{}\n"))
+		r.Header.Set(headerHostname, "web1.example.com")
+		r.Header.Set("Authorization", "Bearer "+secret)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, status, w.Code, secret)
+	}
+	assert.Equal(t, "web1.example.com\tnginx:\t{}", receiveMsg(t, h.MsgChan()))
+}
+
+func basicAuth(id, secret string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(id+":"+secret))
+}
+
+// shippers probe the cluster version with the same credentials as bulk requests
+func TestHttpAuthElasticHandshake(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	keysPath := filepath.Join(dir, "keys.yaml")
+	assert.Nil(t, ioutil.WriteFile(keysPath, []byte(testKeys), 0600))
+
+	logger := zerolog.Nop()
+	h, err := NewHttpReceiver(&config.HttpReceiver{
+		Auth:    config.HttpAuth{Enabled: true, KeysFile: keysPath},
+		Elastic: config.ElasticBulk{Enabled: true},
+	}, metrics.Nop(), &logger)
+	assert.Nil(t, err)
+	handler := h.requireAuth(http.HandlerFunc(h.handleRoot))
+
+	tests := []struct {
+		name          string
+		path          string
+		authorization string
+		status        int
+		body          string
+	}{
+		{"vector bearer", "/", "Bearer web-secret-0123456789", http.StatusOK, `"number":"7.17.0"`},
+		{"vector bearer license", "/_license", "Bearer web-secret-0123456789", http.StatusOK, `"status":"active"`},
+		{"fluent bit basic", "/", basicAuth("web", "web-secret-0123456789"), http.StatusOK, `"number":"7.17.0"`},
+		{"fluent bit basic license", "/_license", basicAuth("web", "web-secret-0123456789"), http.StatusOK, `"status":"active"`},
+		{"missing", "/", "", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			assert.Equal(t, tt.status, w.Code, w.Body.String())
+			assert.Contains(t, w.Body.String(), tt.body)
+		})
+	}
+}
+
+func TestParseAuthKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		keys string
+		err  bool
+	}{
+		{"valid", testKeys, false},
+		{"missing id", `keys: [{secret: secret-0123456789abc, hostnames: ["*"], tags: ["*"]}]`, true},
+		{"short secret", `keys: [{id: web, secret: secret, hostnames: ["*"], tags: ["*"]}]`, true},
+		{"missing scope", `keys: [{id: web, secret: secret-0123456789abc, tags: ["*"]}]`, true},
+		{"invalid hostname pattern", `keys: [{id: web, secret: secret-0123456789abc, hostnames: ["[web"], tags: ["*"]}]`, true},
+		{"duplicate id", `keys: [{id: web, secret: secret-0123456789abc, hostnames: ["*"], tags: ["*"]}, {id: web, secret: secret-0123456789xyz, hostnames: ["*"], tags: ["*"]}]`, true},
+		{"shared secret", `keys: [{id: a, secret: secret-0123456789abc, hostnames: ["*"], tags: ["*"]}, {id: b, secret: secret-0123456789abc, hostnames: ["*"], tags: ["*"]}]`, true},
+		{"unknown field", `keys: [{id: web, secret: secret-0123456789abc, hostnames: ["*"], tags: ["*"], tag: nginx}]`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := parseAuthKeys([]byte(tt.keys))
+			assert.Equal(t, tt.err, err != nil, "%v", err)
+		})
+	}
+}
+
+func TestReplayedSignatures(t *testing.T) {
+	a := &authKeys{maxClockSkew: time.Minute, signaturesMu: &sync.Mutex{}, signatures: make(map[string]time.Time)}
+	now := time.Now()
+
+	assert.False(t, a.replayed("ab", now, now))
+	assert.True(t, a.replayed("ab", now, now.Add(time.Second)))
+	assert.False(t, a.replayed("cd", now, now.Add(time.Second)))
+
+	// expired signatures are purged, their timestamps are rejected by the skew check anyway
+	assert.False(t, a.replayed("ef", now.Add(2*time.Minute), now.Add(2*time.Minute)))
+	assert.Len(t, a.signatures, 1)
+}
@@ -0,0 +1,193 @@
+package receiver
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"nginx-log-collector/utils"
+)
+
+const (
+	OverloadBlock      = "block"
+	OverloadDropNewest = "drop-newest"
+	OverloadSample     = "sample"
+
+	defaultOverloadSampleRate = 10
+)
+
+// ValidateOverloadPolicy checks that policy applied to the full queue is known
+func ValidateOverloadPolicy(policy string) error {
+	switch policy {
+	case "", OverloadBlock, OverloadDropNewest, OverloadSample:
+		return nil
+	default:
+		return fmt.Errorf("unknown overload policy: %s", policy)
+	}
+}
+
+// connStats is updated by the connection goroutine and collected by queueMonitoring
+type connStats struct {
+	host      string
+	sampled   uint64
+	dropped   int64
+	blocked   int64 // nanoseconds spent waiting for the queue
+	throttled int64 // nanoseconds spent waiting for rate limiters
+}
+
+type hostStats struct {
+	dropped   int64
+	blocked   time.Duration
+	throttled time.Duration
+}
+
+// overload tracks connections affected by the full queue or rate limits
+type overload struct {
+	policy     string
+	sampleRate uint64
+
+	mu    *sync.Mutex
+	conns map[*connStats]bool
+}
+
+func newOverload(policy string, sampleRate int) *overload {
+	if policy == "" {
+		policy = OverloadBlock
+	}
+	if sampleRate <= 0 {
+		sampleRate = defaultOverloadSampleRate
+	}
+	return &overload{
+		policy:     policy,
+		sampleRate: uint64(sampleRate),
+		mu:         &sync.Mutex{},
+		conns:      make(map[*connStats]bool),
+	}
+}
+
+func (o *overload) register(host string) *connStats {
+	stats := &connStats{host: host}
+	o.mu.Lock()
+	o.conns[stats] = true
+	o.mu.Unlock()
+	return stats
+}
+
+// unregister keeps stats of the closed connection until the next collect
+func (o *overload) unregister(stats *connStats) {
+	o.mu.Lock()
+	o.conns[stats] = false
+	o.mu.Unlock()
+}
+
+// send puts message into the queue according to the overload policy and reports whether it was queued
+func (o *overload) send(msgChan chan []byte, msg []byte, stats *connStats) bool {
+	select {
+	case msgChan <- msg:
+		return true
+	default:
+	}
+
+	if o.policy == OverloadDropNewest ||
+		o.policy == OverloadSample && atomic.AddUint64(&stats.sampled, 1)%o.sampleRate != 0 {
+		atomic.AddInt64(&stats.dropped, 1)
+		return false
+	}
+
+	start := time.Now()
+	msgChan <- msg
+	atomic.AddInt64(&stats.blocked, int64(time.Since(start)))
+	return true
+}
+
+// collect resets connection counters and returns them grouped by host
+func (o *overload) collect() map[string]*hostStats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	hosts := make(map[string]*hostStats)
+	for stats, alive := range o.conns {
+		if !alive {
+			delete(o.conns, stats)
+		}
+		dropped := atomic.SwapInt64(&stats.dropped, 0)
+		blocked := atomic.SwapInt64(&stats.blocked, 0)
+		throttled := atomic.SwapInt64(&stats.throttled, 0)
+		if dropped == 0 && blocked == 0 && throttled == 0 {
+			continue
+		}
+		h, found := hosts[stats.host]
+		if !found {
+			h = &hostStats{}
+			hosts[stats.host] = h
+		}
+		h.dropped += dropped
+		h.blocked += time.Duration(blocked)
+		h.throttled += time.Duration(throttled)
+	}
+	return hosts
+}
+
+// reportOverload sends overload metrics and logs hosts affected since the previous report
+func (t *TCPReceiver) reportOverload() {
+	hosts := t.overload.collect()
+	names := make([]string, 0, len(hosts))
+	for host := range hosts {
+		names = append(names, host)
+	}
+	sort.Strings(names)
+
+	var total hostStats
+	for _, host := range names {
+		h := hosts[host]
+		t.logger.Warn().Str("host", host).Int64("dropped", h.dropped).Dur("blocked", h.blocked).
+			Dur("throttled", h.throttled).Str("policy", t.overload.policy).Msg("host throttled")
+		total.dropped += h.dropped
+		total.blocked += h.blocked
+		total.throttled += h.throttled
+	}
+	t.metrics.Count("overload_dropped", total.dropped)
+	t.metrics.Count("overload_blocked_ms", total.blocked.Milliseconds())
+	t.metrics.Count("throttled_ms", total.throttled.Milliseconds())
+}
+
+// statsHost names connection in throttling reports
+func statsHost(hostname string, conn net.Conn) string {
+	if hostname != "" {
+		return hostname
+	}
+	return peerHost(conn.RemoteAddr())
+}
+
+// connReader applies global and per-connection read rate limits
+func (t *TCPReceiver) connReader(conn net.Conn, stats *connStats) io.Reader {
+	if t.rateLimiter == nil && t.connRateLimit <= 0 {
+		return conn
+	}
+	return &throttledReader{
+		r:        conn,
+		limiters: []*utils.RateLimiter{t.rateLimiter, utils.NewRateLimiter(t.connRateLimit)},
+		stats:    stats,
+	}
+}
+
+// throttledReader waits for rate limiters after every read and accounts the time spent
+type throttledReader struct {
+	r        io.Reader
+	limiters []*utils.RateLimiter
+	stats    *connStats
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	for _, limiter := range t.limiters {
+		if wait := limiter.Wait(n); wait > 0 {
+			atomic.AddInt64(&t.stats.throttled, int64(wait))
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,83 @@
+package receiver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"nginx-log-collector/utils"
+)
+
+func TestOverloadSend(t *testing.T) {
+	tests := []struct {
+		policy  string
+		kept    bool // whether the 3rd line sent to the full queue is kept
+		dropped int64
+	}{
+		{OverloadDropNewest, false, 3},
+		{OverloadSample, true, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			o := newOverload(tt.policy, 3)
+			stats := o.register("web1")
+			msgChan := make(chan []byte, 1)
+
+			assert.True(t, o.send(msgChan, []byte("line"), stats))
+			assert.False(t, o.send(msgChan, []byte("line"), stats))
+			assert.False(t, o.send(msgChan, []byte("line"), stats))
+
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				<-msgChan
+			}()
+			assert.Equal(t, tt.kept, o.send(msgChan, []byte("line"), stats))
+
+			o.unregister(stats)
+			hosts := o.collect()
+			assert.Equal(t, tt.dropped, hosts["web1"].dropped)
+			assert.Empty(t, o.conns)
+		})
+	}
+}
+
+func TestOverloadBlock(t *testing.T) {
+	o := newOverload("", 0)
+	stats := o.register("web1")
+	msgChan := make(chan []byte, 1)
+	msgChan <- []byte("first")
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		<-msgChan
+	}()
+	assert.True(t, o.send(msgChan, []byte("second"), stats))
+
+	hosts := o.collect()
+	assert.Equal(t, int64(0), hosts["web1"].dropped)
+	assert.True(t, hosts["web1"].blocked > 0)
+	assert.Len(t, o.conns, 1)
+}
+
+func TestThrottledReader(t *testing.T) {
+	stats := &connStats{}
+	data := bytes.Repeat([]byte("x"), 200)
+	r := &throttledReader{
+		r:        bytes.NewReader(data),
+		limiters: []*utils.RateLimiter{nil, utils.NewRateLimiter(1000)},
+		stats:    stats,
+	}
+	read, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, read)
+	assert.Equal(t, int64(0), stats.throttled) // fits into the burst
+
+	r.r = bytes.NewReader(bytes.Repeat([]byte("x"), 1000))
+	_, err = ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.True(t, stats.throttled > 0)
+}
@@ -0,0 +1,376 @@
+package receiver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/pkg/errors"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+const (
+	elasticBulkEndpoint          = "_bulk"
+	defaultElasticVersion        = "7.17.0"
+	defaultElasticHostnameField  = "host.name"
+	elasticTimestampField        = "@timestamp"
+	headerElasticProduct         = "X-Elastic-Product"
+	elasticClusterName           = "nginx-log-collector"
+	elasticErrIndexNotFound      = "index_not_found_exception"
+	elasticErrMapperParsing      = "mapper_parsing_exception"
+	elasticErrActionNotSupported = "action_request_validation_exception"
+	elasticErrSecurity           = "security_exception"
+)
+
+// elasticItem is a single action of bulk request and its result
+type elasticItem struct {
+	action string
+	index  string
+	id     string
+	tag    string
+	msg    []byte
+
+	status    int
+	errorType string
+	reason    string
+}
+
+// elasticSettings applies defaults to elasticsearch api config
+func elasticSettings(cfg config.ElasticBulk) config.ElasticBulk {
+	if cfg.Version == "" {
+		cfg.Version = defaultElasticVersion
+	}
+	if cfg.HostnameField == "" {
+		cfg.HostnameField = defaultElasticHostnameField
+	}
+	return cfg
+}
+
+// ValidateElasticConfig checks index patterns; tags are checked against collected logs by the caller
+func ValidateElasticConfig(cfg config.ElasticBulk) error {
+	for i, idx := range cfg.Indices {
+		if _, err := path.Match(idx.Match, ""); err != nil || idx.Match == "" {
+			return fmt.Errorf("indices[%d]: invalid match pattern %q", i, idx.Match)
+		}
+		if idx.Tag == "" {
+			return fmt.Errorf("indices[%d]: tag should be set", i)
+		}
+	}
+	return nil
+}
+
+// isElasticPath reports whether request addresses elasticsearch api rather than log upload
+func isElasticPath(r *http.Request) bool {
+	if r.URL.Path == "/" {
+		return r.Method == http.MethodGet || r.Method == http.MethodHead
+	}
+	for _, segment := range strings.Split(r.URL.Path, "/") {
+		if strings.HasPrefix(segment, "_") {
+			return true
+		}
+	}
+	return false
+}
+
+// handleElastic serves _bulk requests and answers handshake requests of shippers:
+// cluster info, license and template or ilm policy checks
+func (h *HttpReceiver) handleElastic(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	w.Header().Set(headerElasticProduct, "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+
+	p := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path.Base(p) == elasticBulkEndpoint:
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		h.handleElasticBulk(w, r, strings.TrimSuffix(strings.TrimSuffix(p, elasticBulkEndpoint), "/"))
+	case r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case r.Method != http.MethodGet:
+		// templates, ilm policies and pipelines are acknowledged but ignored
+		writeElasticResponse(w, http.StatusOK, map[string]interface{}{"acknowledged": true})
+	case p == "":
+		hostname, _ := os.Hostname()
+		writeElasticResponse(w, http.StatusOK, map[string]interface{}{
+			"name":         hostname,
+			"cluster_name": elasticClusterName,
+			"cluster_uuid": elasticClusterName,
+			"version": map[string]interface{}{
+				"number":                              h.elastic.Version,
+				"build_flavor":                        "default",
+				"build_type":                          "tar",
+				"minimum_wire_compatibility_version":  "6.8.0",
+				"minimum_index_compatibility_version": "6.0.0-beta1",
+			},
+			"tagline": "You Know, for Search",
+		})
+	case p == "_license":
+		writeElasticResponse(w, http.StatusOK, map[string]interface{}{
+			"license": map[string]interface{}{
+				"uid":    elasticClusterName,
+				"type":   "basic",
+				"mode":   "basic",
+				"status": "active",
+			},
+		})
+	case p == "_xpack":
+		writeElasticResponse(w, http.StatusOK, map[string]interface{}{
+			"build":    map[string]interface{}{},
+			"license":  map[string]interface{}{"uid": elasticClusterName, "type": "basic", "mode": "basic", "status": "active"},
+			"features": map[string]interface{}{"ilm": map[string]interface{}{"available": false, "enabled": false}},
+		})
+	default:
+		writeElasticResponse(w, http.StatusOK, map[string]interface{}{})
+	}
+}
+
+// handleElasticBulk accepts action and document pairs of index and create actions, documents are sent as is.
+// Malformed body rejects the whole request, unknown index or unsupported action rejects the item only
+func (h *HttpReceiver) handleElasticBulk(w http.ResponseWriter, r *http.Request, defaultIndex string) {
+	start := time.Now()
+
+	source, err := h.pushSource(r)
+	if err != nil {
+		writeElasticError(w, http.StatusForbidden, elasticErrSecurity, err.Error())
+		return
+	}
+
+	body := limitBody(r.Body)
+	switch r.Header.Get("Content-Encoding") {
+	case "":
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			h.metrics.Increment("elastic.body_error")
+			writeElasticError(w, bodyErrorStatus(err), "parse_exception", "invalid gzip body: "+err.Error())
+			return
+		}
+		defer gz.Close()
+		body = limitBody(gz)
+	default:
+		writeElasticError(w, http.StatusUnsupportedMediaType, "illegal_argument_exception", "only gzip content encoding is supported")
+		return
+	}
+
+	items, err := readElasticBulk(body, defaultIndex)
+	if err != nil {
+		h.metrics.Increment("elastic.body_error")
+		writeElasticError(w, bodyErrorStatus(err), "illegal_argument_exception", err.Error())
+		return
+	}
+
+	cfg := h.elastic
+	for i := range items {
+		item := &items[i]
+		if item.status != 0 {
+			continue
+		}
+		tag, found := h.elasticTag(item.index)
+		if !found {
+			item.status = http.StatusNotFound
+			item.errorType = elasticErrIndexNotFound
+			item.reason = fmt.Sprintf("no such index [%s]", item.index)
+			continue
+		}
+
+		hostname, permitted := source.resolve(elasticField(item.msg, cfg.HostnameField), tag)
+		if !permitted {
+			item.status = http.StatusForbidden
+			item.errorType = elasticErrSecurity
+			item.reason = fmt.Sprintf("key is not allowed to write %s logs of %s", tag, hostname)
+			continue
+		}
+		item.tag = tag
+		item.msg = formatMessage(hostname, tag, elasticDocument(item.msg))
+		item.status = http.StatusCreated
+	}
+
+	// documents are queued only after the whole body is parsed, so malformed request can be retried safely
+	accepted := make(map[string]int)
+	var rejected int
+	resultItems := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		result := map[string]interface{}{
+			"_index": item.index,
+			"status": item.status,
+		}
+		if item.id != "" {
+			result["_id"] = item.id
+		}
+		if item.status == http.StatusCreated {
+			h.msgChan <- item.msg
+			accepted[item.tag]++
+			result["result"] = "created"
+			result["_version"] = 1
+			result["_shards"] = map[string]int{"total": 1, "successful": 1, "failed": 0}
+		} else {
+			rejected++
+			result["error"] = map[string]interface{}{
+				"type":   item.errorType,
+				"reason": item.reason,
+				"index":  item.index,
+			}
+		}
+		resultItems = append(resultItems, map[string]interface{}{item.action: result})
+	}
+	for tag, cnt := range accepted {
+		h.metrics.Count("elastic.accepted", cnt, metrics.Tag(tag))
+	}
+	if rejected > 0 {
+		h.metrics.Count("elastic.rejected", rejected)
+	}
+
+	writeElasticResponse(w, http.StatusOK, map[string]interface{}{
+		"took":   time.Since(start).Milliseconds(),
+		"errors": rejected > 0,
+		"items":  resultItems,
+	})
+}
+
+// elasticTag maps index name to collected log tag: configured patterns first, then index name itself
+func (h *HttpReceiver) elasticTag(index string) (string, bool) {
+	for _, idx := range h.elastic.Indices {
+		if matched, _ := path.Match(idx.Match, index); matched {
+			return h.resolveTag(idx.Tag)
+		}
+	}
+	return h.resolveTag(index)
+}
+
+// readElasticBulk parses NDJSON body of bulk request into items
+func readElasticBulk(body io.Reader, defaultIndex string) ([]elasticItem, error) {
+	reader := bufio.NewReader(body)
+	readLine := func() ([]byte, error) {
+		for {
+			line, err := reader.ReadBytes('\n')
+			line = bytes.TrimSpace(line)
+			if len(line) > 0 {
+				return line, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var items []elasticItem
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := readLine()
+		if err == io.EOF {
+			return items, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		var action map[string]struct {
+			Index string `json:"_index"`
+			ID    string `json:"_id"`
+		}
+		if err := json.Unmarshal(line, &action); err != nil || len(action) != 1 {
+			return nil, fmt.Errorf("malformed action/metadata line [%d], expected a simple object with a single action", lineNumber)
+		}
+		var item elasticItem
+		for name, meta := range action {
+			item = elasticItem{action: name, index: meta.Index, id: meta.ID}
+		}
+		if item.index == "" {
+			item.index = defaultIndex
+		}
+
+		switch item.action {
+		case "index", "create":
+		case "update":
+			item.status = http.StatusBadRequest
+			item.errorType = elasticErrActionNotSupported
+			item.reason = "update action is not supported"
+		case "delete": // has no document
+			item.status = http.StatusBadRequest
+			item.errorType = elasticErrActionNotSupported
+			item.reason = "delete action is not supported"
+			items = append(items, item)
+			continue
+		default:
+			return nil, fmt.Errorf("malformed action/metadata line [%d], unknown action [%s]", lineNumber, item.action)
+		}
+
+		doc, err := readLine()
+		lineNumber++
+		if err == io.EOF {
+			return nil, errors.New("the bulk request must be terminated by a newline")
+		} else if err != nil {
+			return nil, err
+		}
+		if item.index == "" {
+			return nil, fmt.Errorf("index is missing in action/metadata line [%d]", lineNumber-1)
+		}
+		if item.status == 0 && (doc[0] != '{' || !json.Valid(doc)) {
+			item.status = http.StatusBadRequest
+			item.errorType = elasticErrMapperParsing
+			item.reason = "failed to parse, document is not a json object"
+		}
+		item.msg = doc
+		items = append(items, item)
+	}
+}
+
+// elasticField returns string value by dotted path of nested objects or by flat dotted key
+func elasticField(doc []byte, field string) string {
+	if value, err := jsonparser.GetString(doc, strings.Split(field, ".")...); err == nil {
+		return value
+	}
+	value, _ := jsonparser.GetString(doc, field)
+	return value
+}
+
+// elasticDocument adds missing event_datetime from @timestamp of the document
+func elasticDocument(doc []byte) []byte {
+	if _, _, _, err := jsonparser.Get(doc, "event_datetime"); err != jsonparser.KeyPathNotFoundError {
+		return doc
+	}
+	timestamp, err := jsonparser.GetString(doc, elasticTimestampField)
+	if err != nil {
+		return doc
+	}
+	parsed, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return doc
+	}
+	datetime := []byte(`"` + parsed.Local().Format(eventDatetimeLayout) + `"`)
+	if updated, err := jsonparser.Set(doc, datetime, "event_datetime"); err == nil {
+		return updated
+	}
+	return doc
+}
+
+func writeElasticResponse(w http.ResponseWriter, status int, resp interface{}) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// writeElasticError writes error in the shape of elasticsearch request error
+func writeElasticError(w http.ResponseWriter, status int, errorType, reason string) {
+	cause := map[string]interface{}{"type": errorType, "reason": reason}
+	writeElasticResponse(w, status, map[string]interface{}{
+		"error": map[string]interface{}{
+			"root_cause": []interface{}{cause},
+			"type":       errorType,
+			"reason":     reason,
+		},
+		"status": status,
+	})
+}
@@ -0,0 +1,196 @@
+package receiver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+func TestElasticBulk(t *testing.T) {
+	defer func(local *time.Location) { time.Local = local }(time.Local)
+	time.Local = time.UTC
+	logger := zerolog.Nop()
+	h, err := NewHttpReceiver(&config.HttpReceiver{Elastic: config.ElasticBulk{
+		Enabled: true,
+		Indices: []config.ElasticIndex{{Match: "filebeat-*", Tag: "nginx"}},
+	}}, metrics.Nop(), &logger)
+	assert.Nil(t, err)
+	h.SetTags([]config.CollectedLog{{Tag: "nginx:"}, {Tag: "nginx_error:"}})
+
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	_, _ = gz.Write([]byte(`{"create":{}}` + "\n" + `{"@timestamp":"2020-04-24T18:14:42.5+03:00","host":{"name":"web1"}}` + "\n"))
+	_ = gz.Close()
+
+	tests := []struct {
+		name     string
+		path     string
+		encoding string
+		body     []byte
+		status   int
+		items    []string // action and status of every item
+		msgs     []string
+	}{
+		{
+			name: "mixed actions",
+			path: "/_bulk",
+			body: []byte(strings.Join([]string{
+				`{"index":{"_index":"filebeat-7.17.0-2020.04.24","_id":"1"}}`,
+				`{"status":200,"host":{"name":"web1"},"event_datetime":"2020-04-24T18:14:42+03:00"}`,
+				`{"create":{"_index":"nginx_error"}}`,
+				`{"message":"open() failed","host.name":"web2"}`,
+				``,
+				`{"index":{"_index":"php"}}`,
+				`{}`,
+				`{"delete":{"_index":"nginx_error","_id":"1"}}`,
+				`{"update":{"_index":"nginx_error","_id":"1"}}`,
+				`{"doc":{}}`,
+				`{"index":{"_index":"nginx_error"}}`,
+				`"text"`,
+			}, "\n") + "\n"),
+			status: http.StatusOK,
+			items:  []string{"index 201", "create 201", "index 404", "delete 400", "update 400", "index 400"},
+			msgs: []string{
+				`web1	nginx:	{"status":200,"host":{"name":"web1"},"event_datetime":"2020-04-24T18:14:42+03:00"}`,
+				`web2	nginx_error:	{"message":"open() failed","host.name":"web2"}`,
+			},
+		},
+		{
+			name:     "index in path, gzip",
+			path:     "/filebeat-7.17.0/_bulk",
+			encoding: "gzip",
+			body:     gzipped.Bytes(),
+			status:   http.StatusOK,
+			items:    []string{"create 201"},
+			msgs: []string{
+				`web1	nginx:	{"@timestamp":"2020-04-24T18:14:42.5+03:00","host":{"name":"web1"},"event_datetime":"2020-04-24T15:14:42.500000000Z"}`,
+			},
+		},
+		{
+			name:   "hostname header",
+			path:   "/nginx/_bulk",
+			body:   []byte(`{"index":{}}` + "\n" + `{"status":200}` + "\n"),
+			status: http.StatusOK,
+			items:  []string{"index 201"},
+			msgs:   []string{`web0	nginx:	{"status":200}`},
+		},
+		{
+			name:   "malformed action rejects whole request",
+			path:   "/_bulk",
+			body:   []byte(`{"index":{"_index":"nginx"}}` + "\n" + `{}` + "\n" + `{"index":` + "\n"),
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "missing document",
+			path:   "/_bulk",
+			body:   []byte(`{"index":{"_index":"nginx"}}` + "\n"),
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "missing index",
+			path:   "/_bulk",
+			body:   []byte(`{"index":{}}` + "\n" + `{}` + "\n"),
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/x-ndjson")
+			r.Header.Set("Content-Encoding", tt.encoding)
+			r.Header.Set(headerHostname, "web0")
+			w := httptest.NewRecorder()
+			h.handleRoot(w, r)
+			assert.Equal(t, tt.status, w.Code, w.Body.String())
+			assert.Equal(t, "Elasticsearch", w.Header().Get(headerElasticProduct))
+
+			var resp struct {
+				Errors bool                              `json:"errors"`
+				Items  []map[string]struct{ Status int } `json:"items"`
+			}
+			assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			var items []string
+			for _, item := range resp.Items {
+				for action, result := range item {
+					items = append(items, fmt.Sprintf("%s %d", action, result.Status))
+				}
+			}
+			assert.Equal(t, tt.items, items)
+			assert.Equal(t, len(tt.items) != len(tt.msgs), resp.Errors)
+			for _, msg := range tt.msgs {
+				assert.Equal(t, msg, receiveMsg(t, h.MsgChan()))
+			}
+			assert.Len(t, h.MsgChan(), 0)
+		})
+	}
+}
+
+func TestElasticHandshake(t *testing.T) {
+	logger := zerolog.Nop()
+	h, err := NewHttpReceiver(&config.HttpReceiver{Elastic: config.ElasticBulk{Enabled: true}}, metrics.Nop(), &logger)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		method string
+		path   string
+		body   string // expected json fields
+	}{
+		{http.MethodGet, "/", `"number":"7.17.0"`},
+		{http.MethodHead, "/", ``},
+		{http.MethodGet, "/_license", `"status":"active"`},
+		{http.MethodGet, "/_xpack", `"ilm":{"available":false`},
+		{http.MethodHead, "/_index_template/filebeat-7.17.0", ``},
+		{http.MethodPut, "/_ilm/policy/filebeat", `"acknowledged":true`},
+		{http.MethodGet, "/_bulk", ``},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.handleRoot(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if tt.path == "/_bulk" {
+				assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+				return
+			}
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "Elasticsearch", w.Header().Get(headerElasticProduct))
+			assert.Contains(t, w.Body.String(), tt.body)
+		})
+	}
+
+	// uploads are served as before
+	w := httptest.NewRecorder()
+	h.handleRoot(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("")))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Empty(t, w.Header().Get(headerElasticProduct))
+}
+
+func TestIsElasticPath(t *testing.T) {
+	tests := []struct {
+		method   string
+		path     string
+		expected bool
+	}{
+		{http.MethodGet, "/", true},
+		{http.MethodPost, "/", false},
+		{http.MethodPost, "/_bulk", true},
+		{http.MethodPost, "/filebeat/_bulk", true},
+		{http.MethodGet, "/_template/filebeat", true},
+		{http.MethodPost, "/upload", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, isElasticPath(httptest.NewRequest(tt.method, tt.path, nil)), tt.method+" "+tt.path)
+	}
+}
@@ -0,0 +1,609 @@
+package receiver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+	"nginx-log-collector/processor"
+)
+
+const (
+	defaultFilePollInterval = time.Second
+	defaultFileRotateWait   = 10 * time.Second
+	defaultFileMaxLineSize  = 1024 * 1024
+	fileReadChunkSize       = 64 * 1024
+	fileFingerprintSize     = 256
+)
+
+// fileID identifies a file regardless of its path, so renamed files are followed
+type fileID struct {
+	dev   uint64
+	inode uint64
+}
+
+func fileIdentity(fi os.FileInfo) (fileID, error) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, errors.New("unable to get file inode")
+	}
+	return fileID{dev: uint64(st.Dev), inode: uint64(st.Ino)}, nil
+}
+
+type fileInput struct {
+	pattern  string
+	tag      string
+	hostname string
+}
+
+// tailedFile is an open file; offset points to the end of the last line sent,
+// acks track which of the sent lines are stored
+type tailedFile struct {
+	id      fileID
+	path    string
+	input   *fileInput
+	file    *os.File
+	offset  int64
+	acks    *ackWindow // replaced on truncation, so acks of the old content are ignored
+	pending []byte     // read but incomplete line
+	discard bool       // skipping the rest of too long line
+
+	fingerprint []byte // first bytes of the file, changed ones mean truncation even if the file regrew
+
+	rotatedAt time.Time // when the file stopped matching its pattern
+}
+
+type fileState struct {
+	Path        string `json:"path"`
+	Dev         uint64 `json:"dev"`
+	Inode       uint64 `json:"inode"`
+	Offset      int64  `json:"offset"`
+	Fingerprint []byte `json:"fingerprint,omitempty"`
+}
+
+// ackWindow tracks sent lines of a file until they are uploaded or stored to backlog.
+// Batches complete out of order, so the committed offset is the end of the longest stored prefix
+type ackWindow struct {
+	committed int64
+	base      uint64  // sequence number of offsets[0]
+	offsets   []int64 // end offsets of sent lines
+	acked     []bool
+}
+
+// add registers sent line ending at the offset and returns its sequence number
+func (w *ackWindow) add(offset int64) uint64 {
+	w.offsets = append(w.offsets, offset)
+	w.acked = append(w.acked, false)
+	return w.base + uint64(len(w.offsets)-1)
+}
+
+// skip commits skipped line ending at the offset once the lines before it are stored
+func (w *ackWindow) skip(offset int64) {
+	if len(w.offsets) == 0 {
+		w.committed = offset
+		return
+	}
+	w.ack(w.add(offset))
+}
+
+// ack marks the line stored and reports whether the committed offset has moved
+func (w *ackWindow) ack(seq uint64) bool {
+	w.acked[seq-w.base] = true
+	n := 0
+	for n < len(w.acked) && w.acked[n] {
+		n++
+	}
+	if n == 0 {
+		return false
+	}
+	w.committed = w.offsets[n-1]
+	w.offsets, w.acked = w.offsets[n:], w.acked[n:]
+	w.base += uint64(n)
+	return true
+}
+
+func (w *ackWindow) inFlight() int {
+	return len(w.offsets)
+}
+
+// FileReceiver tails files matched by glob patterns, e.g. on hosts without rsyslog.
+// Files are followed by inode so both rename and copytruncate rotations are handled.
+// Offsets are committed to the state file once lines are uploaded or stored to backlog,
+// so lines are sent again after a crash rather than lost
+type FileReceiver struct {
+	msgChan      chan processor.Message
+	inputs       []*fileInput
+	statePath    string
+	pollInterval time.Duration
+	rotateWait   time.Duration
+	maxLineSize  int
+
+	files        map[fileID]*tailedFile
+	savedStates  map[fileID]fileState // loaded from the state file, kept until the file is opened
+	resumed      bool                 // files rotated while stopped are looked up
+	stateChanged bool
+	readBuf      []byte
+
+	acksMu      *sync.Mutex // guards ack windows, acks come from the uploader
+	acksChanged bool
+
+	metrics metrics.Metrics
+	logger  zerolog.Logger
+	wg      *sync.WaitGroup
+}
+
+func NewFileReceiver(cfg *config.FileReceiver, metrics metrics.Metrics, logger *zerolog.Logger) (*FileReceiver, error) {
+	if err := ValidateFileConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	inputs := make([]*fileInput, 0, len(cfg.Inputs))
+	for _, in := range cfg.Inputs {
+		hostname := in.Hostname
+		if hostname == "" {
+			hostname = localHostname
+		}
+		inputs = append(inputs, &fileInput{pattern: in.Path, tag: in.Tag, hostname: hostname})
+	}
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+
+	f := &FileReceiver{
+		msgChan:      make(chan processor.Message, 100000),
+		inputs:       inputs,
+		statePath:    cfg.StateFile,
+		pollInterval: defaultFilePollInterval,
+		rotateWait:   defaultFileRotateWait,
+		maxLineSize:  defaultFileMaxLineSize,
+		files:        make(map[fileID]*tailedFile),
+		readBuf:      make([]byte, fileReadChunkSize),
+		acksMu:       &sync.Mutex{},
+		metrics:      receiverMetrics(metrics, "file"),
+		wg:           wg,
+		logger:       logger.With().Str("component", "receiver.file").Logger(),
+	}
+	if cfg.PollInterval > 0 {
+		f.pollInterval = cfg.PollInterval
+	}
+	if cfg.RotateWait > 0 {
+		f.rotateWait = cfg.RotateWait
+	}
+	if cfg.MaxLineSize > 0 {
+		f.maxLineSize = cfg.MaxLineSize
+	}
+
+	states, err := loadFileState(cfg.StateFile)
+	if err != nil {
+		return nil, err
+	}
+	f.savedStates = states
+	return f, nil
+}
+
+// ValidateFileConfig checks file receiver config; tags are checked against collected logs by the caller
+func ValidateFileConfig(cfg *config.FileReceiver) error {
+	if cfg.StateFile == "" {
+		return errors.New("state_file should be set")
+	}
+	if len(cfg.Inputs) == 0 {
+		return errors.New("no inputs configured")
+	}
+	for i, in := range cfg.Inputs {
+		if in.Path == "" {
+			return fmt.Errorf("inputs[%d]: path should be set", i)
+		}
+		if _, err := filepath.Match(in.Path, ""); err != nil {
+			return errors.Wrapf(err, "inputs[%d]: invalid path pattern %s", i, in.Path)
+		}
+		if in.Tag == "" {
+			return fmt.Errorf("inputs[%d]: tag should be set", i)
+		}
+	}
+	return nil
+}
+
+func loadFileState(path string) (map[fileID]fileState, error) {
+	states := make(map[fileID]fileState)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return states, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "unable to read state file")
+	}
+	var list []fileState
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse state file %s", path)
+	}
+	for _, s := range list {
+		states[fileID{dev: s.Dev, inode: s.Inode}] = s
+	}
+	return states, nil
+}
+
+// saveState atomically replaces the state file with committed offsets;
+// saved states of files which aren't opened yet are kept
+func (f *FileReceiver) saveState() error {
+	states := make([]fileState, 0, len(f.files)+len(f.savedStates))
+	f.acksMu.Lock()
+	for _, t := range f.files {
+		states = append(states, fileState{Path: t.path, Dev: t.id.dev, Inode: t.id.inode, Offset: t.acks.committed, Fingerprint: t.fingerprint})
+	}
+	f.acksChanged = false
+	f.acksMu.Unlock()
+	for _, s := range f.savedStates {
+		states = append(states, s)
+	}
+	data, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+	tmpPath := f.statePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.Wrap(err, "unable to write state file")
+	}
+	return errors.Wrap(os.Rename(tmpPath, f.statePath), "unable to replace state file")
+}
+
+// MsgChan returns lines acked by the processor once they are uploaded or stored to backlog
+func (f *FileReceiver) MsgChan() chan processor.Message {
+	return f.msgChan
+}
+
+func (f *FileReceiver) Start(done <-chan struct{}) {
+	defer f.wg.Done()
+	defer f.close()
+	f.logger.Info().Msg("starting")
+
+	ticker := time.NewTicker(f.pollInterval)
+	defer ticker.Stop()
+	for {
+		f.poll(done)
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// poll picks up new and rotated files and sends lines appended since the last poll
+func (f *FileReceiver) poll(done <-chan struct{}) {
+	matched := make(map[fileID]bool)
+	for _, in := range f.inputs {
+		paths, _ := filepath.Glob(in.pattern) // pattern is validated
+		for _, path := range paths {
+			if id, ok := f.track(path, in); ok {
+				matched[id] = true
+			}
+		}
+	}
+	if !f.resumed {
+		f.resumeRotated()
+		f.resumed = true
+	}
+
+	for id, t := range f.files {
+		sent, err := f.read(done, t)
+		if err != nil {
+			f.logger.Warn().Err(err).Str("path", t.path).Msg("read error")
+			f.metrics.Increment("read_error")
+		}
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		if matched[id] {
+			t.rotatedAt = time.Time{}
+			continue
+		}
+		// rotated or removed file is still written until the writer reopens its log
+		if t.rotatedAt.IsZero() || sent > 0 {
+			t.rotatedAt = time.Now()
+		} else if time.Since(t.rotatedAt) >= f.rotateWait && f.inFlight(t) == 0 {
+			f.logger.Info().Str("path", t.path).Msg("rotated file closed")
+			t.file.Close()
+			delete(f.files, id)
+			f.stateChanged = true
+		}
+	}
+	f.metrics.Gauge("files", len(f.files))
+	f.metrics.Gauge("msg_chan_len", len(f.msgChan))
+
+	f.acksMu.Lock()
+	f.stateChanged = f.stateChanged || f.acksChanged
+	f.acksMu.Unlock()
+	if f.stateChanged {
+		if err := f.saveState(); err != nil {
+			f.logger.Error().Err(err).Msg("unable to save state")
+			f.metrics.Increment("state_error")
+			return
+		}
+		f.stateChanged = false
+	}
+}
+
+// track opens the file if it isn't tailed yet
+func (f *FileReceiver) track(path string, in *fileInput) (fileID, bool) {
+	fi, err := os.Stat(path)
+	if err != nil || !fi.Mode().IsRegular() {
+		return fileID{}, false // removed since glob or not a file
+	}
+	id, err := fileIdentity(fi)
+	if err != nil {
+		f.logger.Warn().Err(err).Str("path", path).Msg("unable to identify file")
+		return fileID{}, false
+	}
+	if t, found := f.files[id]; found {
+		t.path = path
+		return id, true
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		f.logger.Warn().Err(err).Str("path", path).Msg("unable to open file")
+		f.metrics.Increment("open_error")
+		return fileID{}, false
+	}
+	// the path could be replaced between stat and open
+	if fi, err = file.Stat(); err == nil {
+		id, err = fileIdentity(fi)
+	}
+	if err != nil || f.files[id] != nil {
+		file.Close()
+		return id, err == nil
+	}
+
+	fingerprint, err := readFingerprint(file)
+	if err != nil {
+		file.Close()
+		f.logger.Warn().Err(err).Str("path", path).Msg("unable to read file")
+		f.metrics.Increment("open_error")
+		return fileID{}, false
+	}
+	saved, found := f.savedStates[id]
+	delete(f.savedStates, id)
+	offset := saved.Offset
+	if offset > fi.Size() || !sameContent(saved.Fingerprint, fingerprint) {
+		offset = 0 // truncated while stopped or inode is reused
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		f.logger.Warn().Err(err).Str("path", path).Msg("unable to seek file")
+		f.metrics.Increment("open_error")
+		return fileID{}, false
+	}
+
+	f.logger.Info().Str("path", path).Int64("offset", offset).Bool("resumed", found).Msg("tailing file")
+	f.files[id] = &tailedFile{id: id, path: path, input: in, file: file, offset: offset, acks: &ackWindow{committed: offset}, fingerprint: fingerprint}
+	f.stateChanged = true
+	return id, true
+}
+
+// resumeRotated opens files rotated while the receiver was stopped, so their unread lines aren't lost.
+// Rotated file is looked up by inode among files named after the saved path, e.g. access.log.1
+func (f *FileReceiver) resumeRotated() {
+	for id, s := range f.savedStates {
+		path := findRotated(s.Path, id)
+		if path == "" {
+			f.logger.Info().Str("path", s.Path).Msg("saved file is gone; forgetting it")
+			delete(f.savedStates, id)
+			f.stateChanged = true
+			continue
+		}
+		in := f.matchInput(s.Path)
+		if in == nil {
+			// the input may be configured again, so its offset is kept
+			f.logger.Info().Str("path", s.Path).Msg("saved file doesn't match inputs; keeping its offset")
+			continue
+		}
+		// not matched by the input pattern, so it's closed once read like any rotated file
+		f.track(path, in)
+	}
+}
+
+func (f *FileReceiver) matchInput(path string) *fileInput {
+	for _, in := range f.inputs {
+		if matched, _ := filepath.Match(in.pattern, path); matched {
+			return in
+		}
+	}
+	return nil
+}
+
+// findRotated returns path of the file with given id, which has the same or prefixed name
+func findRotated(path string, id fileID) string {
+	dir, base := filepath.Dir(path), filepath.Base(path)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, e := range entries {
+		if !e.Mode().IsRegular() || !strings.HasPrefix(e.Name(), base) {
+			continue
+		}
+		if eid, err := fileIdentity(e); err == nil && eid == id {
+			return filepath.Join(dir, e.Name())
+		}
+	}
+	return ""
+}
+
+// readFingerprint returns first bytes of the file
+func readFingerprint(file *os.File) ([]byte, error) {
+	buf := make([]byte, fileFingerprintSize)
+	n, err := file.ReadAt(buf, 0)
+	if err == io.EOF {
+		err = nil
+	}
+	return buf[:n], err
+}
+
+// sameContent reports whether the current fingerprint is taken from the file the previous one was taken from
+func sameContent(previous, current []byte) bool {
+	return len(current) >= len(previous) && bytes.Equal(previous, current[:len(previous)])
+}
+
+// read sends complete lines appended to the file and returns their number
+func (f *FileReceiver) read(done <-chan struct{}, t *tailedFile) (int, error) {
+	fi, err := t.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	fingerprint, err := readFingerprint(t.file)
+	if err != nil {
+		return 0, err
+	}
+	readPos := t.offset + int64(len(t.pending))
+	if fi.Size() < readPos || !sameContent(t.fingerprint, fingerprint) {
+		// copytruncate: lines written after the copy but before the truncation are lost anyway.
+		// The file could regrow past the offset before the poll, so its first bytes are compared too
+		f.logger.Info().Str("path", t.path).Msg("file truncated")
+		f.metrics.Increment("truncated")
+		if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		t.offset, t.pending, t.discard = 0, nil, false
+		f.acksMu.Lock()
+		t.acks = &ackWindow{}
+		f.acksMu.Unlock()
+		t.fingerprint = nil
+		f.stateChanged = true
+	}
+	if len(fingerprint) > len(t.fingerprint) {
+		t.fingerprint = fingerprint
+		f.stateChanged = true
+	}
+
+	prefix := []byte(t.input.hostname + "\t" + t.input.tag + "\t")
+	sent := 0
+	for {
+		n, err := t.file.Read(f.readBuf)
+		t.pending = append(t.pending, f.readBuf[:n]...)
+
+		for {
+			idx := bytes.IndexByte(t.pending, '\n')
+			if idx < 0 {
+				break
+			}
+			line := bytes.TrimSuffix(t.pending[:idx], []byte{'\r'})
+			end := t.offset + int64(idx+1)
+			if !t.discard && len(line) > f.maxLineSize {
+				f.logger.Warn().Str("path", t.path).Int("limit", f.maxLineSize).Msg("line is too long; skipping")
+				f.metrics.Increment("line_too_long")
+				f.skip(t, end)
+			} else if !t.discard && len(line) > 0 {
+				msg := make([]byte, 0, len(prefix)+len(line))
+				msg = append(msg, prefix...)
+				msg = append(msg, line...)
+				select {
+				case f.msgChan <- processor.Message{Data: msg, Ack: f.sent(t, end)}:
+				case <-done:
+					// the line isn't committed, so it's sent again after restart
+					return sent, nil
+				}
+				sent++
+				if sent%100 == 0 {
+					f.metrics.Count("lines", 100)
+				}
+			} else {
+				f.skip(t, end)
+			}
+			t.discard = false
+			t.offset = end
+			t.pending = t.pending[idx+1:]
+			f.stateChanged = true
+		}
+
+		if len(t.pending) > f.maxLineSize {
+			f.logger.Warn().Str("path", t.path).Int("limit", f.maxLineSize).Msg("line is too long; skipping")
+			f.metrics.Increment("line_too_long")
+			t.offset += int64(len(t.pending))
+			f.skip(t, t.offset)
+			t.pending = nil
+			t.discard = true
+			f.stateChanged = true
+		}
+
+		if err == io.EOF {
+			if sent%100 > 0 {
+				f.metrics.Count("lines", sent%100)
+			}
+			// release the already sent part of the buffer
+			t.pending = append([]byte(nil), t.pending...)
+			return sent, nil
+		} else if err != nil {
+			return sent, err
+		}
+	}
+}
+
+// sent registers the line ending at the offset and returns its ack.
+// XXX the line should be sent right away, otherwise it blocks commits of the following lines
+func (f *FileReceiver) sent(t *tailedFile, offset int64) func() {
+	f.acksMu.Lock()
+	w := t.acks
+	seq := w.add(offset)
+	f.acksMu.Unlock()
+	return func() {
+		f.acksMu.Lock()
+		if w.ack(seq) {
+			f.acksChanged = true
+		}
+		f.acksMu.Unlock()
+	}
+}
+
+// skip commits the line which isn't sent once the lines before it are stored
+func (f *FileReceiver) skip(t *tailedFile, offset int64) {
+	f.acksMu.Lock()
+	t.acks.skip(offset)
+	f.acksChanged = true
+	f.acksMu.Unlock()
+}
+
+func (f *FileReceiver) inFlight(t *tailedFile) int {
+	f.acksMu.Lock()
+	defer f.acksMu.Unlock()
+	return t.acks.inFlight()
+}
+
+func (f *FileReceiver) close() {
+	if err := f.saveState(); err != nil {
+		f.logger.Error().Err(err).Msg("unable to save state")
+		f.metrics.Increment("state_error")
+	}
+	// files are kept to save offsets committed while the queued lines are flushed
+	for _, t := range f.files {
+		t.file.Close()
+	}
+}
+
+// SaveState saves offsets committed after Stop, once the uploader has flushed the queued lines
+func (f *FileReceiver) SaveState() {
+	if err := f.saveState(); err != nil {
+		f.logger.Error().Err(err).Msg("unable to save state")
+		f.metrics.Increment("state_error")
+	}
+}
+
+func (f *FileReceiver) Stop() {
+	f.logger.Info().Msg("stopping")
+	f.wg.Wait()
+	close(f.msgChan)
+}
@@ -0,0 +1,272 @@
+package receiver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+	"nginx-log-collector/processor"
+)
+
+func appendFile(t *testing.T, path, data string) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = file.WriteString(data)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+}
+
+// receiveAll acks received lines as if they were uploaded
+func receiveAll(msgChan chan processor.Message) []string {
+	var msgs []string
+	for len(msgChan) > 0 {
+		msg := <-msgChan
+		msgs = append(msgs, string(msg.Data))
+		msg.Ack()
+	}
+	return msgs
+}
+
+func newTestFileReceiver(t *testing.T, dir string) *FileReceiver {
+	logger := zerolog.Nop()
+	f, err := NewFileReceiver(&config.FileReceiver{
+		StateFile:   filepath.Join(dir, "state.json"),
+		MaxLineSize: 16,
+		Inputs:      []config.FileInput{{Path: filepath.Join(dir, "*.log"), Tag: "nginx:", Hostname: "web1"}},
+	}, metrics.Nop(), &logger)
+	assert.Nil(t, err)
+	f.rotateWait = 0
+	return f
+}
+
+func TestFileReceiverResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	done := make(chan struct{})
+
+	appendFile(t, path, "{\"a\":1}\n"+"too long line is skipped\n"+"{\"a\":2}\r\n"+"{\"a\"")
+	f := newTestFileReceiver(t, dir)
+	f.poll(done)
+	assert.Equal(t, []string{"web1\tnginx:\t{\"a\":1}", "web1\tnginx:\t{\"a\":2}"}, receiveAll(f.MsgChan()))
+	f.close()
+
+	appendFile(t, path, ":3}\n{\"a\":4}\n")
+	f = newTestFileReceiver(t, dir)
+	f.poll(done)
+	assert.Equal(t, []string{"web1\tnginx:\t{\"a\":3}", "web1\tnginx:\t{\"a\":4}"}, receiveAll(f.MsgChan()))
+	f.close()
+
+	f = newTestFileReceiver(t, dir)
+	f.poll(done)
+	assert.Empty(t, receiveAll(f.MsgChan()))
+	f.close()
+}
+
+func TestFileReceiverCommitsAckedLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	done := make(chan struct{})
+
+	appendFile(t, path, "{\"a\":1}\n{\"a\":2}\n{\"a\":3}\n")
+	f := newTestFileReceiver(t, dir)
+	f.poll(done)
+	first, second, third := <-f.MsgChan(), <-f.MsgChan(), <-f.MsgChan()
+	// batches are uploaded out of order, only the stored prefix is committed
+	second.Ack()
+	first.Ack()
+	f.close()
+	f.SaveState()
+
+	f = newTestFileReceiver(t, dir)
+	f.poll(done)
+	assert.Equal(t, []string{"web1\tnginx:\t{\"a\":3}"}, receiveAll(f.MsgChan()))
+	third.Ack() // ack of the previous run is ignored
+	f.close()
+	f.SaveState()
+
+	f = newTestFileReceiver(t, dir)
+	f.poll(done)
+	assert.Empty(t, receiveAll(f.MsgChan()))
+	f.close()
+}
+
+func TestAckWindow(t *testing.T) {
+	w := &ackWindow{committed: 10}
+	w.skip(15)
+	assert.Equal(t, int64(15), w.committed)
+
+	first, second := w.add(20), w.add(30)
+	w.skip(40)
+	assert.False(t, w.ack(second))
+	assert.Equal(t, int64(15), w.committed)
+	assert.True(t, w.ack(first))
+	assert.Equal(t, int64(40), w.committed)
+	assert.Equal(t, 0, w.inFlight())
+
+	third := w.add(50)
+	assert.Equal(t, uint64(3), third)
+	assert.True(t, w.ack(third))
+	assert.Equal(t, int64(50), w.committed)
+}
+
+func TestFileReceiverRotation(t *testing.T) {
+	tests := []struct {
+		name   string
+		rotate func(t *testing.T, path string)
+		files  int
+	}{
+		{
+			name: "rename",
+			rotate: func(t *testing.T, path string) {
+				assert.Nil(t, os.Rename(path, path+".1"))
+				appendFile(t, path+".1", "{\"a\":2}\n") // written before the writer reopens the log
+				appendFile(t, path, "{\"a\":3}\n")
+			},
+			files: 2,
+		},
+		{
+			name: "copytruncate",
+			rotate: func(t *testing.T, path string) {
+				appendFile(t, path, "{\"a\":2}\n")
+				assert.Nil(t, os.Truncate(path, 0))
+				appendFile(t, path, "{\"a\":3}\n")
+			},
+			files: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "file")
+			assert.Nil(t, err)
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "access.log")
+			done := make(chan struct{})
+
+			appendFile(t, path, "{\"a\":1,\"b\":1}\n")
+			f := newTestFileReceiver(t, dir)
+			defer f.close()
+			f.poll(done)
+			assert.Equal(t, []string{"web1\tnginx:\t{\"a\":1,\"b\":1}"}, receiveAll(f.MsgChan()))
+
+			tt.rotate(t, path)
+			f.poll(done)
+			msgs := receiveAll(f.MsgChan())
+			assert.Contains(t, msgs, "web1\tnginx:\t{\"a\":3}")
+			if tt.name == "rename" {
+				assert.Contains(t, msgs, "web1\tnginx:\t{\"a\":2}")
+			}
+			assert.Len(t, f.files, tt.files)
+
+			// rotated file is closed once it's drained
+			f.poll(done)
+			assert.Len(t, f.files, 1)
+			assert.Empty(t, receiveAll(f.MsgChan()))
+		})
+	}
+}
+
+func TestFileReceiverRotatedWhileStopped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	done := make(chan struct{})
+
+	appendFile(t, path, "{\"a\":1}\n")
+	f := newTestFileReceiver(t, dir)
+	f.poll(done)
+	assert.Equal(t, []string{"web1\tnginx:\t{\"a\":1}"}, receiveAll(f.MsgChan()))
+	f.close()
+
+	appendFile(t, path, "{\"a\":2}\n")
+	assert.Nil(t, os.Rename(path, path+".1"))
+	appendFile(t, path, "{\"a\":3}\n")
+
+	f = newTestFileReceiver(t, dir)
+	defer f.close()
+	f.poll(done)
+	msgs := receiveAll(f.MsgChan())
+	assert.ElementsMatch(t, []string{"web1\tnginx:\t{\"a\":2}", "web1\tnginx:\t{\"a\":3}"}, msgs)
+
+	// resumed rotated file is closed once it's drained
+	f.poll(done)
+	assert.Len(t, f.files, 1)
+	assert.Empty(t, f.savedStates)
+}
+
+func TestFileReceiverKeepsUnopenedState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	done := make(chan struct{})
+
+	// the file isn't matched by inputs anymore
+	path := filepath.Join(dir, "access.txt")
+	appendFile(t, path, "{\"a\":1}\n")
+	fi, err := os.Stat(path)
+	assert.Nil(t, err)
+	id, err := fileIdentity(fi)
+	assert.Nil(t, err)
+
+	f := newTestFileReceiver(t, dir)
+	f.savedStates[id] = fileState{Path: path, Dev: id.dev, Inode: id.inode, Offset: 10}
+	f.stateChanged = true
+	f.poll(done)
+	assert.Empty(t, receiveAll(f.MsgChan()))
+	f.close()
+
+	states, err := loadFileState(filepath.Join(dir, "state.json"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), states[id].Offset)
+}
+
+func TestFileReceiverTruncatedAndRegrown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	done := make(chan struct{})
+
+	appendFile(t, path, "{\"a\":1}\n")
+	f := newTestFileReceiver(t, dir)
+	defer f.close()
+	f.poll(done)
+	assert.Equal(t, []string{"web1\tnginx:\t{\"a\":1}"}, receiveAll(f.MsgChan()))
+
+	// copytruncate and the file regrew past the old offset before the next poll
+	assert.Nil(t, os.Truncate(path, 0))
+	appendFile(t, path, "{\"b\":2}\n{\"b\":3}\n")
+	f.poll(done)
+	assert.Equal(t, []string{"web1\tnginx:\t{\"b\":2}", "web1\tnginx:\t{\"b\":3}"}, receiveAll(f.MsgChan()))
+}
+
+func TestValidateFileConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.FileReceiver
+		err  bool
+	}{
+		{"valid", config.FileReceiver{StateFile: "state.json", Inputs: []config.FileInput{{Path: "/var/log/*.log", Tag: "nginx:"}}}, false},
+		{"no state file", config.FileReceiver{Inputs: []config.FileInput{{Path: "/var/log/*.log", Tag: "nginx:"}}}, true},
+		{"no inputs", config.FileReceiver{StateFile: "state.json"}, true},
+		{"bad pattern", config.FileReceiver{StateFile: "state.json", Inputs: []config.FileInput{{Path: "/var/log/[", Tag: "nginx:"}}}, true},
+		{"no tag", config.FileReceiver{StateFile: "state.json", Inputs: []config.FileInput{{Path: "/var/log/*.log"}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateFileConfig(&tt.cfg)
+			assert.Equal(t, tt.err, err != nil, "%v", err)
+		})
+	}
+}
@@ -0,0 +1,456 @@
+package receiver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+const (
+	defaultForwardMaxMessageSize = 16 * 1024 * 1024
+	defaultForwardHostnameKey    = "hostname"
+)
+
+// forwardRoute maps fluent tags to a collected log tag
+type forwardRoute struct {
+	match      string
+	tag        string
+	messageKey string
+}
+
+// ForwardReceiver receives Fluentd Forward protocol messages, e.g. from Fluent Bit forward output.
+// Records are sent as json or as the raw line from message key, so access and error converters apply
+type ForwardReceiver struct {
+	msgChan        chan []byte
+	listener       net.Listener
+	maxMessageSize int
+	hostnameKey    []string
+	routes         []forwardRoute
+
+	metrics metrics.Metrics
+	logger  zerolog.Logger
+	wg      *sync.WaitGroup
+}
+
+func NewForwardReceiver(cfg *config.ForwardReceiver, metrics metrics.Metrics, logger *zerolog.Logger) (*ForwardReceiver, error) {
+	if err := ValidateForwardConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	resolvedAddr, err := net.ResolveTCPAddr("tcp", cfg.Addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to resolve addr")
+	}
+	listener, err := net.ListenTCP("tcp", resolvedAddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to listen")
+	}
+
+	maxMessageSize := defaultForwardMaxMessageSize
+	if cfg.MaxMessageSize > 0 {
+		maxMessageSize = cfg.MaxMessageSize
+	}
+	hostnameKey := defaultForwardHostnameKey
+	if cfg.HostnameKey != "" {
+		hostnameKey = cfg.HostnameKey
+	}
+	routes := make([]forwardRoute, 0, len(cfg.Routes))
+	for _, r := range cfg.Routes {
+		routes = append(routes, forwardRoute{match: r.Match, tag: r.Tag, messageKey: r.MessageKey})
+	}
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+
+	return &ForwardReceiver{
+		msgChan:        make(chan []byte, 100000),
+		listener:       listener,
+		maxMessageSize: maxMessageSize,
+		hostnameKey:    strings.Split(hostnameKey, "."),
+		routes:         routes,
+		metrics:        receiverMetrics(metrics, "forward"),
+		wg:             wg,
+		logger:         logger.With().Str("component", "receiver.forward").Logger(),
+	}, nil
+}
+
+// ValidateForwardConfig checks forward receiver routes; tags are checked against collected logs by the caller
+func ValidateForwardConfig(cfg *config.ForwardReceiver) error {
+	if len(cfg.Routes) == 0 {
+		return errors.New("no routes configured")
+	}
+	for i, r := range cfg.Routes {
+		if _, err := path.Match(r.Match, ""); err != nil || r.Match == "" {
+			return fmt.Errorf("routes[%d]: invalid match pattern %q", i, r.Match)
+		}
+		if r.Tag == "" {
+			return fmt.Errorf("routes[%d]: tag should be set", i)
+		}
+	}
+	return nil
+}
+
+func (f *ForwardReceiver) MsgChan() chan []byte {
+	return f.msgChan
+}
+
+func (f *ForwardReceiver) Start(done <-chan struct{}) {
+	f.logger.Info().Msg("starting")
+
+	go func() {
+		defer f.wg.Done()
+		monitorQueue(done, f.msgChan, f.metrics, &f.logger)
+	}()
+
+	defer f.listener.Close()
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			f.logger.Warn().Err(err).Msg("unable to accept connection")
+			continue
+		}
+		f.wg.Add(1)
+		go f.handle(conn, done)
+	}
+}
+
+func (f *ForwardReceiver) handle(conn net.Conn, done <-chan struct{}) {
+	defer conn.Close()
+	defer f.wg.Done()
+	f.metrics.Increment("accepted")
+	peer := peerHost(conn.RemoteAddr())
+	reader := bufio.NewReader(conn)
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		err := conn.SetReadDeadline(time.Now().Add(tcpReadTimeout))
+		if err != nil {
+			f.logger.Warn().Err(err).Msg("set deadline error")
+		}
+
+		sent, chunk, err := f.readMessage(newMsgpackDecoder(reader, f.maxMessageSize), peer)
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			if _, ok := err.(net.Error); ok {
+				f.logger.Debug().Err(err).Msg("read error (can be ignored)") // it's ok
+			} else {
+				// msgpack stream can't be resynced after a broken message
+				f.logger.Warn().Err(err).Str("peer", peer).Msg("closing connection")
+				f.metrics.Increment("protocol_error")
+			}
+			return
+		}
+
+		// records are queued, so the client can drop its chunk
+		if chunk != "" {
+			ack := appendMsgpackString([]byte{0x81}, "ack")
+			if _, err := conn.Write(appendMsgpackString(ack, chunk)); err != nil {
+				f.logger.Debug().Err(err).Msg("ack write error")
+				return
+			}
+		}
+
+		if sent > 0 {
+			f.metrics.Count("lines", sent)
+		}
+	}
+}
+
+// readMessage reads Message, Forward or (Compressed)PackedForward mode message and sends its records.
+// Returns number of records sent and chunk option to ack
+func (f *ForwardReceiver) readMessage(dec *msgpackDecoder, peer string) (int, string, error) {
+	n, err := dec.readArrayLen()
+	if err != nil {
+		return 0, "", err
+	}
+	if n < 2 || n > 4 {
+		return 0, "", fmt.Errorf("unexpected message length %d", n)
+	}
+	v, err := dec.readValue()
+	if err != nil {
+		return 0, "", err
+	}
+	fluentTag, ok := v.(string)
+	if !ok {
+		return 0, "", errors.New("tag should be a string")
+	}
+
+	var entries []forwardEntry
+	var packed []byte
+	c, err := dec.peek()
+	if err != nil {
+		return 0, "", noEOF(err)
+	}
+	switch {
+	case c&0xf0 == 0x90 || c == 0xdc || c == 0xdd: // Forward: [tag, [[time, record], ...], option]
+		v, err := dec.readValue()
+		if err != nil {
+			return 0, "", err
+		}
+		for _, v := range v.([]interface{}) {
+			entry, err := decodeEntry(v)
+			if err != nil {
+				return 0, "", err
+			}
+			entries = append(entries, entry)
+		}
+		n -= 2
+	case c&0xe0 == 0xa0 || c >= 0xd9 && c <= 0xdb || c >= 0xc4 && c <= 0xc6: // PackedForward: [tag, entries stream, option]
+		v, err := dec.readValue()
+		if err != nil {
+			return 0, "", err
+		}
+		if s, ok := v.(string); ok {
+			packed = []byte(s)
+		} else {
+			packed = v.([]byte)
+		}
+		n -= 2
+	default: // Message: [tag, time, record, option]
+		if n < 3 {
+			return 0, "", errors.New("message record is missing")
+		}
+		eventTime, err := dec.readValue()
+		if err != nil {
+			return 0, "", err
+		}
+		record, err := dec.readValue()
+		if err != nil {
+			return 0, "", err
+		}
+		entry, err := decodeEntry([]interface{}{eventTime, record})
+		if err != nil {
+			return 0, "", err
+		}
+		entries = append(entries, entry)
+		n -= 3
+	}
+
+	if n > 1 {
+		return 0, "", errors.New("unexpected message length")
+	}
+	var option map[string]interface{}
+	if n > 0 {
+		v, err := dec.readValue()
+		if err != nil {
+			return 0, "", err
+		}
+		option, _ = v.(map[string]interface{})
+	}
+	chunk, _ := option["chunk"].(string)
+
+	if packed != nil {
+		entries, err = f.unpackEntries(packed, option["compressed"])
+		if err != nil {
+			return 0, "", errors.Wrap(err, "invalid packed entries")
+		}
+	}
+
+	sent := 0
+	for _, entry := range entries {
+		if f.sendRecord(fluentTag, entry, peer) {
+			sent++
+		}
+	}
+	return sent, chunk, nil
+}
+
+// unpackEntries decodes msgpack stream of [time, record] entries
+func (f *ForwardReceiver) unpackEntries(packed []byte, compressed interface{}) ([]forwardEntry, error) {
+	var r io.Reader = bytes.NewReader(packed)
+	switch compressed {
+	case nil, "text":
+	case "gzip":
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	default:
+		return nil, fmt.Errorf("unsupported compression %v", compressed)
+	}
+
+	// decompressed entries share the message size limit
+	dec := newMsgpackDecoder(bufio.NewReader(r), f.maxMessageSize)
+	var entries []forwardEntry
+	for {
+		if _, err := dec.peek(); err == io.EOF {
+			return entries, nil
+		}
+		v, err := dec.readValue()
+		if err != nil {
+			return nil, err
+		}
+		entry, err := decodeEntry(v)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// forwardEntry is a record with its event time
+type forwardEntry struct {
+	time   time.Time
+	record map[string]interface{}
+}
+
+func decodeEntry(v interface{}) (forwardEntry, error) {
+	arr, ok := v.([]interface{})
+	if !ok || len(arr) != 2 {
+		return forwardEntry{}, errors.New("entry should be [time, record]")
+	}
+	eventTime, err := decodeEventTime(arr[0])
+	if err != nil {
+		return forwardEntry{}, err
+	}
+	record, ok := arr[1].(map[string]interface{})
+	if !ok {
+		return forwardEntry{}, errors.New("record should be a map")
+	}
+	return forwardEntry{time: eventTime, record: record}, nil
+}
+
+// decodeEventTime decodes unix time in seconds or EventTime extension with nanoseconds
+func decodeEventTime(v interface{}) (time.Time, error) {
+	switch value := v.(type) {
+	case int64:
+		return time.Unix(value, 0), nil
+	case uint64:
+		return time.Unix(int64(value), 0), nil
+	case msgpackExt:
+		if value.Type == 0 && len(value.Data) == 8 {
+			sec := binary.BigEndian.Uint32(value.Data[:4])
+			nsec := binary.BigEndian.Uint32(value.Data[4:])
+			return time.Unix(int64(sec), int64(nsec)), nil
+		}
+	}
+	return time.Time{}, errors.New("time should be an integer or EventTime")
+}
+
+// sendRecord converts the record to hostname\ttag\tmsg line of the first matching route,
+// json records get missing event_datetime from the event time
+func (f *ForwardReceiver) sendRecord(fluentTag string, entry forwardEntry, peer string) bool {
+	record := entry.record
+	var route *forwardRoute
+	for i := range f.routes {
+		if matched, _ := path.Match(f.routes[i].match, fluentTag); matched {
+			route = &f.routes[i]
+			break
+		}
+	}
+	if route == nil {
+		f.logger.Debug().Str("fluent_tag", fluentTag).Msg("no route for tag")
+		f.metrics.Increment("unrouted")
+		return false
+	}
+
+	hostname, ok := recordString(lookupRecord(record, f.hostnameKey))
+	if !ok || hostname == "" {
+		hostname = peer
+	}
+
+	var msg []byte
+	if route.messageKey != "" {
+		line, ok := recordString(record[route.messageKey])
+		if !ok {
+			f.metrics.Increment("missing_key")
+			return false
+		}
+		msg = []byte(strings.TrimRight(line, "\r\n"))
+	} else {
+		if _, found := record["event_datetime"]; !found {
+			record["event_datetime"] = entry.time.Format(eventDatetimeLayout)
+		}
+		var err error
+		if msg, err = json.Marshal(jsonValue(record)); err != nil {
+			f.logger.Warn().Err(err).Str("fluent_tag", fluentTag).Msg("unable to marshal record")
+			f.metrics.Increment("parse_error")
+			return false
+		}
+	}
+
+	line := make([]byte, 0, len(hostname)+len(route.tag)+len(msg)+2)
+	line = append(line, hostname...)
+	line = append(line, '\t')
+	line = append(line, route.tag...)
+	line = append(line, '\t')
+	f.msgChan <- append(line, msg...)
+	return true
+}
+
+// lookupRecord returns value of nested key like kubernetes.host
+func lookupRecord(record map[string]interface{}, key []string) interface{} {
+	var v interface{} = record
+	for _, k := range key {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+// recordString returns str or bin value as string
+func recordString(v interface{}) (string, bool) {
+	switch s := v.(type) {
+	case string:
+		return s, true
+	case []byte:
+		return string(s), true
+	default:
+		return "", false
+	}
+}
+
+// jsonValue converts bin values to strings, json would encode them in base64
+func jsonValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case []byte:
+		return string(value)
+	case map[string]interface{}:
+		for k, item := range value {
+			value[k] = jsonValue(item)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = jsonValue(item)
+		}
+	case msgpackExt:
+		return value.Data
+	}
+	return v
+}
+
+func (f *ForwardReceiver) Stop() {
+	f.listener.Close()
+	f.logger.Info().Msg("stopping")
+	f.wg.Wait()
+	close(f.msgChan)
+}
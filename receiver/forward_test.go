@@ -0,0 +1,237 @@
+package receiver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"math"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+// packMsgpack encodes test values, map keys are sorted to keep output stable
+func packMsgpack(v interface{}) []byte {
+	var buf []byte
+	switch value := v.(type) {
+	case nil:
+		buf = append(buf, 0xc0)
+	case bool:
+		if value {
+			buf = append(buf, 0xc3)
+		} else {
+			buf = append(buf, 0xc2)
+		}
+	case int:
+		buf = append(buf, 0xd3)
+		buf = append(buf, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(buf[1:], uint64(value))
+	case float64:
+		buf = append(buf, 0xcb)
+		buf = append(buf, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(buf[1:], math.Float64bits(value))
+	case string:
+		buf = appendMsgpackString(buf, value)
+	case []byte:
+		buf = append(buf, 0xc6, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(buf[1:], uint32(len(value)))
+		buf = append(buf, value...)
+	case msgpackExt:
+		buf = append(buf, 0xc7, byte(len(value.Data)), byte(value.Type))
+		buf = append(buf, value.Data...)
+	case []interface{}:
+		buf = append(buf, 0xdc, byte(len(value)>>8), byte(len(value)))
+		for _, item := range value {
+			buf = append(buf, packMsgpack(item)...)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for k := range value {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf = append(buf, 0xde, byte(len(value)>>8), byte(len(value)))
+		for _, k := range keys {
+			buf = append(buf, packMsgpack(k)...)
+			buf = append(buf, packMsgpack(value[k])...)
+		}
+	}
+	return buf
+}
+
+func TestMsgpackDecoder(t *testing.T) {
+	value := map[string]interface{}{
+		"str":   "nginx",
+		"bin":   []byte("bin"),
+		"int":   -5,
+		"float": 1.5,
+		"bool":  true,
+		"nil":   nil,
+		"ext":   msgpackExt{Type: 0, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}},
+		"arr":   []interface{}{"a", map[string]interface{}{"b": "c"}},
+	}
+	packed := packMsgpack(value)
+	data := append(packed, 0x05, 0xff, 0xcc, 0xfa, 0x92, 0xa1, 'x', 0xc3)
+
+	dec := newMsgpackDecoder(bufio.NewReader(bytes.NewReader(data)), len(data))
+	v, err := dec.readValue()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"str":   "nginx",
+		"bin":   []byte("bin"),
+		"int":   int64(-5),
+		"float": 1.5,
+		"bool":  true,
+		"nil":   nil,
+		"ext":   msgpackExt{Type: 0, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}},
+		"arr":   []interface{}{"a", map[string]interface{}{"b": "c"}},
+	}, v)
+	for _, expected := range []interface{}{int64(5), int64(-1), uint64(250), []interface{}{"x", true}} {
+		v, err := dec.readValue()
+		assert.Nil(t, err)
+		assert.Equal(t, expected, v)
+	}
+
+	dec = newMsgpackDecoder(bufio.NewReader(bytes.NewReader(data)), len(packed)-1)
+	_, err = dec.readValue()
+	assert.Equal(t, errMsgpackTooLarge, err)
+
+	dec = newMsgpackDecoder(bufio.NewReader(bytes.NewReader(data[:10])), len(data))
+	_, err = dec.readValue()
+	assert.Error(t, err)
+}
+
+func TestForwardReceiver(t *testing.T) {
+	logger := zerolog.Nop()
+	f, err := NewForwardReceiver(&config.ForwardReceiver{
+		Addr:        "127.0.0.1:0",
+		HostnameKey: "kubernetes.host",
+		Routes: []config.ForwardRoute{
+			{Match: "kube.nginx.error", Tag: "nginx_error:", MessageKey: "log"},
+			{Match: "kube.nginx.*", Tag: "nginx:"},
+		},
+	}, metrics.Nop(), &logger)
+	assert.Nil(t, err)
+	done := make(chan struct{})
+	go f.Start(done)
+	defer func() {
+		close(done)
+		f.Stop()
+	}()
+
+	eventTime := msgpackExt{Type: 0, Data: []byte{0x5e, 0xa3, 0x1e, 0x82, 0, 0, 0, 0}}
+	access := map[string]interface{}{
+		"kubernetes":     map[string]interface{}{"host": "node1"},
+		"event_datetime": "2020-04-24T18:14:42+03:00",
+		"request_uri":    []byte("/"),
+		"status":         200,
+	}
+	accessMsg := `node1	nginx:	{"event_datetime":"2020-04-24T18:14:42+03:00","kubernetes":{"host":"node1"},"request_uri":"/","status":200}`
+	errorRecord := map[string]interface{}{"log": "2020/04/24 18:14:42 [error] 1#1: *1 open() failed\n"}
+	errorMsg := "127.0.0.1\tnginx_error:\t2020/04/24 18:14:42 [error] 1#1: *1 open() failed"
+
+	packed := append(packMsgpack([]interface{}{eventTime, access}), packMsgpack([]interface{}{1587741282, access})...)
+	compressed := &bytes.Buffer{}
+	gz := gzip.NewWriter(compressed)
+	_, _ = gz.Write(packed)
+	_ = gz.Close()
+
+	tests := []struct {
+		name     string
+		message  []interface{}
+		ack      string
+		expected []string
+	}{
+		{
+			name:     "message",
+			message:  []interface{}{"kube.nginx.access", eventTime, access},
+			expected: []string{accessMsg},
+		},
+		{
+			name:     "message with chunk",
+			message:  []interface{}{"kube.nginx.error", 1587741282, errorRecord, map[string]interface{}{"chunk": "c1"}},
+			ack:      "c1",
+			expected: []string{errorMsg},
+		},
+		{
+			name: "forward",
+			message: []interface{}{"kube.nginx.error", []interface{}{
+				[]interface{}{eventTime, errorRecord},
+				[]interface{}{eventTime, map[string]interface{}{"message": "no log key"}},
+				[]interface{}{eventTime, errorRecord},
+			}},
+			expected: []string{errorMsg, errorMsg},
+		},
+		{
+			name:     "packed forward",
+			message:  []interface{}{"kube.nginx.access", packed, map[string]interface{}{"size": 2, "chunk": "c2"}},
+			ack:      "c2",
+			expected: []string{accessMsg, accessMsg},
+		},
+		{
+			name:     "compressed packed forward",
+			message:  []interface{}{"kube.nginx.access", compressed.Bytes(), map[string]interface{}{"compressed": "gzip"}},
+			expected: []string{accessMsg, accessMsg},
+		},
+		{
+			name: "event time",
+			message: []interface{}{"kube.nginx.access", []interface{}{
+				[]interface{}{msgpackExt{Type: 0, Data: []byte{0x5e, 0xa3, 0x1e, 0x82, 0, 0, 0x03, 0xe8}}, map[string]interface{}{"status": 200}},
+				[]interface{}{1587741282, map[string]interface{}{"status": 200}},
+			}},
+			expected: []string{
+				`127.0.0.1	nginx:	{"event_datetime":"` + time.Unix(1587748482, 1000).Format(eventDatetimeLayout) + `","status":200}`,
+				`127.0.0.1	nginx:	{"event_datetime":"` + time.Unix(1587741282, 0).Format(eventDatetimeLayout) + `","status":200}`,
+			},
+		},
+		{
+			name:    "unrouted",
+			message: []interface{}{"kube.php", eventTime, access, map[string]interface{}{"chunk": "c3"}},
+			ack:     "c3",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", f.listener.Addr().String())
+			assert.Nil(t, err)
+			defer conn.Close()
+			_, err = conn.Write(packMsgpack(tt.message))
+			assert.Nil(t, err)
+
+			if tt.ack != "" {
+				assert.Nil(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+				v, err := newMsgpackDecoder(bufio.NewReader(conn), 1024).readValue()
+				assert.Nil(t, err)
+				assert.Equal(t, map[string]interface{}{"ack": tt.ack}, v)
+			}
+			for _, msg := range tt.expected {
+				assert.Equal(t, msg, receiveMsg(t, f.MsgChan()))
+			}
+			assert.Len(t, f.MsgChan(), 0)
+		})
+	}
+}
+
+func TestDecodeEventTime(t *testing.T) {
+	parsed, err := decodeEventTime(msgpackExt{Type: 0, Data: []byte{0x5e, 0xa3, 0x1e, 0x82, 0, 0, 0x03, 0xe8}})
+	assert.Nil(t, err)
+	assert.Equal(t, time.Unix(1587748482, 1000), parsed)
+
+	parsed, err = decodeEventTime(uint64(1587741282))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Unix(1587741282, 0), parsed)
+
+	_, err = decodeEventTime(msgpackExt{Type: 1, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}})
+	assert.Error(t, err)
+	_, err = decodeEventTime("2020-04-24")
+	assert.Error(t, err)
+}
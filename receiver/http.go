@@ -2,40 +2,45 @@ package receiver
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
-	"gopkg.in/alexcesaro/statsd.v2"
 
 	"nginx-log-collector/config"
-	"nginx-log-collector/utils"
+	"nginx-log-collector/metrics"
 )
 
 type HttpReceiver struct {
 	config  *config.HttpReceiver
-	metrics *statsd.Client
+	tls     *tlsSettings
+	metrics metrics.Metrics
 	msgChan chan []byte
 	logger  zerolog.Logger
 	wg      *sync.WaitGroup
-}
 
-type processedLogEntry struct {
-	EventDateTime string `json:"event_datetime"`
-	EventDate     string `json:"event_date"`
-	Hostname      string `json:"hostname"`
-	Message       string `json:"message"`
-	SetupID       string `json:"request_id"`
-	Severity      string `json:"severity"`
-	User          string `json:"user"`
-	RowNumber     int    `json:"row_number"`
+	tagsMu *sync.RWMutex
+	tags   map[string]bool
+
+	parsers       map[string]*lineParser
+	defaultParser string
+
+	loki       config.LokiPush
+	lokiFields []string // sorted to keep order of added fields
+
+	otlp config.OTLPLogs
+
+	elastic config.ElasticBulk
+
+	auth *authKeys
 }
 
 const (
@@ -44,34 +49,50 @@ const (
 	httpShutdownTimeout = 5 * time.Second
 
 	dateFormat           = "2006-01-02"
+	eventDatetimeLayout  = "2006-01-02T15:04:05.000000000Z07:00" // event_datetime of pushed records
 	headerHostname       = "X-Log-Source"
 	headerSetupID        = "X-Setup-Id"
 	multipartFormMaxSize = 100 * 1024 * 1024
-	tag                  = "puppet:"
 )
 
-var (
-	datetimeTransformers = []*utils.DatetimeTransformer{
-		{
-			"2006-01-02 15:04:05 -0700",
-			time.RFC3339,
-			time.Local,
-		},
-		{
-			"2006-01-02 15:04:05 0700",
-			time.RFC3339,
-			time.Local,
-		},
+func NewHttpReceiver(cfg *config.HttpReceiver, metrics metrics.Metrics, logger *zerolog.Logger) (*HttpReceiver, error) {
+	tlsSettings, err := newTLSSettings(cfg.TLS)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid tls config")
+	}
+	parsers, defaultParser, err := newLineParsers(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid parsers config")
+	}
+	if err := ValidateElasticConfig(cfg.Elastic); err != nil {
+		return nil, errors.Wrap(err, "invalid elasticsearch config")
+	}
+	auth, err := newAuthKeys(cfg.Auth)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid auth config")
 	}
-)
 
-func NewHttpReceiver(cfg *config.HttpReceiver, metrics *statsd.Client, logger *zerolog.Logger) (*HttpReceiver, error) {
 	httpReceiver := &HttpReceiver{
 		config:  cfg,
-		metrics: metrics.Clone(statsd.Prefix("receiver.http")),
+		tls:     tlsSettings,
+		metrics: receiverMetrics(metrics, "http"),
 		msgChan: make(chan []byte, 100000),
 		wg:      &sync.WaitGroup{},
 		logger:  logger.With().Str("component", "receiver.http").Logger(),
+		tagsMu:  &sync.RWMutex{},
+		tags:    make(map[string]bool),
+
+		parsers:       parsers,
+		defaultParser: defaultParser,
+
+		loki:       lokiSettings(cfg.Loki),
+		lokiFields: sortedKeys(cfg.Loki.Fields),
+
+		otlp: otlpSettings(cfg.OTLP),
+
+		elastic: elasticSettings(cfg.Elastic),
+
+		auth: auth,
 	}
 	return httpReceiver, nil
 }
@@ -84,13 +105,18 @@ func (h *HttpReceiver) Start(done <-chan struct{}) {
 	h.logger.Info().Msg("Starting")
 
 	router := http.NewServeMux()
-	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		h.handle(w, r)
-	})
+	router.HandleFunc("/", h.handleRoot)
+	router.HandleFunc(ingestPath, h.handleIngest)
+	if h.loki.Enabled {
+		router.HandleFunc(lokiPushPath, h.handleLokiPush)
+	}
+	if h.otlp.Enabled {
+		router.HandleFunc(otlpLogsPath, h.handleOTLPLogs)
+	}
 
 	server := &http.Server{
 		Addr:         h.config.Url,
-		Handler:      router,
+		Handler:      h.requireAuth(router),
 		ReadTimeout:  httpReadTimeout,
 		WriteTimeout: httpWriteTimeout,
 	}
@@ -101,7 +127,18 @@ func (h *HttpReceiver) Start(done <-chan struct{}) {
 	h.wg.Add(1)
 	go h.queueStats(done)
 
-	err := server.ListenAndServe()
+	if h.auth != nil {
+		h.wg.Add(1)
+		go h.watchKeys(done)
+	}
+
+	var err error
+	if h.tls != nil {
+		server.TLSConfig = h.tls.config
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
 	if err != nil && err != http.ErrServerClosed {
 		h.logger.Fatal().Err(err).Msgf("Could not listen on %s", h.config.Url)
 		return
@@ -130,14 +167,32 @@ func (h *HttpReceiver) gracefulShutdownSentry(done <-chan struct{}, server *http
 	}
 }
 
+// handleRoot routes elasticsearch api requests if enabled, the rest are log uploads
+func (h *HttpReceiver) handleRoot(w http.ResponseWriter, r *http.Request) {
+	if h.elastic.Enabled && isElasticPath(r) {
+		h.handleElastic(w, r)
+		return
+	}
+	h.handle(w, r)
+}
+
 // handle processes single request
 func (h *HttpReceiver) handle(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	hostname := r.Header.Get(headerHostname)
-	if hostname == "" {
+	hostname, ok := h.requestHostname(w, r)
+	if !ok {
+		return
+	}
+
+	parser, err := h.requestParser(r)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		_, _ = w.Write([]byte("Missing or empty " + headerHostname + " header"))
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	if !h.permitted(r, hostname, parser.tag) {
+		writeForbidden(w, hostname, parser.tag)
 		return
 	}
 
@@ -166,12 +221,12 @@ func (h *HttpReceiver) handle(w http.ResponseWriter, r *http.Request) {
 					continue
 				}
 
-				h.processContent(file, hostname, setupID)
+				h.processContent(file, parser, hostname, setupID)
 				_ = file.Close()
 			}
 		}
 	} else if strings.HasPrefix(contentType, "text/plain") {
-		h.processContent(r.Body, hostname, setupID)
+		h.processContent(r.Body, parser, hostname, setupID)
 	} else {
 		w.WriteHeader(http.StatusBadRequest)
 		_, _ = w.Write([]byte("Only 'text/plain' and 'multipart/form-data' content types are supported, got " + contentType))
@@ -181,16 +236,89 @@ func (h *HttpReceiver) handle(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// enforcedHostname returns hostname from the client certificate, empty if it isn't enforced
+func (h *HttpReceiver) enforcedHostname(r *http.Request) (string, error) {
+	if r.TLS == nil {
+		return "", nil
+	}
+	hostname, err := h.tls.hostname(r.TLS)
+	if err != nil {
+		h.metrics.Increment("tls_error")
+	}
+	return hostname, err
+}
+
+// requestHostname returns hostname of the log source or writes error response
+func (h *HttpReceiver) requestHostname(w http.ResponseWriter, r *http.Request) (string, bool) {
+	hostname := r.Header.Get(headerHostname)
+	enforced, err := h.enforcedHostname(r)
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(err.Error()))
+		return "", false
+	}
+	if enforced != "" { // client can't spoof hostname of another one
+		hostname = enforced
+	}
+	if hostname == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("Missing or empty " + headerHostname + " header"))
+		return "", false
+	}
+	return hostname, true
+}
+
+// pushSource resolves hostnames of records pushed by shipper protocols (loki, otlp, elasticsearch)
+type pushSource struct {
+	h        *HttpReceiver
+	r        *http.Request
+	enforced string // from client certificate
+	peer     string
+}
+
+// pushSource checks client certificate of the request, the error is written by the caller in its protocol format
+func (h *HttpReceiver) pushSource(r *http.Request) (*pushSource, error) {
+	enforced, err := h.enforcedHostname(r)
+	if err != nil {
+		return nil, err
+	}
+	peer, _, _ := net.SplitHostPort(r.RemoteAddr)
+	return &pushSource{h: h, r: r, enforced: enforced, peer: peer}, nil
+}
+
+// resolve returns hostname of the record and whether the key permits it to write the tag.
+// Client certificate hostname wins, then the record hostname, X-Log-Source header and peer address
+func (s *pushSource) resolve(recordHostname, tag string) (string, bool) {
+	hostname := s.enforced
+	if hostname == "" {
+		hostname = recordHostname
+	}
+	if hostname == "" {
+		hostname = s.r.Header.Get(headerHostname)
+	}
+	if hostname == "" {
+		hostname = s.peer
+	}
+	return hostname, s.h.permitted(s.r, hostname, tag)
+}
+
+// formatMessage builds HOSTNAME\tTAG\tLINE message of the processor input format
+func formatMessage(hostname, tag string, line []byte) []byte {
+	msg := make([]byte, 0, len(hostname)+len(tag)+len(line)+2)
+	msg = append(msg, hostname...)
+	msg = append(msg, '\t')
+	msg = append(msg, tag...)
+	msg = append(msg, '\t')
+	return append(msg, line...)
+}
+
 // processContent processes request body or posted file
-func (h *HttpReceiver) processContent(content io.Reader, hostname, setupID string) {
+func (h *HttpReceiver) processContent(content io.Reader, parser *lineParser, hostname, setupID string) {
 	hasData := true
 	reader := bufio.NewReader(content)
 	rowNumber := 0
 
-	var (
-		logEntryCurr *processedLogEntry
-		logEntryNext *processedLogEntry
-	)
+	var logEntryCurr logEntry
 
 	for hasData {
 		line, err := reader.ReadString('\n')
@@ -198,36 +326,32 @@ func (h *HttpReceiver) processContent(content io.Reader, hostname, setupID strin
 		if err != nil && hasData {
 			h.logger.Error().Err(err).Str("line", line).Msg("Got an error while reading the line")
 		}
+		if !hasData && line == "" { // content ends with a newline
+			break
+		}
 
 		line = strings.TrimSuffix(line, "\n")
-		logEntryNext, err = h.transformLine(line)
-
-		if logEntryCurr != nil {
-			if logEntryNext == nil {
-				logEntryCurr.Message += "\n" + line
-			}
-		}
+		logEntryNext, err := parser.parse(line)
 
 		if logEntryNext != nil { // new log entry is up
 			if logEntryCurr != nil { // flush previous log entry
-				h.sendLogEntry(logEntryCurr)
+				h.sendLogEntry(parser, logEntryCurr)
 			}
 
 			// switch to the new one
 			logEntryCurr = logEntryNext
-			logEntryCurr.Hostname = hostname
-			logEntryCurr.RowNumber = rowNumber
-			logEntryCurr.SetupID = setupID
+			logEntryCurr["hostname"] = hostname
+			logEntryCurr["row_number"] = rowNumber
+			logEntryCurr["request_id"] = setupID
 			rowNumber++
-		} else if logEntryCurr != nil { // another row of multiline log entry
-			logEntryCurr.Message += "\n" + line
-		} else if err != nil {
-			h.logger.Error().Err(err).Str("line", line).Msg("Got an error while processing the line")
+		} else if logEntryCurr == nil || !parser.appendLine(logEntryCurr, line) { // not another row of multiline log entry
+			h.logger.Error().Err(err).Str("parser", parser.name).Str("line", line).Msg("Got an error while processing the line")
+			h.metrics.Increment("line_error")
 		}
+	}
 
-		if !hasData && logEntryCurr != nil { // also flush the last log entry
-			h.sendLogEntry(logEntryCurr)
-		}
+	if logEntryCurr != nil { // also flush the last log entry
+		h.sendLogEntry(parser, logEntryCurr)
 	}
 }
 
@@ -246,67 +370,21 @@ func (h *HttpReceiver) queueStats(done <-chan struct{}) {
 		case <-ticker.C:
 			queueSize := len(h.msgChan)
 			h.logger.Debug().Int("http_msg_chan_len", queueSize).Msg("http queue stats")
-			h.metrics.Count("http_msg_chan_len", queueSize)
+			// statsd keeps the legacy bucket
+			metrics.StatsdOnly(h.metrics).Count("http_msg_chan_len", queueSize)
+			metrics.PrometheusOnly(h.metrics).Gauge("msg_chan_len", queueSize)
 		}
 	}
 }
 
 // sendLogEntry prepares the bytes buffer and sends it
-func (h *HttpReceiver) sendLogEntry(logEntry *processedLogEntry) {
-	data, err := json.Marshal(logEntry)
+func (h *HttpReceiver) sendLogEntry(parser *lineParser, entry logEntry) {
+	data, err := json.Marshal(entry)
 	if err != nil {
-		h.logger.Error().Err(err).Str("logEntry", fmt.Sprintf("%+v", logEntry)).Msg("Failed to marshal log entry")
+		h.logger.Error().Err(err).Str("logEntry", fmt.Sprintf("%+v", entry)).Msg("Failed to marshal log entry")
 		return
 	}
 
-	buffer := bytes.Buffer{}
-	buffer.WriteString(logEntry.Hostname)
-	buffer.WriteByte('\t')
-	buffer.WriteString(tag)
-	buffer.WriteByte('\t')
-	buffer.Write(data)
-
-	h.msgChan <- buffer.Bytes()
-}
-
-// transformLine parses log line and transforms it to access log format
-// expected line format:
-// 2020-04-24 18:14:42 +0300 Puppet (info): Applying configuration version '1587741267'
-func (h *HttpReceiver) transformLine(line string) (*processedLogEntry, error) {
-	// "2020-04-24", "18:14:42", "+0300", "Puppet", "(info):", "Applying configuration version '1587741267'"
-	parts := strings.SplitN(line, " ", 6)
-	if len(parts) != 6 {
-		return nil, fmt.Errorf("wrong line structure")
-	}
-
-	// "(info):"
-	severity := parts[4]
-	if !strings.HasPrefix(severity, "(") || !strings.HasSuffix(severity, "):") {
-		return nil, fmt.Errorf("wrong severity format: %s", severity)
-	}
-	severity = severity[1 : len(severity)-2]
-
-	// "2020-04-24", "18:14:42", "+0300"
-	datetime := strings.Join(parts[0:3], " ")
-	parsed, transformer, err := utils.TryDatetimeFormats(datetime, datetimeTransformers)
-	if err != nil {
-		return nil, err
-	}
-
-	// "Puppet"
-	user := parts[3]
-	if user == "" {
-		return nil, fmt.Errorf("wrong user format: %s", user)
-	}
-
-	// "Applying configuration version '1587741267'"
-	message := parts[5] // message can be empty
-
-	return &processedLogEntry{
-		EventDateTime: parsed.Format(transformer.FormatDst),
-		EventDate:     parsed.Format(dateFormat),
-		Message:       message,
-		Severity:      severity,
-		User:          user,
-	}, nil
+	h.msgChan <- formatMessage(entry["hostname"].(string), parser.tag, data)
+	h.metrics.Increment("lines")
 }
@@ -0,0 +1,238 @@
+package receiver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+const (
+	ingestPath          = "/ingest/"
+	ingestMaxBodySize   = 100 * 1024 * 1024
+	ingestMaxLineErrors = 100
+)
+
+var errBodyTooLarge = fmt.Errorf("request body exceeds %d bytes", ingestMaxBodySize)
+
+// bodyLimitReader fails with errBodyTooLarge once the limit is exceeded, unlike io.LimitReader which truncates silently
+type bodyLimitReader struct {
+	r io.Reader
+	n int64
+}
+
+// limitBody bounds request body; decompressed stream is wrapped as well, so small gzip bombs are rejected
+func limitBody(r io.Reader) io.Reader {
+	return &bodyLimitReader{r: r, n: ingestMaxBodySize}
+}
+
+func (l *bodyLimitReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// stream ending exactly at the limit is fine
+		if _, err := io.ReadFull(l.r, make([]byte, 1)); err != nil {
+			return 0, err
+		}
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// bodyErrorStatus returns response status for body read error
+func bodyErrorStatus(err error) int {
+	if errors.Cause(err) == errBodyTooLarge {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+type ingestLineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+type ingestResponse struct {
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Errors   []ingestLineError `json:"errors,omitempty"`
+	Error    string            `json:"error,omitempty"` // body can't be read, following records are lost
+}
+
+func (r *ingestResponse) reject(line int, err error) {
+	r.Rejected++
+	if len(r.Errors) < ingestMaxLineErrors {
+		r.Errors = append(r.Errors, ingestLineError{Line: line, Error: err.Error()})
+	}
+}
+
+// SetTags sets tags accepted by the ingest endpoint
+func (h *HttpReceiver) SetTags(logs []config.CollectedLog) {
+	tags := make(map[string]bool, len(logs))
+	for _, l := range logs {
+		tags[l.Tag] = true
+	}
+	h.tagsMu.Lock()
+	h.tags = tags
+	h.tagsMu.Unlock()
+}
+
+// resolveTag returns configured tag; trailing colon of syslog tags can be omitted in url
+func (h *HttpReceiver) resolveTag(tag string) (string, bool) {
+	h.tagsMu.RLock()
+	defer h.tagsMu.RUnlock()
+	if tag != "" && h.tags[tag] {
+		return tag, true
+	}
+	if tag != "" && h.tags[tag+":"] {
+		return tag + ":", true
+	}
+	return "", false
+}
+
+// handleIngest accepts NDJSON or JSON array of records for the tag: POST /ingest/{tag}
+func (h *HttpReceiver) handleIngest(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	tag, found := h.resolveTag(strings.TrimPrefix(r.URL.Path, ingestPath))
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("Unknown tag " + strings.TrimPrefix(r.URL.Path, ingestPath)))
+		return
+	}
+	hostname, ok := h.requestHostname(w, r)
+	if !ok {
+		return
+	}
+	if !h.permitted(r, hostname, tag) {
+		writeForbidden(w, hostname, tag)
+		return
+	}
+
+	body := limitBody(r.Body)
+	switch r.Header.Get("Content-Encoding") {
+	case "":
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			w.WriteHeader(bodyErrorStatus(err))
+			_, _ = w.Write([]byte("Invalid gzip body: " + err.Error()))
+			return
+		}
+		defer gz.Close()
+		body = limitBody(gz)
+	default:
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		_, _ = w.Write([]byte("Only gzip content encoding is supported"))
+		return
+	}
+
+	resp := &ingestResponse{}
+	prefix := []byte(hostname + "\t" + tag + "\t")
+	err := readIngestRecords(body, func(line int, record []byte, err error) {
+		if err == nil && (len(record) == 0 || record[0] != '{') {
+			err = errors.New("record should be a json object")
+		}
+		if err != nil {
+			resp.reject(line, err)
+			return
+		}
+		msg := make([]byte, 0, len(prefix)+len(record))
+		msg = append(msg, prefix...)
+		h.msgChan <- append(msg, record...)
+		resp.Accepted++
+	})
+
+	tagLabel := metrics.Tag(tag)
+	h.metrics.Count("ingest.accepted", resp.Accepted, tagLabel)
+	h.metrics.Count("ingest.rejected", resp.Rejected, tagLabel)
+
+	status := http.StatusOK
+	if err != nil {
+		h.logger.Warn().Err(err).Str("host", hostname).Str("tag", tag).Msg("unable to read ingest body")
+		h.metrics.Increment("ingest.body_error", tagLabel)
+		status = bodyErrorStatus(err)
+		resp.Error = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// readIngestRecords calls fn for every record of NDJSON or JSON array in compact form.
+// Invalid NDJSON lines are passed with an error, invalid array stops reading
+func readIngestRecords(r io.Reader, fn func(line int, record []byte, err error)) error {
+	reader := bufio.NewReader(r)
+	first, err := peekNonSpace(reader)
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if first == '[' {
+		decoder := json.NewDecoder(reader)
+		if _, err := decoder.Token(); err != nil {
+			return err
+		}
+		for line := 1; decoder.More(); line++ {
+			var record json.RawMessage
+			if err := decoder.Decode(&record); err != nil {
+				return errors.Wrapf(err, "record %d", line)
+			}
+			buf := &bytes.Buffer{}
+			if err := json.Compact(buf, record); err != nil {
+				return errors.Wrapf(err, "record %d", line)
+			}
+			fn(line, buf.Bytes(), nil)
+		}
+		_, err := decoder.Token()
+		return err
+	}
+
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		record := bytes.TrimSpace(data)
+		if len(record) > 0 {
+			if json.Valid(record) {
+				fn(line, record, nil)
+			} else {
+				fn(line, nil, errors.New("invalid json"))
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+func peekNonSpace(reader *bufio.Reader) (byte, error) {
+	for {
+		c, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			return c, reader.UnreadByte()
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package receiver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+func gzipString(t *testing.T, s string) string {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	_, err := w.Write([]byte(s))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+	return buf.String()
+}
+
+func TestHttpReceiverIngest(t *testing.T) {
+	logger := zerolog.Nop()
+	h, err := NewHttpReceiver(&config.HttpReceiver{}, metrics.Nop(), &logger)
+	assert.Nil(t, err)
+	h.SetTags([]config.CollectedLog{{Tag: "nginx:"}, {Tag: "api"}})
+
+	tests := []struct {
+		name     string
+		path     string
+		encoding string
+		body     string
+		status   int
+		resp     ingestResponse
+		msgs     []string
+	}{
+		{
+			name:   "ndjson",
+			path:   "/ingest/nginx",
+			body:   "{\"a\":1}\n\nnot json\n[1]\n{\"b\":2}",
+			status: http.StatusOK,
+			resp: ingestResponse{Accepted: 2, Rejected: 2, Errors: []ingestLineError{
+				{Line: 3, Error: "invalid json"},
+				{Line: 4, Error: "record should be a json object"},
+			}},
+			msgs: []string{"web1\tnginx:\t{\"a\":1}", "web1\tnginx:\t{\"b\":2}"},
+		},
+		{
+			name:     "gzip array",
+			path:     "/ingest/api",
+			encoding: "gzip",
+			body:     gzipString(t, "[\n {\"a\": 1},\n {\"b\": [2, 3]}\n]"),
+			status:   http.StatusOK,
+			resp:     ingestResponse{Accepted: 2},
+			msgs:     []string{"web1\tapi\t{\"a\":1}", "web1\tapi\t{\"b\":[2,3]}"},
+		},
+		{
+			name:   "broken array",
+			path:   "/ingest/nginx:",
+			body:   `[{"a":1}, {"b"`,
+			status: http.StatusBadRequest,
+			resp:   ingestResponse{Accepted: 1, Error: "record 2: unexpected EOF"},
+			msgs:   []string{"web1\tnginx:\t{\"a\":1}"},
+		},
+		{
+			name:     "gzip bomb",
+			path:     "/ingest/nginx",
+			encoding: "gzip",
+			body:     gzipString(t, strings.Repeat("\n", ingestMaxBodySize+1)),
+			status:   http.StatusRequestEntityTooLarge,
+			resp:     ingestResponse{Error: errBodyTooLarge.Error()},
+		},
+		{
+			name:   "unknown tag",
+			path:   "/ingest/unknown",
+			body:   `{"a":1}`,
+			status: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			r.Header.Set(headerHostname, "web1")
+			r.Header.Set("Content-Encoding", tt.encoding)
+			w := httptest.NewRecorder()
+			h.handleIngest(w, r)
+			assert.Equal(t, tt.status, w.Code)
+
+			if tt.status != http.StatusNotFound {
+				var resp ingestResponse
+				assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+				assert.Equal(t, tt.resp, resp)
+			}
+			for _, msg := range tt.msgs {
+				assert.Equal(t, msg, receiveMsg(t, h.MsgChan()))
+			}
+			assert.Len(t, h.MsgChan(), 0)
+		})
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	for _, tt := range []struct {
+		size int
+		err  error
+	}{
+		{10, nil},
+		{ingestMaxBodySize, nil},
+		{ingestMaxBodySize + 1, errBodyTooLarge},
+	} {
+		n, err := io.Copy(ioutil.Discard, limitBody(strings.NewReader(strings.Repeat("x", tt.size))))
+		assert.Equal(t, tt.err, err)
+		if tt.err == nil {
+			assert.Equal(t, int64(tt.size), n)
+		}
+	}
+}
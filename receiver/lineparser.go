@@ -0,0 +1,195 @@
+package receiver
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/utils"
+)
+
+const (
+	headerLogFormat    = "X-Log-Format"
+	uploadPath         = "/upload/"
+	defaultLineParser  = "puppet"
+	continuationNone   = "none"
+	datetimeGroup      = "datetime"
+	messageGroup       = "message"
+	maxDatetimeLayouts = 16
+)
+
+// puppetParser is the built-in parser of lines like
+// 2020-04-24 18:14:42 +0300 Puppet (info): Applying configuration version '1587741267'
+var puppetParser = config.LineParser{
+	Name:            defaultLineParser,
+	Tag:             "puppet:",
+	Pattern:         `^(?P<datetime>\S+ \S+ \S+) (?P<user>\S+) \((?P<severity>\S*)\): (?P<message>.*)$`,
+	DatetimeLayouts: []string{"2006-01-02 15:04:05 -0700", "2006-01-02 15:04:05 0700"},
+}
+
+type logEntry map[string]interface{}
+
+// lineParser converts lines of uploaded logs into json log entries
+type lineParser struct {
+	name                 string
+	tag                  string
+	pattern              *regexp.Regexp
+	datetimeIdx          int
+	datetimeTransformers []*utils.DatetimeTransformer
+	fields               map[string]int // output field to pattern group index
+	messageField         string         // continuation lines are appended to this field
+
+	multiline    bool
+	continuation *regexp.Regexp // nil means every line which doesn't start a new entry
+}
+
+func newLineParser(cfg config.LineParser) (*lineParser, error) {
+	if cfg.Name == "" {
+		return nil, errors.New("parser name should be set")
+	}
+	if cfg.Tag == "" {
+		return nil, errors.New("parser tag should be set")
+	}
+	pattern, err := regexp.Compile(cfg.Pattern)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid pattern")
+	}
+	groups := make(map[string]int)
+	for i, name := range pattern.SubexpNames() {
+		if name != "" {
+			groups[name] = i
+		}
+	}
+	datetimeIdx, found := groups[datetimeGroup]
+	if !found {
+		return nil, fmt.Errorf("pattern should have %s group", datetimeGroup)
+	}
+	if len(cfg.DatetimeLayouts) == 0 || len(cfg.DatetimeLayouts) > maxDatetimeLayouts {
+		return nil, fmt.Errorf("from 1 to %d datetime layouts should be set", maxDatetimeLayouts)
+	}
+	transformers := make([]*utils.DatetimeTransformer, 0, len(cfg.DatetimeLayouts))
+	for _, layout := range cfg.DatetimeLayouts {
+		transformers = append(transformers, &utils.DatetimeTransformer{
+			FormatSrc: layout,
+			FormatDst: time.RFC3339,
+			Location:  time.Local,
+		})
+	}
+
+	p := &lineParser{
+		name:                 cfg.Name,
+		tag:                  cfg.Tag,
+		pattern:              pattern,
+		datetimeIdx:          datetimeIdx,
+		datetimeTransformers: transformers,
+		fields:               make(map[string]int),
+		multiline:            cfg.Continuation != continuationNone,
+	}
+
+	fields := cfg.Fields
+	if len(fields) == 0 {
+		fields = make(map[string]string, len(groups))
+		for name := range groups {
+			if name != datetimeGroup {
+				fields[name] = name
+			}
+		}
+	}
+	for field, group := range fields {
+		idx, found := groups[group]
+		if !found {
+			return nil, fmt.Errorf("field %s refers to unknown group %s", field, group)
+		}
+		p.fields[field] = idx
+		if group == messageGroup {
+			p.messageField = field
+		}
+	}
+	if p.multiline && p.messageField == "" {
+		return nil, fmt.Errorf("multiline parser should have %s field", messageGroup)
+	}
+
+	if p.multiline && cfg.Continuation != "" {
+		if p.continuation, err = regexp.Compile(cfg.Continuation); err != nil {
+			return nil, errors.Wrap(err, "invalid continuation")
+		}
+	}
+	return p, nil
+}
+
+// newLineParsers returns built-in parsers overridden and extended by configured ones
+func newLineParsers(cfg *config.HttpReceiver) (map[string]*lineParser, string, error) {
+	parsers := make(map[string]*lineParser)
+	for _, parserCfg := range append([]config.LineParser{puppetParser}, cfg.Parsers...) {
+		p, err := newLineParser(parserCfg)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "parser %s", parserCfg.Name)
+		}
+		parsers[p.name] = p
+	}
+
+	defaultParser := defaultLineParser
+	if cfg.DefaultParser != "" {
+		defaultParser = cfg.DefaultParser
+	}
+	if _, found := parsers[defaultParser]; !found {
+		return nil, "", fmt.Errorf("unknown default parser: %s", defaultParser)
+	}
+	return parsers, defaultParser, nil
+}
+
+// ValidateLineParsers checks http receiver parsers config
+func ValidateLineParsers(cfg *config.HttpReceiver) error {
+	_, _, err := newLineParsers(cfg)
+	return err
+}
+
+// parse returns nil entry if the line doesn't start a new entry
+func (p *lineParser) parse(line string) (logEntry, error) {
+	match := p.pattern.FindStringSubmatch(line)
+	if match == nil {
+		return nil, errors.New("wrong line structure")
+	}
+	parsed, transformer, err := utils.TryDatetimeFormats(match[p.datetimeIdx], p.datetimeTransformers)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := make(logEntry, len(p.fields)+2)
+	entry["event_datetime"] = parsed.Format(transformer.FormatDst)
+	entry["event_date"] = parsed.Format(dateFormat)
+	for field, idx := range p.fields {
+		entry[field] = match[idx]
+	}
+	return entry, nil
+}
+
+// appendLine appends the line to the entry if it's a continuation of multiline message
+func (p *lineParser) appendLine(entry logEntry, line string) bool {
+	if !p.multiline || p.continuation != nil && !p.continuation.MatchString(line) {
+		return false
+	}
+	entry[p.messageField] = entry[p.messageField].(string) + "\n" + line
+	return true
+}
+
+// requestParser selects parser by /upload/{name} path or X-Log-Format header
+func (h *HttpReceiver) requestParser(r *http.Request) (*lineParser, error) {
+	name := r.Header.Get(headerLogFormat)
+	if strings.HasPrefix(r.URL.Path, uploadPath) {
+		name = strings.TrimPrefix(r.URL.Path, uploadPath)
+	}
+	if name == "" {
+		name = h.defaultParser
+	}
+	parser, found := h.parsers[name]
+	if !found {
+		return nil, fmt.Errorf("unknown log format: %s", name)
+	}
+	return parser, nil
+}
@@ -0,0 +1,138 @@
+package receiver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+var ansibleParser = config.LineParser{
+	Name:            "ansible",
+	Tag:             "ansible:",
+	Pattern:         `^(?P<datetime>\S+ \S+,\d+) p=\d+ u=(?P<user>\S+) n=\S+ \| (?P<message>.*)$`,
+	DatetimeLayouts: []string{"2006-01-02 15:04:05,000"},
+	Continuation:    `^\s`,
+	Fields:          map[string]string{"user": "user", "text": "message"},
+}
+
+func TestHttpReceiverParsers(t *testing.T) {
+	defer func(local *time.Location) { time.Local = local }(time.Local)
+	time.Local = time.UTC
+	logger := zerolog.Nop()
+	h, err := NewHttpReceiver(&config.HttpReceiver{Parsers: []config.LineParser{ansibleParser}}, metrics.Nop(), &logger)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name   string
+		path   string
+		format string
+		body   string
+		status int
+		msgs   []string
+	}{
+		{
+			name: "puppet by default",
+			path: "/",
+			body: "2020-04-24 18:14:42 +0300 Puppet (info): Applying\nconfiguration\n" +
+				"garbage\n" +
+				"2020-04-24 18:14:43 +0300 Puppet (err): \n",
+			status: http.StatusNoContent,
+			msgs: []string{
+				`web1	puppet:	{"event_date":"2020-04-24","event_datetime":"2020-04-24T15:14:42Z","hostname":"web1",` +
+					`"message":"Applying\nconfiguration\ngarbage","request_id":"setup","row_number":0,"severity":"info","user":"Puppet"}`,
+				`web1	puppet:	{"event_date":"2020-04-24","event_datetime":"2020-04-24T15:14:43Z","hostname":"web1",` +
+					`"message":"","request_id":"setup","row_number":1,"severity":"err","user":"Puppet"}`,
+			},
+		},
+		{
+			name:   "header",
+			path:   "/",
+			format: "ansible",
+			body: "2020-04-24 18:14:42,123 p=1 u=deploy n=ansible | TASK [nginx]\n" +
+				"  changed: [web1]\n" +
+				"not a continuation\n",
+			status: http.StatusNoContent,
+			msgs: []string{
+				`web1	ansible:	{"event_date":"2020-04-24","event_datetime":"2020-04-24T18:14:42Z","hostname":"web1",` +
+					`"request_id":"setup","row_number":0,"text":"TASK [nginx]\n  changed: [web1]","user":"deploy"}`,
+			},
+		},
+		{
+			name:   "path",
+			path:   "/upload/ansible",
+			format: "puppet",
+			body:   "2020-04-24 18:14:42,123 p=1 u=deploy n=ansible | PLAY RECAP",
+			status: http.StatusNoContent,
+			msgs: []string{
+				`web1	ansible:	{"event_date":"2020-04-24","event_datetime":"2020-04-24T18:14:42Z","hostname":"web1",` +
+					`"request_id":"setup","row_number":0,"text":"PLAY RECAP","user":"deploy"}`,
+			},
+		},
+		{
+			name:   "unknown format",
+			path:   "/upload/chef",
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "text/plain")
+			r.Header.Set(headerHostname, "web1")
+			r.Header.Set(headerSetupID, "setup")
+			r.Header.Set(headerLogFormat, tt.format)
+			w := httptest.NewRecorder()
+			h.handle(w, r)
+			assert.Equal(t, tt.status, w.Code)
+			for _, msg := range tt.msgs {
+				assert.Equal(t, msg, receiveMsg(t, h.MsgChan()))
+			}
+			assert.Len(t, h.MsgChan(), 0)
+		})
+	}
+}
+
+func TestValidateLineParsers(t *testing.T) {
+	noContinuation := ansibleParser
+	noContinuation.Name = "no-continuation"
+	noContinuation.Continuation = continuationNone
+	noContinuation.Fields = map[string]string{"user": "user"}
+
+	noDatetime := ansibleParser
+	noDatetime.Pattern = `^(?P<message>.*)$`
+
+	unknownGroup := ansibleParser
+	unknownGroup.Fields = map[string]string{"user": "login"}
+
+	noMessage := ansibleParser
+	noMessage.Fields = map[string]string{"user": "user"}
+
+	tests := []struct {
+		name string
+		cfg  config.HttpReceiver
+		err  bool
+	}{
+		{"built-in", config.HttpReceiver{}, false},
+		{"custom default", config.HttpReceiver{Parsers: []config.LineParser{ansibleParser}, DefaultParser: "ansible"}, false},
+		{"no continuation", config.HttpReceiver{Parsers: []config.LineParser{noContinuation}}, false},
+		{"unknown default", config.HttpReceiver{DefaultParser: "ansible"}, true},
+		{"no datetime", config.HttpReceiver{Parsers: []config.LineParser{noDatetime}}, true},
+		{"unknown group", config.HttpReceiver{Parsers: []config.LineParser{unknownGroup}}, true},
+		{"multiline without message", config.HttpReceiver{Parsers: []config.LineParser{noMessage}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateLineParsers(&tt.cfg)
+			assert.Equal(t, tt.err, err != nil, "%v", err)
+		})
+	}
+}
@@ -0,0 +1,440 @@
+package receiver
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/klauspost/compress/snappy"
+	"github.com/pkg/errors"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+const (
+	lokiPushPath             = "/loki/api/v1/push"
+	defaultLokiHostnameLabel = "host"
+	defaultLokiTagLabel      = "job"
+)
+
+type lokiEntry struct {
+	timestamp time.Time
+	line      string
+	metadata  map[string]string // structured metadata, overrides stream labels
+}
+
+type lokiStream struct {
+	labels  map[string]string
+	entries []lokiEntry
+}
+
+// lokiSettings applies defaults to loki push config
+func lokiSettings(cfg config.LokiPush) config.LokiPush {
+	if cfg.HostnameLabel == "" {
+		cfg.HostnameLabel = defaultLokiHostnameLabel
+	}
+	if cfg.TagLabel == "" {
+		cfg.TagLabel = defaultLokiTagLabel
+	}
+	return cfg
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// handleLokiPush implements Loki push API, so Promtail and Grafana Agent can send logs to the collector.
+// Stream tag label selects collected log, labels from fields config are added to json lines
+func (h *HttpReceiver) handleLokiPush(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	streams, err := readLokiPush(r, limitBody(r.Body))
+	if err != nil {
+		h.metrics.Increment("loki.body_error")
+		w.WriteHeader(bodyErrorStatus(err))
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
+	source, err := h.pushSource(r)
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
+	cfg := h.loki
+	unknownTags := make(map[string]bool)
+	forbidden := make(map[string]bool)
+	for _, stream := range streams {
+		tag, found := h.resolveTag(stream.labels[cfg.TagLabel])
+		if !found {
+			unknownTags[stream.labels[cfg.TagLabel]] = true
+			h.metrics.Count("loki.rejected", len(stream.entries))
+			continue
+		}
+
+		hostname, permitted := source.resolve(stream.labels[cfg.HostnameLabel], tag)
+		if !permitted {
+			forbidden[fmt.Sprintf("%s logs of %s", tag, hostname)] = true
+			h.metrics.Count("loki.rejected", len(stream.entries))
+			continue
+		}
+
+		for _, entry := range stream.entries {
+			h.msgChan <- formatMessage(hostname, tag, h.lokiLine(entry, stream.labels))
+		}
+		h.metrics.Count("loki.accepted", len(stream.entries), metrics.Tag(tag))
+	}
+
+	if len(forbidden) > 0 {
+		streams := make([]string, 0, len(forbidden))
+		for stream := range forbidden {
+			streams = append(streams, stream)
+		}
+		sort.Strings(streams)
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("Key is not allowed to write " + strings.Join(streams, ", ")))
+		return
+	}
+	if len(unknownTags) > 0 {
+		tags := make([]string, 0, len(unknownTags))
+		for tag := range unknownTags {
+			tags = append(tags, strconv.Quote(tag))
+		}
+		sort.Strings(tags)
+		// 4xx isn't retried, so accepted streams aren't duplicated
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(fmt.Sprintf("Unknown %s label values: %s", cfg.TagLabel, strings.Join(tags, ", "))))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lokiLine adds configured label columns and missing event_datetime to json lines, other lines are sent as is
+func (h *HttpReceiver) lokiLine(entry lokiEntry, labels map[string]string) []byte {
+	line := []byte(entry.line)
+	if len(line) == 0 || line[0] != '{' {
+		return line
+	}
+	for _, field := range h.lokiFields {
+		label := h.loki.Fields[field]
+		value, found := entry.metadata[label]
+		if !found {
+			value, found = labels[label]
+		}
+		if !found {
+			continue
+		}
+		quoted, _ := json.Marshal(value)
+		if updated, err := jsonparser.Set(line, quoted, field); err == nil {
+			line = updated
+		}
+	}
+	if _, _, _, err := jsonparser.Get(line, "event_datetime"); err == jsonparser.KeyPathNotFoundError {
+		datetime := []byte(`"` + entry.timestamp.Format(eventDatetimeLayout) + `"`)
+		if updated, err := jsonparser.Set(line, datetime, "event_datetime"); err == nil {
+			line = updated
+		}
+	}
+	return line
+}
+
+// readLokiPush decodes json or snappy compressed protobuf push request
+func readLokiPush(r *http.Request, body io.Reader) ([]lokiStream, error) {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType == "application/json" {
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(body)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid gzip body")
+			}
+			defer gz.Close()
+			body = limitBody(gz)
+		}
+		return parseLokiJSON(body)
+	}
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	decodedLen, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid snappy body")
+	}
+	if decodedLen > ingestMaxBodySize {
+		return nil, errBodyTooLarge
+	}
+	decoded, err := snappy.Decode(nil, data)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid snappy body")
+	}
+	return parseLokiProto(decoded)
+}
+
+func parseLokiJSON(body io.Reader) ([]lokiStream, error) {
+	var req struct {
+		Streams []struct {
+			Stream map[string]string   `json:"stream"`
+			Values [][]json.RawMessage `json:"values"`
+		} `json:"streams"`
+	}
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		return nil, errors.Wrap(err, "invalid json")
+	}
+
+	streams := make([]lokiStream, 0, len(req.Streams))
+	for _, s := range req.Streams {
+		stream := lokiStream{labels: s.Stream, entries: make([]lokiEntry, 0, len(s.Values))}
+		for _, value := range s.Values {
+			if len(value) < 2 || len(value) > 3 {
+				return nil, errors.New("value should be [timestamp, line] or [timestamp, line, metadata]")
+			}
+			var ts, line string
+			var entry lokiEntry
+			if err := json.Unmarshal(value[0], &ts); err != nil {
+				return nil, errors.Wrap(err, "invalid timestamp")
+			}
+			nsec, err := strconv.ParseInt(ts, 10, 64)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid timestamp")
+			}
+			if err := json.Unmarshal(value[1], &line); err != nil {
+				return nil, errors.Wrap(err, "invalid line")
+			}
+			if len(value) == 3 {
+				if err := json.Unmarshal(value[2], &entry.metadata); err != nil {
+					return nil, errors.Wrap(err, "invalid structured metadata")
+				}
+			}
+			entry.timestamp = time.Unix(0, nsec)
+			entry.line = line
+			stream.entries = append(stream.entries, entry)
+		}
+		streams = append(streams, stream)
+	}
+	return streams, nil
+}
+
+// parseLokiProto decodes logproto.PushRequest
+func parseLokiProto(data []byte) ([]lokiStream, error) {
+	var streams []lokiStream
+	p := &protoReader{buf: data}
+	for {
+		field, wireType, err := p.next()
+		if err == io.EOF {
+			return streams, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if field != 1 || wireType != protoBytes {
+			if err := p.skip(wireType); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		b, err := p.bytes()
+		if err != nil {
+			return nil, err
+		}
+		stream, err := parseLokiProtoStream(b)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid stream")
+		}
+		streams = append(streams, stream)
+	}
+}
+
+// parseLokiProtoStream decodes StreamAdapter{labels = 1, entries = 2}
+func parseLokiProtoStream(data []byte) (lokiStream, error) {
+	var stream lokiStream
+	p := &protoReader{buf: data}
+	for {
+		field, wireType, err := p.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return stream, err
+		}
+		if (field != 1 && field != 2) || wireType != protoBytes {
+			if err := p.skip(wireType); err != nil {
+				return stream, err
+			}
+			continue
+		}
+		b, err := p.bytes()
+		if err != nil {
+			return stream, err
+		}
+		if field == 1 {
+			if stream.labels, err = parseLokiLabels(string(b)); err != nil {
+				return stream, err
+			}
+			continue
+		}
+		entry, err := parseLokiProtoEntry(b)
+		if err != nil {
+			return stream, errors.Wrap(err, "invalid entry")
+		}
+		stream.entries = append(stream.entries, entry)
+	}
+	if stream.labels == nil {
+		return stream, errors.New("labels are missing")
+	}
+	return stream, nil
+}
+
+// parseLokiProtoEntry decodes EntryAdapter{timestamp = 1, line = 2, structuredMetadata = 3}
+func parseLokiProtoEntry(data []byte) (lokiEntry, error) {
+	var entry lokiEntry
+	var sec, nsec int64
+	p := &protoReader{buf: data}
+	for {
+		field, wireType, err := p.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return entry, err
+		}
+		if field < 1 || field > 3 || wireType != protoBytes {
+			if err := p.skip(wireType); err != nil {
+				return entry, err
+			}
+			continue
+		}
+		b, err := p.bytes()
+		if err != nil {
+			return entry, err
+		}
+		switch field {
+		case 1:
+			values, err := parseProtoVarints(b)
+			if err != nil {
+				return entry, errors.Wrap(err, "invalid timestamp")
+			}
+			sec, nsec = int64(values[1]), int64(values[2])
+		case 2:
+			entry.line = string(b)
+		case 3:
+			pair, err := parseProtoStrings(b)
+			if err != nil {
+				return entry, errors.Wrap(err, "invalid structured metadata")
+			}
+			if entry.metadata == nil {
+				entry.metadata = make(map[string]string)
+			}
+			entry.metadata[pair[1]] = pair[2]
+		}
+	}
+	entry.timestamp = time.Unix(sec, nsec)
+	return entry, nil
+}
+
+// parseProtoVarints decodes message of varint fields 1 and 2, e.g. google.protobuf.Timestamp
+func parseProtoVarints(data []byte) ([3]uint64, error) {
+	var values [3]uint64
+	p := &protoReader{buf: data}
+	for {
+		field, wireType, err := p.next()
+		if err == io.EOF {
+			return values, nil
+		} else if err != nil {
+			return values, err
+		}
+		if field < 1 || field > 2 || wireType != protoVarint {
+			if err := p.skip(wireType); err != nil {
+				return values, err
+			}
+			continue
+		}
+		if values[field], err = p.varint(); err != nil {
+			return values, err
+		}
+	}
+}
+
+// parseProtoStrings decodes message of string fields 1 and 2, e.g. LabelPairAdapter
+func parseProtoStrings(data []byte) ([3]string, error) {
+	var values [3]string
+	p := &protoReader{buf: data}
+	for {
+		field, wireType, err := p.next()
+		if err == io.EOF {
+			return values, nil
+		} else if err != nil {
+			return values, err
+		}
+		if field < 1 || field > 2 || wireType != protoBytes {
+			if err := p.skip(wireType); err != nil {
+				return values, err
+			}
+			continue
+		}
+		b, err := p.bytes()
+		if err != nil {
+			return values, err
+		}
+		values[field] = string(b)
+	}
+}
+
+// parseLokiLabels parses stream selector like {job="nginx", host="web1"}
+func parseLokiLabels(s string) (map[string]string, error) {
+	s = strings.TrimSpace(s)
+	if len(s) < 2 || s[0] != '{' || s[len(s)-1] != '}' {
+		return nil, fmt.Errorf("invalid labels %q", s)
+	}
+	labels := make(map[string]string)
+	rest := strings.TrimSpace(s[1 : len(s)-1])
+	for rest != "" {
+		eq := strings.IndexByte(rest, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("invalid labels %q", s)
+		}
+		name := strings.TrimSpace(rest[:eq])
+		rest = strings.TrimSpace(rest[eq+1:])
+
+		end := 1
+		for ; end < len(rest) && rest[end] != '"'; end++ {
+			if rest[end] == '\\' {
+				end++
+			}
+		}
+		if rest == "" || rest[0] != '"' || end >= len(rest) {
+			return nil, fmt.Errorf("invalid labels %q", s)
+		}
+		value, err := strconv.Unquote(rest[:end+1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid labels %q", s)
+		}
+		labels[name] = value
+
+		rest = strings.TrimSpace(rest[end+1:])
+		if strings.HasPrefix(rest, ",") {
+			rest = strings.TrimSpace(rest[1:])
+		} else if rest != "" {
+			return nil, fmt.Errorf("invalid labels %q", s)
+		}
+	}
+	return labels, nil
+}
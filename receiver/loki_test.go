@@ -0,0 +1,121 @@
+package receiver
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+func TestLokiPush(t *testing.T) {
+	defer func(local *time.Location) { time.Local = local }(time.Local)
+	time.Local = time.UTC
+	logger := zerolog.Nop()
+	h, err := NewHttpReceiver(&config.HttpReceiver{Loki: config.LokiPush{
+		Enabled: true,
+		Fields:  map[string]string{"namespace": "namespace", "pod": "pod"},
+	}}, metrics.Nop(), &logger)
+	assert.Nil(t, err)
+	h.SetTags([]config.CollectedLog{{Tag: "nginx:"}, {Tag: "nginx_error:"}})
+
+	var entry []byte
+	entry = appendProtoBytes(entry, 1, appendProtoVarint(appendProtoVarint(nil, 1, 1587741282), 2, 5))
+	entry = appendProtoBytes(entry, 2, []byte(`{"status":200}`))
+	entry = appendProtoBytes(entry, 3, appendProtoBytes(appendProtoBytes(nil, 1, []byte("pod")), 2, []byte("nginx-1")))
+	var stream []byte
+	stream = appendProtoBytes(stream, 1, []byte(`{job="nginx", host="web1", namespace="web\"prod"}`))
+	stream = appendProtoBytes(stream, 2, entry)
+	stream = appendProtoVarint(stream, 3, 12345) // hash
+	protoBody := snappy.Encode(nil, appendProtoBytes(nil, 1, stream))
+
+	jsonBody := `{"streams":[
+		{"stream":{"job":"nginx_error","namespace":"web"},"values":[
+			["1587741282000000005","2020/04/24 18:14:42 [error] 1#1: open() failed",{"pod":"nginx-1"}]
+		]},
+		{"stream":{"job":"php"},"values":[["1587741282000000005","{}"]]},
+		{"stream":{"job":"nginx","host":"web2"},"values":[["1587741282000000005","{\"event_datetime\":\"2020-04-24T18:14:42+03:00\"}"]]}
+	]}`
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		status      int
+		msgs        []string
+	}{
+		{
+			name:        "protobuf",
+			contentType: "application/x-protobuf",
+			body:        protoBody,
+			status:      http.StatusNoContent,
+			msgs: []string{
+				`web1	nginx:	{"status":200,"namespace":"web\"prod","pod":"nginx-1","event_datetime":"2020-04-24T15:14:42.000000005Z"}`,
+			},
+		},
+		{
+			name:        "json",
+			contentType: "application/json",
+			body:        []byte(jsonBody),
+			status:      http.StatusBadRequest,
+			msgs: []string{
+				"web0\tnginx_error:\t2020/04/24 18:14:42 [error] 1#1: open() failed",
+				`web2	nginx:	{"event_datetime":"2020-04-24T18:14:42+03:00"}`,
+			},
+		},
+		{
+			name:        "invalid snappy",
+			contentType: "application/x-protobuf",
+			body:        []byte("{}"),
+			status:      http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, lokiPushPath, bytes.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			r.Header.Set(headerHostname, "web0")
+			w := httptest.NewRecorder()
+			h.handleLokiPush(w, r)
+			assert.Equal(t, tt.status, w.Code, w.Body.String())
+			for _, msg := range tt.msgs {
+				assert.Equal(t, msg, receiveMsg(t, h.MsgChan()))
+			}
+			assert.Len(t, h.MsgChan(), 0)
+		})
+	}
+}
+
+func TestParseLokiLabels(t *testing.T) {
+	tests := []struct {
+		labels   string
+		expected map[string]string
+	}{
+		{`{}`, map[string]string{}},
+		{`{job="nginx"}`, map[string]string{"job": "nginx"}},
+		{` { job = "nginx" ,host="web1", path="C:\\logs \"x\""} `, map[string]string{"job": "nginx", "host": "web1", "path": `C:\logs "x"`}},
+		{`{job="nginx",}`, map[string]string{"job": "nginx"}},
+		{`job="nginx"`, nil},
+		{`{job=nginx}`, nil},
+		{`{job="nginx}`, nil},
+		{`{job="nginx" host="web1"}`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.labels, func(t *testing.T) {
+			labels, err := parseLokiLabels(tt.labels)
+			assert.Equal(t, tt.expected == nil, err != nil, "%v", err)
+			assert.Equal(t, tt.expected, labels)
+		})
+	}
+	_, err := parseLokiLabels(strings.Repeat("{", 10))
+	assert.Error(t, err)
+}
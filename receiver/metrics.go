@@ -0,0 +1,32 @@
+package receiver
+
+import (
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"nginx-log-collector/metrics"
+)
+
+// receiverMetrics returns metrics of the named receiver: statsd prefix is receiver.<name>,
+// prometheus metrics are labeled with receiver name
+func receiverMetrics(m metrics.Metrics, name string) metrics.Metrics {
+	return m.Clone("receiver", metrics.Label{Name: "receiver", Value: name})
+}
+
+// monitorQueue periodically reports length of the receiver queue until done is closed
+func monitorQueue(done <-chan struct{}, msgChan chan []byte, m metrics.Metrics, logger *zerolog.Logger) {
+	ticker := time.NewTicker(queueCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			logger.Debug().Int("msg_chan_len", len(msgChan)).Msg("queue stats")
+			m.Gauge("msg_chan_len", len(msgChan))
+		case <-done:
+			logger.Debug().Msg("queueMonitoring exit")
+			return
+		}
+	}
+}
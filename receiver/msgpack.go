@@ -0,0 +1,285 @@
+package receiver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+const msgpackMaxDepth = 32
+
+var errMsgpackTooLarge = errors.New("msgpack message is too large")
+
+// msgpackExt is an extension value, e.g. fluentd EventTime
+type msgpackExt struct {
+	Type int8
+	Data []byte
+}
+
+// msgpackDecoder decodes msgpack values into nil, bool, int64, uint64, float64, string,
+// []byte, []interface{}, map[string]interface{} and msgpackExt.
+// Every value read is charged to the budget, so the peer can't make it allocate more
+type msgpackDecoder struct {
+	r      *bufio.Reader
+	budget int
+}
+
+func newMsgpackDecoder(r *bufio.Reader, budget int) *msgpackDecoder {
+	return &msgpackDecoder{r: r, budget: budget}
+}
+
+func (d *msgpackDecoder) charge(n uint64) error {
+	if n > uint64(d.budget) {
+		return errMsgpackTooLarge
+	}
+	d.budget -= int(n)
+	return nil
+}
+
+func (d *msgpackDecoder) readByte() (byte, error) {
+	if err := d.charge(1); err != nil {
+		return 0, err
+	}
+	return d.r.ReadByte()
+}
+
+func (d *msgpackDecoder) readN(n uint64) ([]byte, error) {
+	if err := d.charge(n); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(d.r, buf); err != nil {
+		return nil, noEOF(err)
+	}
+	return buf, nil
+}
+
+func (d *msgpackDecoder) readUint(size int) (uint64, error) {
+	buf, err := d.readN(uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(buf[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(buf)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(buf)), nil
+	default:
+		return binary.BigEndian.Uint64(buf), nil
+	}
+}
+
+// noEOF reports value cut in the middle as an error unlike EOF between values
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// peek returns the format byte of the next value without consuming it
+func (d *msgpackDecoder) peek() (byte, error) {
+	b, err := d.r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// readArrayLen reads array header, io.EOF means there are no more values
+func (d *msgpackDecoder) readArrayLen() (int, error) {
+	c, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+	n, ok, err := d.containerLen(c, 0x90, 0xdc)
+	if err != nil {
+		return 0, noEOF(err)
+	}
+	if !ok {
+		return 0, fmt.Errorf("msgpack array expected, got 0x%02x", c)
+	}
+	return n, nil
+}
+
+// containerLen decodes length of fix, 16 and 32 bit array (0x90, 0xdc) or map (0x80, 0xde) headers
+func (d *msgpackDecoder) containerLen(c, fix, c16 byte) (int, bool, error) {
+	var n uint64
+	var err error
+	switch {
+	case c&0xf0 == fix:
+		n = uint64(c & 0x0f)
+	case c == c16:
+		n, err = d.readUint(2)
+	case c == c16+1:
+		n, err = d.readUint(4)
+	default:
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, true, err
+	}
+	// every element takes at least a byte
+	if n > uint64(d.budget) {
+		return 0, true, errMsgpackTooLarge
+	}
+	return int(n), true, nil
+}
+
+func (d *msgpackDecoder) readValue() (interface{}, error) {
+	v, err := d.readValueDepth(0)
+	return v, noEOF(err)
+}
+
+func (d *msgpackDecoder) readValueDepth(depth int) (interface{}, error) {
+	if depth > msgpackMaxDepth {
+		return nil, errors.New("msgpack value is nested too deep")
+	}
+	c, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xe0 == 0xa0:
+		return d.readString(uint64(c & 0x1f))
+	}
+	if n, ok, err := d.containerLen(c, 0x90, 0xdc); ok {
+		if err != nil {
+			return nil, err
+		}
+		return d.readArray(n, depth)
+	}
+	if n, ok, err := d.containerLen(c, 0x80, 0xde); ok {
+		if err != nil {
+			return nil, err
+		}
+		return d.readMap(n, depth)
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6: // bin 8, 16, 32
+		n, err := d.readUint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return d.readN(n)
+	case 0xd9, 0xda, 0xdb: // str 8, 16, 32
+		n, err := d.readUint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.readString(n)
+	case 0xca:
+		n, err := d.readUint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := d.readUint(8)
+		return math.Float64frombits(n), err
+	case 0xcc, 0xcd, 0xce, 0xcf: // uint 8, 16, 32, 64
+		return d.readUint(1 << (c - 0xcc))
+	case 0xd0:
+		n, err := d.readUint(1)
+		return int64(int8(n)), err
+	case 0xd1:
+		n, err := d.readUint(2)
+		return int64(int16(n)), err
+	case 0xd2:
+		n, err := d.readUint(4)
+		return int64(int32(n)), err
+	case 0xd3:
+		n, err := d.readUint(8)
+		return int64(n), err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8: // fixext 1, 2, 4, 8, 16
+		return d.readExt(1 << (c - 0xd4))
+	case 0xc7, 0xc8, 0xc9: // ext 8, 16, 32
+		n, err := d.readUint(1 << (c - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.readExt(n)
+	default:
+		return nil, fmt.Errorf("unknown msgpack format 0x%02x", c)
+	}
+}
+
+func (d *msgpackDecoder) readString(n uint64) (string, error) {
+	buf, err := d.readN(n)
+	return string(buf), err
+}
+
+func (d *msgpackDecoder) readExt(n uint64) (msgpackExt, error) {
+	typ, err := d.readByte()
+	if err != nil {
+		return msgpackExt{}, err
+	}
+	data, err := d.readN(n)
+	return msgpackExt{Type: int8(typ), Data: data}, err
+}
+
+func (d *msgpackDecoder) readArray(n, depth int) ([]interface{}, error) {
+	arr := make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		v, err := d.readValueDepth(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, v)
+	}
+	return arr, nil
+}
+
+func (d *msgpackDecoder) readMap(n, depth int) (map[string]interface{}, error) {
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.readValueDepth(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.readValueDepth(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		switch key := k.(type) {
+		case string:
+			m[key] = v
+		case []byte:
+			m[string(key)] = v
+		default:
+			m[fmt.Sprint(key)] = v
+		}
+	}
+	return m, nil
+}
+
+// appendMsgpackString encodes s as msgpack str
+func appendMsgpackString(buf []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n < 32:
+		buf = append(buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		buf = append(buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		buf = append(buf, 0xda, byte(n>>8), byte(n))
+	default:
+		buf = append(buf, 0xdb, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(buf, s...)
+}
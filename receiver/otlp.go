@@ -0,0 +1,626 @@
+package receiver
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+const (
+	otlpLogsPath                 = "/v1/logs"
+	defaultOTLPTagAttribute      = "service.name"
+	defaultOTLPHostnameAttribute = "host.name"
+	otlpMessageField             = "message"
+	otlpMaxDepth                 = 32
+)
+
+type otlpLogRecord struct {
+	timestamp  time.Time
+	severity   string
+	body       interface{}
+	attributes map[string]interface{}
+	traceID    string
+	spanID     string
+}
+
+type otlpResourceLogs struct {
+	attributes map[string]interface{}
+	records    []otlpLogRecord
+}
+
+// otlpSeverityLevels are short names of severity number ranges, 1-4 is TRACE and so on
+var otlpSeverityLevels = []string{"TRACE", "DEBUG", "INFO", "WARN", "ERROR", "FATAL"}
+
+// otlpSeverityText maps severity number to its short name like INFO or INFO2, used when severity text is empty
+func otlpSeverityText(number int64) string {
+	if number < 1 || number > int64(len(otlpSeverityLevels)*4) {
+		return ""
+	}
+	name := otlpSeverityLevels[(number-1)/4]
+	if n := (number-1)%4 + 1; n > 1 {
+		name += strconv.FormatInt(n, 10)
+	}
+	return name
+}
+
+// parseOTLPJSONSeverity decodes severityNumber, enum name like SEVERITY_NUMBER_INFO is accepted as well
+func parseOTLPJSONSeverity(raw json.RawMessage) (int64, error) {
+	s := strings.Trim(string(raw), `"`)
+	if strings.HasPrefix(s, "SEVERITY_NUMBER_") {
+		for i := int64(1); i <= int64(len(otlpSeverityLevels)*4); i++ {
+			if "SEVERITY_NUMBER_"+otlpSeverityText(i) == s {
+				return i, nil
+			}
+		}
+		return 0, nil // SEVERITY_NUMBER_UNSPECIFIED
+	}
+	return parseOTLPJSONInt(raw)
+}
+
+// otlpSettings applies defaults to otlp logs config
+func otlpSettings(cfg config.OTLPLogs) config.OTLPLogs {
+	if cfg.TagAttribute == "" {
+		cfg.TagAttribute = defaultOTLPTagAttribute
+	}
+	if cfg.HostnameAttribute == "" {
+		cfg.HostnameAttribute = defaultOTLPHostnameAttribute
+	}
+	return cfg
+}
+
+// handleOTLPLogs implements OTLP/HTTP logs export. Every log record is sent as json of flattened
+// resource and record attributes, so collected logs of access format apply
+func (h *HttpReceiver) handleOTLPLogs(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	isJSON := contentType == "application/json"
+	if !isJSON && contentType != "application/x-protobuf" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		_, _ = w.Write([]byte("Only application/x-protobuf and application/json are supported"))
+		return
+	}
+
+	resourceLogs, err := readOTLPLogs(limitBody(r.Body), r.Header.Get("Content-Encoding"), isJSON)
+	if err != nil {
+		h.metrics.Increment("otlp.body_error")
+		w.WriteHeader(bodyErrorStatus(err))
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
+	source, err := h.pushSource(r)
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
+	cfg := h.otlp
+	accepted := make(map[string]int)
+	var rejected int64
+	var rejectedTags []string
+	var forbidden int
+	for _, rl := range resourceLogs {
+		for _, record := range rl.records {
+			tagValue, _ := otlpAttribute(cfg.TagAttribute, record.attributes, rl.attributes).(string)
+			tag, found := h.resolveTag(tagValue)
+			if !found {
+				rejected++
+				if len(rejectedTags) < ingestMaxLineErrors {
+					rejectedTags = append(rejectedTags, strconv.Quote(tagValue))
+				}
+				continue
+			}
+
+			recordHostname, _ := otlpAttribute(cfg.HostnameAttribute, record.attributes, rl.attributes).(string)
+			hostname, permitted := source.resolve(recordHostname, tag)
+			if !permitted {
+				rejected++
+				forbidden++
+				continue
+			}
+
+			line, err := json.Marshal(otlpFields(rl.attributes, record))
+			if err != nil {
+				rejected++
+				continue
+			}
+			h.msgChan <- formatMessage(hostname, tag, line)
+			accepted[tag]++
+		}
+	}
+	for tag, cnt := range accepted {
+		h.metrics.Count("otlp.accepted", cnt, metrics.Tag(tag))
+	}
+	if rejected > 0 {
+		h.metrics.Count("otlp.rejected", int(rejected))
+	}
+
+	// rejected records are reported as partial success, they can't be fixed by retrying
+	var messages []string
+	if len(rejectedTags) > 0 {
+		messages = append(messages, fmt.Sprintf("unknown %s attribute values: %s", cfg.TagAttribute, strings.Join(rejectedTags, ", ")))
+	}
+	if forbidden > 0 {
+		messages = append(messages, fmt.Sprintf("%d records are out of key scope", forbidden))
+	}
+	errorMessage := strings.Join(messages, "; ")
+	if isJSON {
+		resp := map[string]interface{}{}
+		if rejected > 0 {
+			resp["partialSuccess"] = map[string]interface{}{
+				"rejectedLogRecords": strconv.FormatInt(rejected, 10),
+				"errorMessage":       errorMessage,
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(resp)
+		return
+	}
+	var resp []byte
+	if rejected > 0 {
+		partial := appendProtoVarint(nil, 1, uint64(rejected))
+		partial = appendProtoBytes(partial, 2, []byte(errorMessage))
+		resp = appendProtoBytes(nil, 1, partial)
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resp)
+}
+
+// otlpAttribute looks up the attribute in log record then in resource attributes
+func otlpAttribute(key string, recordAttributes, resourceAttributes map[string]interface{}) interface{} {
+	if v, found := recordAttributes[key]; found {
+		return v
+	}
+	return resourceAttributes[key]
+}
+
+// otlpFields flattens resource attributes, record attributes and kvlist body into json fields,
+// dots and nesting are replaced by underscores: service.name -> service_name
+func otlpFields(resourceAttributes map[string]interface{}, record otlpLogRecord) map[string]interface{} {
+	fields := make(map[string]interface{}, len(resourceAttributes)+len(record.attributes)+4)
+	flattenOTLP(fields, "", resourceAttributes)
+	flattenOTLP(fields, "", record.attributes)
+	if body, ok := record.body.(map[string]interface{}); ok {
+		flattenOTLP(fields, "", body)
+	} else if record.body != nil {
+		fields[otlpMessageField] = record.body
+	}
+	if record.severity != "" {
+		fields["severity"] = record.severity
+	}
+	if record.traceID != "" {
+		fields["trace_id"] = record.traceID
+	}
+	if record.spanID != "" {
+		fields["span_id"] = record.spanID
+	}
+	if _, found := fields["event_datetime"]; !found && !record.timestamp.IsZero() {
+		fields["event_datetime"] = record.timestamp.Format(eventDatetimeLayout)
+	}
+	return fields
+}
+
+func flattenOTLP(fields map[string]interface{}, prefix string, attributes map[string]interface{}) {
+	for key, value := range attributes {
+		name := prefix + strings.Replace(key, ".", "_", -1)
+		if nested, ok := value.(map[string]interface{}); ok {
+			flattenOTLP(fields, name+"_", nested)
+			continue
+		}
+		fields[name] = value
+	}
+}
+
+func readOTLPLogs(body io.Reader, contentEncoding string, isJSON bool) ([]otlpResourceLogs, error) {
+	switch contentEncoding {
+	case "":
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid gzip body")
+		}
+		defer gz.Close()
+		body = limitBody(gz)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %s", contentEncoding)
+	}
+
+	if isJSON {
+		return parseOTLPJSON(body)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return parseOTLPProto(data)
+}
+
+type otlpJSONKeyValue struct {
+	Key   string           `json:"key"`
+	Value otlpJSONAnyValue `json:"value"`
+}
+
+type otlpJSONAnyValue struct {
+	StringValue *string         `json:"stringValue"`
+	BoolValue   *bool           `json:"boolValue"`
+	IntValue    json.RawMessage `json:"intValue"` // int64 is encoded as string
+	DoubleValue *float64        `json:"doubleValue"`
+	BytesValue  []byte          `json:"bytesValue"`
+	ArrayValue  *struct {
+		Values []otlpJSONAnyValue `json:"values"`
+	} `json:"arrayValue"`
+	KvlistValue *struct {
+		Values []otlpJSONKeyValue `json:"values"`
+	} `json:"kvlistValue"`
+}
+
+func (v *otlpJSONAnyValue) value() (interface{}, error) {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue, nil
+	case v.BoolValue != nil:
+		return *v.BoolValue, nil
+	case v.IntValue != nil:
+		return parseOTLPJSONInt(v.IntValue)
+	case v.DoubleValue != nil:
+		return *v.DoubleValue, nil
+	case v.BytesValue != nil:
+		return v.BytesValue, nil
+	case v.ArrayValue != nil:
+		values := make([]interface{}, 0, len(v.ArrayValue.Values))
+		for i := range v.ArrayValue.Values {
+			item, err := v.ArrayValue.Values[i].value()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, item)
+		}
+		return values, nil
+	case v.KvlistValue != nil:
+		return otlpJSONAttributes(v.KvlistValue.Values)
+	default:
+		return nil, nil
+	}
+}
+
+func otlpJSONAttributes(kvs []otlpJSONKeyValue) (map[string]interface{}, error) {
+	attributes := make(map[string]interface{}, len(kvs))
+	for i := range kvs {
+		v, err := kvs[i].Value.value()
+		if err != nil {
+			return nil, errors.Wrapf(err, "attribute %s", kvs[i].Key)
+		}
+		attributes[kvs[i].Key] = v
+	}
+	return attributes, nil
+}
+
+// parseOTLPJSONInt parses 64 bit integer encoded as string or number
+func parseOTLPJSONInt(raw json.RawMessage) (int64, error) {
+	s := strings.Trim(string(raw), `"`)
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+func parseOTLPJSON(body io.Reader) ([]otlpResourceLogs, error) {
+	var req struct {
+		ResourceLogs []struct {
+			Resource struct {
+				Attributes []otlpJSONKeyValue `json:"attributes"`
+			} `json:"resource"`
+			ScopeLogs []struct {
+				LogRecords []struct {
+					TimeUnixNano         json.RawMessage    `json:"timeUnixNano"`
+					ObservedTimeUnixNano json.RawMessage    `json:"observedTimeUnixNano"`
+					SeverityNumber       json.RawMessage    `json:"severityNumber"`
+					SeverityText         string             `json:"severityText"`
+					Body                 otlpJSONAnyValue   `json:"body"`
+					Attributes           []otlpJSONKeyValue `json:"attributes"`
+					TraceID              string             `json:"traceId"`
+					SpanID               string             `json:"spanId"`
+				} `json:"logRecords"`
+			} `json:"scopeLogs"`
+		} `json:"resourceLogs"`
+	}
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		return nil, errors.Wrap(err, "invalid json")
+	}
+
+	resourceLogs := make([]otlpResourceLogs, 0, len(req.ResourceLogs))
+	for _, rl := range req.ResourceLogs {
+		attributes, err := otlpJSONAttributes(rl.Resource.Attributes)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid resource")
+		}
+		resource := otlpResourceLogs{attributes: attributes}
+		for _, sl := range rl.ScopeLogs {
+			for _, lr := range sl.LogRecords {
+				record := otlpLogRecord{severity: lr.SeverityText, traceID: lr.TraceID, spanID: lr.SpanID}
+				if record.attributes, err = otlpJSONAttributes(lr.Attributes); err != nil {
+					return nil, errors.Wrap(err, "invalid log record")
+				}
+				if record.body, err = lr.Body.value(); err != nil {
+					return nil, errors.Wrap(err, "invalid log record body")
+				}
+				if record.severity == "" {
+					number, err := parseOTLPJSONSeverity(lr.SeverityNumber)
+					if err != nil {
+						return nil, errors.Wrap(err, "invalid log record severity")
+					}
+					record.severity = otlpSeverityText(number)
+				}
+				nsec, err := parseOTLPJSONInt(lr.TimeUnixNano)
+				if err == nil && nsec == 0 {
+					nsec, err = parseOTLPJSONInt(lr.ObservedTimeUnixNano)
+				}
+				if err != nil {
+					return nil, errors.Wrap(err, "invalid log record time")
+				}
+				if nsec != 0 {
+					record.timestamp = time.Unix(0, nsec)
+				}
+				resource.records = append(resource.records, record)
+			}
+		}
+		resourceLogs = append(resourceLogs, resource)
+	}
+	return resourceLogs, nil
+}
+
+// parseOTLPProto decodes ExportLogsServiceRequest{resource_logs = 1}
+func parseOTLPProto(data []byte) ([]otlpResourceLogs, error) {
+	var resourceLogs []otlpResourceLogs
+	err := forEachProtoBytes(data, func(field int, b []byte) error {
+		if field != 1 {
+			return nil
+		}
+		rl, err := parseOTLPResourceLogs(b)
+		resourceLogs = append(resourceLogs, rl)
+		return errors.Wrap(err, "invalid resource logs")
+	})
+	return resourceLogs, err
+}
+
+// parseOTLPResourceLogs decodes ResourceLogs{resource = 1, scope_logs = 2}, Resource{attributes = 1}
+// and ScopeLogs{log_records = 2}
+func parseOTLPResourceLogs(data []byte) (otlpResourceLogs, error) {
+	rl := otlpResourceLogs{attributes: make(map[string]interface{})}
+	err := forEachProtoBytes(data, func(field int, b []byte) error {
+		switch field {
+		case 1:
+			return forEachProtoBytes(b, func(field int, b []byte) error {
+				if field != 1 {
+					return nil
+				}
+				return parseOTLPKeyValue(b, rl.attributes)
+			})
+		case 2:
+			return forEachProtoBytes(b, func(field int, b []byte) error {
+				if field != 2 {
+					return nil
+				}
+				record, err := parseOTLPLogRecord(b)
+				rl.records = append(rl.records, record)
+				return errors.Wrap(err, "invalid log record")
+			})
+		}
+		return nil
+	})
+	return rl, err
+}
+
+// parseOTLPLogRecord decodes LogRecord{time_unix_nano = 1, severity_number = 2, severity_text = 3, body = 5,
+// attributes = 6, trace_id = 9, span_id = 10, observed_time_unix_nano = 11}
+func parseOTLPLogRecord(data []byte) (otlpLogRecord, error) {
+	record := otlpLogRecord{attributes: make(map[string]interface{})}
+	var timeNano, observedNano, severityNumber uint64
+	p := &protoReader{buf: data}
+	for {
+		field, wireType, err := p.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return record, err
+		}
+		switch {
+		case (field == 1 || field == 11) && wireType == protoFixed64:
+			v, err := p.fixed64()
+			if err != nil {
+				return record, err
+			}
+			if field == 1 {
+				timeNano = v
+			} else {
+				observedNano = v
+			}
+		case field == 2 && wireType == protoVarint:
+			if severityNumber, err = p.varint(); err != nil {
+				return record, err
+			}
+		case (field == 3 || field == 5 || field == 6 || field == 9 || field == 10) && wireType == protoBytes:
+			b, err := p.bytes()
+			if err != nil {
+				return record, err
+			}
+			switch field {
+			case 3:
+				record.severity = string(b)
+			case 5:
+				if record.body, err = parseOTLPAnyValue(b, 0); err != nil {
+					return record, err
+				}
+			case 6:
+				if err := parseOTLPKeyValue(b, record.attributes); err != nil {
+					return record, err
+				}
+			case 9:
+				record.traceID = hex.EncodeToString(b)
+			case 10:
+				record.spanID = hex.EncodeToString(b)
+			}
+		default:
+			if err := p.skip(wireType); err != nil {
+				return record, err
+			}
+		}
+	}
+	if timeNano == 0 {
+		timeNano = observedNano
+	}
+	if timeNano != 0 {
+		record.timestamp = time.Unix(0, int64(timeNano))
+	}
+	if record.severity == "" {
+		record.severity = otlpSeverityText(int64(severityNumber))
+	}
+	return record, nil
+}
+
+// parseOTLPKeyValue decodes KeyValue{key = 1, value = 2} into attributes
+func parseOTLPKeyValue(data []byte, attributes map[string]interface{}) error {
+	return parseOTLPKeyValueDepth(data, attributes, 0)
+}
+
+func parseOTLPKeyValueDepth(data []byte, attributes map[string]interface{}, depth int) error {
+	var key string
+	var value interface{}
+	err := forEachProtoBytes(data, func(field int, b []byte) error {
+		var err error
+		switch field {
+		case 1:
+			key = string(b)
+		case 2:
+			value, err = parseOTLPAnyValue(b, depth)
+		}
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "attribute %s", key)
+	}
+	attributes[key] = value
+	return nil
+}
+
+// parseOTLPAnyValue decodes AnyValue{string_value = 1, bool_value = 2, int_value = 3, double_value = 4,
+// array_value = 5, kvlist_value = 6, bytes_value = 7}
+func parseOTLPAnyValue(data []byte, depth int) (interface{}, error) {
+	if depth > otlpMaxDepth {
+		return nil, errors.New("value is nested too deep")
+	}
+	var value interface{}
+	p := &protoReader{buf: data}
+	for {
+		field, wireType, err := p.next()
+		if err == io.EOF {
+			return value, nil
+		} else if err != nil {
+			return nil, err
+		}
+		switch {
+		case (field == 2 || field == 3) && wireType == protoVarint:
+			v, err := p.varint()
+			if err != nil {
+				return nil, err
+			}
+			if field == 2 {
+				value = v != 0
+			} else {
+				value = int64(v)
+			}
+		case field == 4 && wireType == protoFixed64:
+			v, err := p.fixed64()
+			if err != nil {
+				return nil, err
+			}
+			value = math.Float64frombits(v)
+		case (field == 1 || field >= 5 && field <= 7) && wireType == protoBytes:
+			b, err := p.bytes()
+			if err != nil {
+				return nil, err
+			}
+			switch field {
+			case 1:
+				value = string(b)
+			case 5: // ArrayValue{values = 1}
+				values := []interface{}{}
+				err = forEachProtoBytes(b, func(field int, b []byte) error {
+					if field != 1 {
+						return nil
+					}
+					item, err := parseOTLPAnyValue(b, depth+1)
+					values = append(values, item)
+					return err
+				})
+				value = values
+			case 6: // KeyValueList{values = 1}
+				kvlist := make(map[string]interface{})
+				err = forEachProtoBytes(b, func(field int, b []byte) error {
+					if field != 1 {
+						return nil
+					}
+					return parseOTLPKeyValueDepth(b, kvlist, depth+1)
+				})
+				value = kvlist
+			case 7:
+				value = b
+			}
+			if err != nil {
+				return nil, err
+			}
+		default:
+			if err := p.skip(wireType); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// forEachProtoBytes calls fn for every length-delimited field of the message, other fields are skipped
+func forEachProtoBytes(data []byte, fn func(field int, b []byte) error) error {
+	p := &protoReader{buf: data}
+	for {
+		field, wireType, err := p.next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if wireType != protoBytes {
+			if err := p.skip(wireType); err != nil {
+				return err
+			}
+			continue
+		}
+		b, err := p.bytes()
+		if err != nil {
+			return err
+		}
+		if err := fn(field, b); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package receiver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+func appendProtoFixed64(buf []byte, field int, v uint64) []byte {
+	buf = appendUvarint(buf, uint64(field<<3|protoFixed64))
+	tmp := make([]byte, 8)
+	binary.LittleEndian.PutUint64(tmp, v)
+	return append(buf, tmp...)
+}
+
+func otlpStringAttribute(key, value string) []byte {
+	return appendProtoBytes(appendProtoBytes(nil, 1, []byte(key)), 2, appendProtoBytes(nil, 1, []byte(value)))
+}
+
+func TestOTLPLogs(t *testing.T) {
+	defer func(local *time.Location) { time.Local = local }(time.Local)
+	time.Local = time.UTC
+	logger := zerolog.Nop()
+	h, err := NewHttpReceiver(&config.HttpReceiver{OTLP: config.OTLPLogs{Enabled: true}}, metrics.Nop(), &logger)
+	assert.Nil(t, err)
+	h.SetTags([]config.CollectedLog{{Tag: "nginx:"}})
+
+	var resource []byte
+	resource = appendProtoBytes(resource, 1, otlpStringAttribute("service.name", "nginx"))
+	resource = appendProtoBytes(resource, 1, otlpStringAttribute("host.name", "web1"))
+
+	var kvlist []byte // {"request": {"status": 200, "time": 0.5}, "tags": [true]}
+	request := appendProtoBytes(nil, 1, appendProtoBytes(appendProtoBytes(nil, 1, []byte("status")), 2, appendProtoVarint(nil, 3, 200)))
+	request = appendProtoBytes(request, 1, appendProtoBytes(appendProtoBytes(nil, 1, []byte("time")), 2, appendProtoFixed64(nil, 4, math.Float64bits(0.5))))
+	kvlist = appendProtoBytes(kvlist, 1, appendProtoBytes(appendProtoBytes(nil, 1, []byte("request")), 2, appendProtoBytes(nil, 6, request)))
+	tags := appendProtoBytes(nil, 5, appendProtoBytes(nil, 1, appendProtoVarint(nil, 2, 1)))
+	kvlist = appendProtoBytes(kvlist, 1, appendProtoBytes(appendProtoBytes(nil, 1, []byte("tags")), 2, tags))
+
+	var record []byte
+	record = appendProtoFixed64(record, 1, 1587741282000000005)
+	record = appendProtoVarint(record, 2, 10) // severity text wins
+	record = appendProtoBytes(record, 3, []byte("INFO"))
+	record = appendProtoBytes(record, 5, appendProtoBytes(nil, 6, kvlist))
+	record = appendProtoBytes(record, 6, otlpStringAttribute("http.route", "/"))
+	record = appendProtoBytes(record, 9, []byte{0xab, 0xcd})
+
+	var unknown []byte
+	unknown = appendProtoBytes(unknown, 5, appendProtoBytes(nil, 1, []byte("GET /")))
+	unknown = appendProtoBytes(unknown, 6, otlpStringAttribute("service.name", "php"))
+
+	scope := appendProtoBytes(appendProtoBytes(appendProtoBytes(nil, 1, []byte("scope")), 2, record), 2, unknown)
+	protoBody := appendProtoBytes(nil, 1, appendProtoBytes(appendProtoBytes(nil, 1, resource), 2, scope))
+
+	jsonBody := `{"resourceLogs":[{
+		"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"nginx"}}]},
+		"scopeLogs":[{"logRecords":[{
+			"observedTimeUnixNano":"1587741282000000005",
+			"severityNumber":13,
+			"body":{"stringValue":"GET /"},
+			"attributes":[{"key":"bytes","value":{"intValue":"512"}},{"key":"event_datetime","value":{"stringValue":"2020-04-24T18:14:42+03:00"}}],
+			"spanId":"abcd"
+		}]}]
+	}]}`
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		resp        []byte
+		msgs        []string
+	}{
+		{
+			name:        "protobuf",
+			contentType: "application/x-protobuf",
+			body:        protoBody,
+			resp:        appendProtoBytes(nil, 1, appendProtoBytes(appendProtoVarint(nil, 1, 1), 2, []byte(`unknown service.name attribute values: "php"`))),
+			msgs: []string{
+				`web1	nginx:	{"event_datetime":"2020-04-24T15:14:42.000000005Z","host_name":"web1","http_route":"/",` +
+					`"request_status":200,"request_time":0.5,"service_name":"nginx","severity":"INFO","tags":[true],"trace_id":"abcd"}`,
+			},
+		},
+		{
+			name:        "json",
+			contentType: "application/json",
+			body:        []byte(jsonBody),
+			resp:        []byte("{}\n"),
+			msgs: []string{
+				`web0	nginx:	{"bytes":512,"event_datetime":"2020-04-24T18:14:42+03:00","message":"GET /","service_name":"nginx","severity":"WARN","span_id":"abcd"}`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, otlpLogsPath, bytes.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			r.Header.Set(headerHostname, "web0")
+			w := httptest.NewRecorder()
+			h.handleOTLPLogs(w, r)
+			assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			assert.Equal(t, tt.resp, w.Body.Bytes())
+			for _, msg := range tt.msgs {
+				assert.Equal(t, msg, receiveMsg(t, h.MsgChan()))
+			}
+			assert.Len(t, h.MsgChan(), 0)
+		})
+	}
+}
+
+func TestOTLPSeverityText(t *testing.T) {
+	table := []struct {
+		number   int64
+		expected string
+	}{
+		{0, ""},
+		{1, "TRACE"},
+		{8, "DEBUG4"},
+		{9, "INFO"},
+		{10, "INFO2"},
+		{17, "ERROR"},
+		{24, "FATAL4"},
+		{25, ""},
+	}
+
+	for _, p := range table {
+		assert.Equal(t, p.expected, otlpSeverityText(p.number), p.number)
+	}
+
+	number, err := parseOTLPJSONSeverity([]byte(`"SEVERITY_NUMBER_WARN2"`))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(14), number)
+}
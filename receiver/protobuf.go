@@ -0,0 +1,106 @@
+package receiver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// protobuf wire types
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+var errProtoTruncated = errors.New("truncated protobuf message")
+
+// protoReader iterates over fields of a protobuf message without generated code
+type protoReader struct {
+	buf []byte
+}
+
+// next returns number and wire type of the next field, io.EOF at the end of message
+func (p *protoReader) next() (int, int, error) {
+	if len(p.buf) == 0 {
+		return 0, 0, io.EOF
+	}
+	key, err := p.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(key >> 3), int(key & 7), nil
+}
+
+func (p *protoReader) varint() (uint64, error) {
+	v, n := binary.Uvarint(p.buf)
+	if n <= 0 {
+		return 0, errProtoTruncated
+	}
+	p.buf = p.buf[n:]
+	return v, nil
+}
+
+// bytes returns length-delimited field: string, bytes or embedded message
+func (p *protoReader) bytes() ([]byte, error) {
+	n, err := p.varint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(p.buf)) {
+		return nil, errProtoTruncated
+	}
+	b := p.buf[:n]
+	p.buf = p.buf[n:]
+	return b, nil
+}
+
+func (p *protoReader) fixed64() (uint64, error) {
+	if len(p.buf) < 8 {
+		return 0, errProtoTruncated
+	}
+	v := binary.LittleEndian.Uint64(p.buf)
+	p.buf = p.buf[8:]
+	return v, nil
+}
+
+// skip skips value of unknown field
+func (p *protoReader) skip(wireType int) error {
+	var n int
+	switch wireType {
+	case protoVarint:
+		_, err := p.varint()
+		return err
+	case protoBytes:
+		_, err := p.bytes()
+		return err
+	case protoFixed64:
+		n = 8
+	case protoFixed32:
+		n = 4
+	default:
+		return fmt.Errorf("unsupported protobuf wire type %d", wireType)
+	}
+	if n > len(p.buf) {
+		return errProtoTruncated
+	}
+	p.buf = p.buf[n:]
+	return nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	tmp := make([]byte, binary.MaxVarintLen64)
+	return append(buf, tmp[:binary.PutUvarint(tmp, v)]...)
+}
+
+func appendProtoVarint(buf []byte, field int, v uint64) []byte {
+	return appendUvarint(appendUvarint(buf, uint64(field<<3|protoVarint)), v)
+}
+
+func appendProtoBytes(buf []byte, field int, b []byte) []byte {
+	buf = appendUvarint(buf, uint64(field<<3|protoBytes))
+	return append(appendUvarint(buf, uint64(len(b))), b...)
+}
@@ -0,0 +1,264 @@
+package receiver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/pkg/errors"
+
+	"nginx-log-collector/config"
+)
+
+const (
+	proxyV1Prefix    = "PROXY "
+	proxyV1MaxLength = 107 // including CRLF
+	proxyV2Length    = 16  // signature, version and command, family, length
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocol reads PROXY protocol v1/v2 header of connections from trusted balancers
+type proxyProtocol struct {
+	trusted       []*net.IPNet
+	sourceField   string
+	sourceMetrics []*net.IPNet
+}
+
+// proxyConn reports the source address from PROXY protocol header as the remote address
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// ValidateProxyProtocol checks trusted sources of proxy protocol config
+func ValidateProxyProtocol(cfg config.ProxyProtocol) error {
+	_, err := newProxyProtocol(cfg)
+	return err
+}
+
+// newProxyProtocol returns nil if proxy protocol is disabled
+func newProxyProtocol(cfg config.ProxyProtocol) (*proxyProtocol, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if len(cfg.TrustedCIDRs) == 0 {
+		return nil, errors.New("trusted_cidrs should be set")
+	}
+	trusted, err := parseCIDRs(cfg.TrustedCIDRs)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid trusted_cidrs")
+	}
+	sourceMetrics, err := parseCIDRs(cfg.SourceMetricsCIDRs)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid source_metrics_cidrs")
+	}
+	return &proxyProtocol{trusted: trusted, sourceField: cfg.SourceField, sourceMetrics: sourceMetrics}, nil
+}
+
+// parseCIDRs parses networks, single addresses are allowed as well
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") { // single address
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// sourceLabel returns the first source_metrics_cidrs network of the source or "other",
+// so the label cardinality is bounded by the config. Empty if per-source metrics are off
+func (p *proxyProtocol) sourceLabel(addr net.Addr) string {
+	if len(p.sourceMetrics) == 0 {
+		return ""
+	}
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		for _, ipNet := range p.sourceMetrics {
+			if ipNet.Contains(tcpAddr.IP) {
+				return ipNet.String()
+			}
+		}
+	}
+	return "other"
+}
+
+// isTrusted reports whether the peer is a balancer allowed to send the header
+func (p *proxyProtocol) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range p.trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// conn reads the header of connection from trusted balancer, other connections are returned as is.
+// The header is required from trusted balancers
+func (p *proxyProtocol) conn(conn net.Conn) (net.Conn, error) {
+	if !p.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(tcpReadTimeout)); err != nil {
+		return conn, errors.Wrap(err, "set deadline error")
+	}
+	reader := bufio.NewReader(conn)
+	source, err := readProxyHeader(reader)
+	if err != nil {
+		return conn, err
+	}
+	if source == nil { // health check of the balancer or unknown protocol
+		source = conn.RemoteAddr()
+	}
+	return &proxyConn{Conn: conn, reader: reader, remoteAddr: source}, nil
+}
+
+// readProxyHeader returns source address, nil for LOCAL command and UNKNOWN protocol
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read proxy protocol header")
+	}
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		return readProxyV1(r)
+	case proxyV2Signature[0]:
+		return readProxyV2(r)
+	default:
+		return nil, errors.New("missing proxy protocol header")
+	}
+}
+
+// readProxyV1 parses human-readable header: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 4444\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, errors.New("proxy protocol v1 header is too long")
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read proxy protocol v1 header")
+		}
+		line = append(line, c)
+	}
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if fields[0] != strings.TrimSpace(proxyV1Prefix) || len(fields) < 2 {
+		return nil, fmt.Errorf("invalid proxy protocol v1 header %q", line)
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unsupported proxy protocol v1 protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("invalid proxy protocol v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("invalid proxy protocol v1 source address in %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 parses binary header, TLVs are skipped
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, proxyV2Length)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.Wrap(err, "unable to read proxy protocol v2 header")
+	}
+	if !bytes.Equal(header[:len(proxyV2Signature)], proxyV2Signature) {
+		return nil, errors.New("invalid proxy protocol v2 signature")
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported proxy protocol version %d", header[12]>>4)
+	}
+	command, family := header[12]&0x0f, header[13]
+	addresses := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, addresses); err != nil {
+		return nil, errors.Wrap(err, "unable to read proxy protocol v2 addresses")
+	}
+
+	switch command {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported proxy protocol v2 command %d", command)
+	}
+	var ipLen int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default: // UDP and unix sockets aren't balanced to this receiver
+		return nil, nil
+	}
+	if len(addresses) < 2*ipLen+4 {
+		return nil, errors.New("truncated proxy protocol v2 addresses")
+	}
+	ip := make(net.IP, ipLen)
+	copy(ip, addresses)
+	return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(addresses[2*ipLen:]))}, nil
+}
+
+// injectSource sets source field of json message in TSV line, other messages are sent as is
+func injectSource(line []byte, field, source string) []byte {
+	tabs := 0
+	for i, c := range line {
+		if c != '\t' {
+			continue
+		}
+		tabs++
+		if tabs == 2 {
+			content := injectField(line[i+1:], field, source)
+			return append(line[:i+1:i+1], content...)
+		}
+	}
+	return line
+}
+
+// injectField sets string field of json object
+func injectField(content []byte, field, value string) []byte {
+	if len(content) == 0 || content[0] != '{' {
+		return content
+	}
+	quoted := []byte(strconv.Quote(value))
+	if updated, err := jsonparser.Set(content, quoted, field); err == nil {
+		return updated
+	}
+	return content
+}
@@ -0,0 +1,137 @@
+package receiver
+
+import (
+	"bufio"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(command, family byte, addresses string) string {
+		length := string([]byte{byte(len(addresses) >> 8), byte(len(addresses))})
+		return string(proxyV2Signature) + string([]byte{0x20 | command, family}) + length + addresses
+	}
+	v4Addresses := "\xc0\x00\x02\x01" + "\xc0\x00\x02\x02" + "\xdc\x04" + "\x11\x5c"
+
+	tests := []struct {
+		name   string
+		header string
+		source string
+		err    bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 4444\r\n", "192.0.2.1:56324", false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 4444\r\n", "[2001:db8::1]:56324", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", false},
+		{"v1 address family mismatch", "PROXY TCP4 2001:db8::1 192.0.2.2 56324 4444\r\n", "", true},
+		{"v1 missing port", "PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n", "", true},
+		{"v1 too long", "PROXY UNKNOWN " + strings.Repeat("x", 200) + "\r\n", "", true},
+		{"v2 tcp4 with tlv", v2(1, 0x11, v4Addresses+"\x04\x00\x01x"), "192.0.2.1:56324", false},
+		{"v2 local", v2(0, 0x00, ""), "", false},
+		{"v2 truncated addresses", v2(1, 0x21, v4Addresses), "", true},
+		{"v2 wrong version", string(proxyV2Signature) + "\x11\x11\x00\x00", "", true},
+		{"missing header", "web1\tnginx:\t{}\n", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.header + "rest"))
+			source, err := readProxyHeader(r)
+			assert.Equal(t, tt.err, err != nil, "%v", err)
+			if tt.err {
+				return
+			}
+			if tt.source == "" {
+				assert.Nil(t, source)
+			} else {
+				assert.Equal(t, tt.source, source.String())
+			}
+			rest, _ := r.ReadString('\n')
+			assert.Equal(t, "rest", rest)
+		})
+	}
+}
+
+func TestInjectSource(t *testing.T) {
+	assert.Equal(t, `web1	nginx:	{"status":200,"source_addr":"192.0.2.1"}`,
+		string(injectSource([]byte(`web1	nginx:	{"status":200}`), "source_addr", "192.0.2.1")))
+	assert.Equal(t, "web1\tnginx_error:\tplain text",
+		string(injectSource([]byte("web1\tnginx_error:\tplain text"), "source_addr", "192.0.2.1")))
+}
+
+func TestTCPReceiverProxyProtocol(t *testing.T) {
+	logger := zerolog.Nop()
+	prom := metrics.NewPrometheus("nlc")
+	receiver, err := NewTCPReceiver(&config.TCPReceiver{
+		Addr: "127.0.0.1:0",
+		ProxyProtocol: config.ProxyProtocol{
+			Enabled:      true,
+			TrustedCIDRs: []string{"127.0.0.1"},
+			SourceField:  "source_addr",
+
+			SourceMetricsCIDRs: []string{"192.0.2.0/25"},
+		},
+	}, prom, &logger)
+	assert.Nil(t, err)
+	done := make(chan struct{})
+	go receiver.Start(done)
+
+	conn, err := net.Dial("tcp", receiver.listener.Addr().String())
+	assert.Nil(t, err)
+	_, err = conn.Write([]byte("PROXY TCP4 192.0.2.1 127.0.0.1 56324 4444\r\nweb1\tnginx:\t{}\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, `web1	nginx:	{"source_addr":"192.0.2.1"}`, receiveMsg(t, receiver.MsgChan()))
+	conn.Close()
+
+	conn, err = net.Dial("tcp", receiver.listener.Addr().String())
+	assert.Nil(t, err)
+	_, err = conn.Write([]byte("PROXY TCP4 192.0.2.200 127.0.0.1 56324 4444\r\nweb1\tnginx:\t{}\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, `web1	nginx:	{"source_addr":"192.0.2.200"}`, receiveMsg(t, receiver.MsgChan()))
+	conn.Close()
+
+	// traffic is attributed to the configured source networks
+	w := httptest.NewRecorder()
+	prom.ServeHTTP(w, nil)
+	assert.Contains(t, w.Body.String(), `nlc_receiver_source_connections_total{receiver="tcp",source="192.0.2.0/25"} 1`)
+	assert.Contains(t, w.Body.String(), `nlc_receiver_source_connections_total{receiver="tcp",source="other"} 1`)
+
+	// the header is required from trusted balancers
+	conn, err = net.Dial("tcp", receiver.listener.Addr().String())
+	assert.Nil(t, err)
+	_, err = conn.Write([]byte("web1\tnginx:\t{}\n"))
+	assert.Nil(t, err)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.Len(t, receiver.MsgChan(), 0)
+	conn.Close()
+
+	close(done)
+	receiver.Stop()
+}
+
+func TestValidateProxyProtocol(t *testing.T) {
+	assert.Nil(t, ValidateProxyProtocol(config.ProxyProtocol{}))
+	assert.Nil(t, ValidateProxyProtocol(config.ProxyProtocol{Enabled: true, TrustedCIDRs: []string{"10.0.0.0/8", "2001:db8::1"}}))
+	assert.Error(t, ValidateProxyProtocol(config.ProxyProtocol{Enabled: true}))
+	assert.Error(t, ValidateProxyProtocol(config.ProxyProtocol{Enabled: true, TrustedCIDRs: []string{"10.0.0.0/33"}}))
+	assert.Error(t, ValidateProxyProtocol(config.ProxyProtocol{Enabled: true, TrustedCIDRs: []string{"10.0.0.0/8"}, SourceMetricsCIDRs: []string{"192.0.2"}}))
+}
+
+func TestSourceLabel(t *testing.T) {
+	p, err := newProxyProtocol(config.ProxyProtocol{Enabled: true, TrustedCIDRs: []string{"10.0.0.0/8"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "", p.sourceLabel(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}))
+
+	p, err = newProxyProtocol(config.ProxyProtocol{Enabled: true, TrustedCIDRs: []string{"10.0.0.0/8"}, SourceMetricsCIDRs: []string{"192.0.2.1", "2001:db8::/32"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "192.0.2.1/32", p.sourceLabel(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}))
+	assert.Equal(t, "2001:db8::/32", p.sourceLabel(&net.TCPAddr{IP: net.ParseIP("2001:db8::5")}))
+	assert.Equal(t, "other", p.sourceLabel(&net.TCPAddr{IP: net.ParseIP("192.0.2.2")}))
+}
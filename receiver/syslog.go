@@ -0,0 +1,284 @@
+package receiver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	FormatTSV    = "tsv"
+	FormatSyslog = "syslog"
+
+	defaultMaxMessageSize = 1024 * 1024
+	maxMsgLenDigits       = 10
+)
+
+var (
+	localHostname, _ = os.Hostname()
+
+	errFraming     = errors.New("invalid octet-counted frame")
+	errLineTooLong = errors.New("line exceeds max message size")
+	utf8BOM        = []byte{0xEF, 0xBB, 0xBF}
+)
+
+// ValidateFormat checks that stream receiver format is known
+func ValidateFormat(format string) error {
+	switch format {
+	case "", FormatTSV, FormatSyslog:
+		return nil
+	default:
+		return fmt.Errorf("unknown receiver format: %s", format)
+	}
+}
+
+// syslogMessage is a syslog message reduced to the fields processor needs
+type syslogMessage struct {
+	Hostname string
+	Tag      string // app-name followed by a colon, the same as rsyslog %syslogtag%
+	Content  []byte
+}
+
+// bytes returns message in the HOSTNAME\tTAG\tMSG format produced by rsyslog TSV template
+func (m *syslogMessage) bytes() []byte {
+	buf := make([]byte, 0, len(m.Hostname)+len(m.Tag)+len(m.Content)+2)
+	buf = append(buf, m.Hostname...)
+	buf = append(buf, '\t')
+	buf = append(buf, m.Tag...)
+	buf = append(buf, '\t')
+	return append(buf, m.Content...)
+}
+
+// readSyslogFrame reads single message framed according to RFC 6587:
+// octet counting ("MSG-LEN SP SYSLOG-MSG") if the frame starts with a digit,
+// non-transparent framing (LF terminated) otherwise
+func readSyslogFrame(r *bufio.Reader, maxSize int) ([]byte, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] < '1' || first[0] > '9' {
+		line, err := readLine(r, maxSize)
+		if err != nil {
+			return line, err
+		}
+		return bytes.TrimRight(line, "\r"), nil
+	}
+
+	var size int
+	for i := 0; ; i++ {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if c == ' ' {
+			break
+		}
+		if c < '0' || c > '9' || i >= maxMsgLenDigits {
+			return nil, errFraming
+		}
+		size = size*10 + int(c-'0')
+	}
+	if size > maxSize {
+		return nil, errors.Wrapf(errFraming, "message size %d exceeds limit %d", size, maxSize)
+	}
+	frame := make([]byte, size)
+	if n, err := io.ReadFull(r, frame); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return frame[:n], err
+	}
+	return frame, nil
+}
+
+// readLine reads LF terminated line without the delimiter. Lines longer than maxSize are skipped
+// up to the next LF and errLineTooLong is returned, so a peer never sending LF can't exhaust memory
+func readLine(r *bufio.Reader, maxSize int) ([]byte, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !tooLong && len(line)+len(chunk) > maxSize+1 { // LF isn't counted
+			tooLong, line = true, nil
+		}
+		if !tooLong {
+			line = append(line, chunk...)
+		}
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err != nil:
+			return line, err
+		case tooLong:
+			return nil, errLineTooLong
+		default:
+			return line[:len(line)-1], nil
+		}
+	}
+}
+
+// peerHost returns hostname used for messages which don't contain it
+func peerHost(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	default: // unix socket peer is a local process
+		return localHostname
+	}
+}
+
+// parseSyslog parses RFC 5424 and RFC 3164 messages.
+// Hostname is empty if the message doesn't contain it
+func parseSyslog(data []byte) (*syslogMessage, error) {
+	rest, err := skipPri(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 1 && rest[0] >= '1' && rest[0] <= '9' && rest[1] == ' ' {
+		return parseRFC5424(rest[2:])
+	}
+	return parseRFC3164(rest)
+}
+
+// skipPri skips "<PRI>" part of the message
+func skipPri(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != '<' {
+		return nil, errors.New("missing priority")
+	}
+	end := bytes.IndexByte(data, '>')
+	if end < 2 || end > 4 {
+		return nil, errors.New("invalid priority")
+	}
+	pri, err := strconv.Atoi(string(data[1:end]))
+	if err != nil || pri > 191 {
+		return nil, errors.New("invalid priority")
+	}
+	return data[end+1:], nil
+}
+
+// parseRFC5424 parses message after "<PRI>VERSION SP":
+// TIMESTAMP SP HOSTNAME SP APP-NAME SP PROCID SP MSGID SP STRUCTURED-DATA [SP MSG]
+func parseRFC5424(data []byte) (*syslogMessage, error) {
+	var fields [5][]byte
+	for i := range fields {
+		sp := bytes.IndexByte(data, ' ')
+		if sp <= 0 {
+			return nil, errors.New("truncated rfc5424 header")
+		}
+		fields[i], data = data[:sp], data[sp+1:]
+	}
+	hostname, appName := fields[1], fields[2]
+	if string(appName) == "-" {
+		return nil, errors.New("missing app-name")
+	}
+
+	data, err := skipStructuredData(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if data[0] != ' ' {
+			return nil, errors.New("invalid structured data")
+		}
+		data = bytes.TrimPrefix(data[1:], utf8BOM)
+	}
+
+	msg := &syslogMessage{Tag: string(appName) + ":", Content: data}
+	if string(hostname) != "-" {
+		msg.Hostname = string(hostname)
+	}
+	return msg, nil
+}
+
+// skipStructuredData skips nil value or a sequence of [SD-ID PARAM="VALUE" ...] elements
+func skipStructuredData(data []byte) ([]byte, error) {
+	if len(data) > 0 && data[0] == '-' {
+		return data[1:], nil
+	}
+	if len(data) == 0 || data[0] != '[' {
+		return nil, errors.New("invalid structured data")
+	}
+	for len(data) > 0 && data[0] == '[' {
+		end := -1
+		inQuotes := false
+		for i := 1; i < len(data) && end < 0; i++ {
+			switch data[i] {
+			case '\\':
+				i++ // escaped '"', '\' or ']'
+			case '"':
+				inQuotes = !inQuotes
+			case ']':
+				if !inQuotes {
+					end = i
+				}
+			}
+		}
+		if end < 0 {
+			return nil, errors.New("unterminated structured data")
+		}
+		data = data[end+1:]
+	}
+	return data, nil
+}
+
+// parseRFC3164 parses message after "<PRI>": [TIMESTAMP SP] [HOSTNAME SP] TAG[PID]: MSG.
+// Timestamp is either "Mmm dd hh:mm:ss" or RFC 3339 as sent by rsyslog forward format
+func parseRFC3164(data []byte) (*syslogMessage, error) {
+	if len(data) > len(time.Stamp) && data[len(time.Stamp)] == ' ' {
+		if _, err := time.Parse(time.Stamp, string(data[:len(time.Stamp)])); err == nil {
+			data = data[len(time.Stamp)+1:]
+		}
+	}
+	if sp := bytes.IndexByte(data, ' '); sp > 0 {
+		if _, err := time.Parse(time.RFC3339, string(data[:sp])); err == nil {
+			data = data[sp+1:]
+		}
+	}
+
+	token, rest := nextToken(data)
+	tag, ok := parseTag(token)
+	hostname := ""
+	if !ok {
+		hostname = string(token)
+		token, rest = nextToken(rest)
+		if tag, ok = parseTag(token); !ok {
+			return nil, errors.New("missing tag")
+		}
+	}
+	return &syslogMessage{Hostname: hostname, Tag: tag, Content: rest}, nil
+}
+
+// nextToken splits data by the first space
+func nextToken(data []byte) ([]byte, []byte) {
+	sp := bytes.IndexByte(data, ' ')
+	if sp < 0 {
+		return data, nil
+	}
+	return data[:sp], data[sp+1:]
+}
+
+// parseTag converts "tag:" or "tag[pid]:" to "tag:"
+func parseTag(token []byte) (string, bool) {
+	if len(token) < 2 || token[len(token)-1] != ':' {
+		return "", false
+	}
+	token = token[:len(token)-1]
+	if token[len(token)-1] == ']' {
+		start := bytes.IndexByte(token, '[')
+		if start <= 0 {
+			return "", false
+		}
+		token = token[:start]
+	}
+	return string(token) + ":", true
+}
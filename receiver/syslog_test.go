@@ -0,0 +1,159 @@
+package receiver
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSyslog(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		hostname string
+		tag      string
+		content  string
+		err      bool
+	}{
+		{
+			name:     "nginx rfc3164",
+			data:     `<190>Oct 17 04:04:19 web1 nginx: {"status":200}`,
+			hostname: "web1",
+			tag:      "nginx:",
+			content:  `{"status":200}`,
+		},
+		{
+			name:     "rfc3164 nohostname",
+			data:     `<190>Oct  7 04:04:19 nginx_error: msg`,
+			hostname: "",
+			tag:      "nginx_error:",
+			content:  "msg",
+		},
+		{
+			name:     "rfc3164 pid",
+			data:     `<13>Oct 17 04:04:19 web1 app[123]: hello world`,
+			hostname: "web1",
+			tag:      "app:",
+			content:  "hello world",
+		},
+		{
+			name:     "rfc3164 rfc3339 timestamp",
+			data:     `<13>2020-04-24T18:14:42.123+03:00 web1 app: hello`,
+			hostname: "web1",
+			tag:      "app:",
+			content:  "hello",
+		},
+		{
+			name: "rfc3164 missing tag",
+			data: `<13>Oct 17 04:04:19 web1 hello`,
+			err:  true,
+		},
+		{
+			name:     "rfc5424",
+			data:     `<165>1 2003-10-11T22:14:15.003Z web1 nginx 1234 ID47 - {"status":200}`,
+			hostname: "web1",
+			tag:      "nginx:",
+			content:  `{"status":200}`,
+		},
+		{
+			name:     "rfc5424 structured data",
+			data:     `<165>1 2003-10-11T22:14:15.003Z web1 nginx - - [a@1 k="v\]"][b@1 x="y z"] ` + "\xEF\xBB\xBF" + `msg`,
+			hostname: "web1",
+			tag:      "nginx:",
+			content:  "msg",
+		},
+		{
+			name:     "rfc5424 nil hostname and no msg",
+			data:     `<165>1 - - nginx - - -`,
+			hostname: "",
+			tag:      "nginx:",
+			content:  "",
+		},
+		{
+			name: "rfc5424 nil app-name",
+			data: `<165>1 - web1 - - - - msg`,
+			err:  true,
+		},
+		{
+			name: "rfc5424 unterminated structured data",
+			data: `<165>1 - web1 nginx - - [a@1 k="]" msg`,
+			err:  true,
+		},
+		{
+			name: "missing priority",
+			data: `Oct 17 04:04:19 web1 nginx: msg`,
+			err:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := parseSyslog([]byte(tt.data))
+			if tt.err {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.hostname, msg.Hostname)
+			assert.Equal(t, tt.tag, msg.Tag)
+			assert.Equal(t, tt.content, string(msg.Content))
+		})
+	}
+}
+
+func TestReadSyslogFrame(t *testing.T) {
+	stream := "14 <13>1 - - a -\n" + // octet counted frame may contain LF
+		"<13>b: msg\r\n" +
+		"12 <13>c: x y z"
+	reader := bufio.NewReader(strings.NewReader(stream))
+
+	for _, expected := range []string{"<13>1 - - a -\n", "<13>b: msg", "<13>c: x y z"} {
+		frame, err := readSyslogFrame(reader, 100)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, string(frame))
+	}
+	_, err := readSyslogFrame(reader, 100)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReadLine(t *testing.T) {
+	long := strings.Repeat("x", 5000) // longer than reader buffer
+	reader := bufio.NewReaderSize(strings.NewReader("short\n"+long+"\n"+"0123456789\n"+long+"\nnext\nunfinished"), 16)
+
+	tests := []struct {
+		line string
+		err  error
+	}{
+		{"short", nil},
+		{"", errLineTooLong},
+		{"0123456789", nil},
+		{"", errLineTooLong},
+		{"next", nil},
+		{"unfinished", io.EOF},
+	}
+	for _, tt := range tests {
+		line, err := readLine(reader, 10)
+		assert.Equal(t, tt.err, err)
+		assert.Equal(t, tt.line, string(line))
+	}
+
+	// a peer never sending LF is bounded by the limit too
+	_, err := readSyslogFrame(bufio.NewReader(strings.NewReader("<13>a: "+long+"\n")), 100)
+	assert.Equal(t, errLineTooLong, err)
+}
+
+func TestReadSyslogFrameErrors(t *testing.T) {
+	_, err := readSyslogFrame(bufio.NewReader(strings.NewReader("101 <13>a: b")), 100)
+	assert.Equal(t, errFraming, errors.Cause(err))
+
+	_, err = readSyslogFrame(bufio.NewReader(strings.NewReader("12x <13>a: b")), 100)
+	assert.Equal(t, errFraming, errors.Cause(err))
+
+	frame, err := readSyslogFrame(bufio.NewReader(strings.NewReader("20 <13>a: b")), 100)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "<13>a: b", string(frame))
+}
@@ -2,6 +2,7 @@ package receiver
 
 import (
 	"bufio"
+	"crypto/tls"
 	"io"
 	"net"
 	"sync"
@@ -9,7 +10,10 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
-	"gopkg.in/alexcesaro/statsd.v2"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+	"nginx-log-collector/utils"
 )
 
 const (
@@ -18,16 +22,41 @@ const (
 )
 
 type TCPReceiver struct {
-	msgChan  chan []byte
-	listener *net.TCPListener
+	msgChan        chan []byte
+	listener       net.Listener
+	format         string
+	maxMessageSize int
+	tls            *tlsSettings
+	proxy          *proxyProtocol
+
+	overload      *overload
+	rateLimiter   *utils.RateLimiter
+	connRateLimit int64
 
-	metrics *statsd.Client
+	metrics metrics.Metrics
 	logger  zerolog.Logger
 	wg      *sync.WaitGroup
 }
 
-func NewTCPReceiver(addr string, metrics *statsd.Client, logger *zerolog.Logger) (*TCPReceiver, error) {
-	resolvedAddr, err := net.ResolveTCPAddr("tcp", addr)
+func NewTCPReceiver(cfg *config.TCPReceiver, metrics metrics.Metrics, logger *zerolog.Logger) (*TCPReceiver, error) {
+	format, maxMessageSize, err := streamSettings(cfg.Format, cfg.MaxMessageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ValidateOverloadPolicy(cfg.OverloadPolicy); err != nil {
+		return nil, err
+	}
+	tlsSettings, err := newTLSSettings(cfg.TLS)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid tls config")
+	}
+	proxy, err := newProxyProtocol(cfg.ProxyProtocol)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid proxy_protocol config")
+	}
+
+	resolvedAddr, err := net.ResolveTCPAddr("tcp", cfg.Addr)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to resolve addr")
 	}
@@ -37,17 +66,45 @@ func NewTCPReceiver(addr string, metrics *statsd.Client, logger *zerolog.Logger)
 		return nil, errors.Wrap(err, "unable to listen")
 	}
 
+	t := newStreamReceiver("tcp", listener, format, maxMessageSize, metrics, logger)
+	t.tls = tlsSettings
+	t.proxy = proxy
+	t.overload = newOverload(cfg.OverloadPolicy, cfg.OverloadSampleRate)
+	t.rateLimiter = utils.NewRateLimiter(cfg.RateLimit)
+	t.connRateLimit = cfg.ConnRateLimit
+	return t, nil
+}
+
+// newStreamReceiver creates receiver accepting connections from any stream listener
+func newStreamReceiver(name string, listener net.Listener, format string, maxMessageSize int, metrics metrics.Metrics, logger *zerolog.Logger) *TCPReceiver {
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
 
 	msgChan := make(chan []byte, 100000)
 	return &TCPReceiver{
-		msgChan:  msgChan,
-		listener: listener,
-		metrics:  metrics.Clone(statsd.Prefix("receiver.tcp")),
-		wg:       wg,
-		logger:   logger.With().Str("component", "receiver.tcp").Logger(),
-	}, nil
+		msgChan:        msgChan,
+		listener:       listener,
+		format:         format,
+		maxMessageSize: maxMessageSize,
+		overload:       newOverload(OverloadBlock, 0),
+		metrics:        receiverMetrics(metrics, name),
+		wg:             wg,
+		logger:         logger.With().Str("component", "receiver."+name).Logger(),
+	}
+}
+
+// streamSettings applies defaults to the message format and size limit
+func streamSettings(format string, maxMessageSize int) (string, int, error) {
+	if format == "" {
+		format = FormatTSV
+	}
+	if err := ValidateFormat(format); err != nil {
+		return "", 0, err
+	}
+	if maxMessageSize <= 0 {
+		maxMessageSize = defaultMaxMessageSize
+	}
+	return format, maxMessageSize, nil
 }
 
 func (t *TCPReceiver) MsgChan() chan []byte {
@@ -72,15 +129,68 @@ func (t *TCPReceiver) Start(done <-chan struct{}) {
 			continue
 		}
 		t.wg.Add(1)
-		go t.handle(conn, done)
+		if t.format == FormatSyslog {
+			go t.handleSyslog(conn, done)
+		} else {
+			go t.handle(conn, done)
+		}
 	}
 }
 
-func (t *TCPReceiver) handle(conn net.Conn, done <-chan struct{}) {
-	defer conn.Close()
+// setupConn reads PROXY protocol header and starts tls on the accepted connection;
+// tls is started per connection since the header precedes the handshake.
+// Metrics labeled with the source network are returned for proxied connections if enabled, nil otherwise
+func (t *TCPReceiver) setupConn(conn net.Conn) (net.Conn, metrics.Metrics, error) {
+	var sourceMetrics metrics.Metrics
+	if t.proxy != nil {
+		proxied, err := t.proxy.conn(conn)
+		if err != nil {
+			t.logger.Warn().Err(err).Str("peer", conn.RemoteAddr().String()).Msg("proxy protocol error")
+			t.metrics.Increment("proxy_error")
+			return conn, nil, err
+		}
+		if proxied != conn {
+			t.logger.Info().Str("balancer", conn.RemoteAddr().String()).Str("peer", proxied.RemoteAddr().String()).Msg("proxied connection")
+			if source := t.proxy.sourceLabel(proxied.RemoteAddr()); source != "" {
+				sourceMetrics = t.metrics.Clone("source", metrics.Label{Name: "source", Value: source})
+				sourceMetrics.Increment("connections")
+			}
+			t.metrics.Increment("proxied")
+		}
+		conn = proxied
+	}
+	if t.tls != nil {
+		conn = tls.Server(conn, t.tls.config)
+	}
+	return conn, sourceMetrics, nil
+}
+
+// source returns real source address to inject into json messages, empty if disabled
+func (t *TCPReceiver) source(conn net.Conn) string {
+	if t.proxy == nil || t.proxy.sourceField == "" {
+		return ""
+	}
+	return peerHost(conn.RemoteAddr())
+}
+
+func (t *TCPReceiver) handle(rawConn net.Conn, done <-chan struct{}) {
 	defer t.wg.Done()
 	t.metrics.Increment("accepted")
-	reader := bufio.NewReader(conn)
+	conn, sourceMetrics, err := t.setupConn(rawConn)
+	defer conn.Close()
+	if err != nil {
+		return
+	}
+	source := t.source(conn)
+	hostname, err := t.tls.connHostname(conn)
+	if err != nil {
+		t.logger.Warn().Err(err).Str("peer", conn.RemoteAddr().String()).Msg("tls error")
+		t.metrics.Increment("tls_error")
+		return
+	}
+	stats := t.overload.register(statsHost(hostname, conn))
+	defer t.overload.unregister(stats)
+	reader := bufio.NewReader(t.connReader(conn, stats))
 	var cnt uint64
 	for {
 		select {
@@ -93,7 +203,12 @@ func (t *TCPReceiver) handle(conn net.Conn, done <-chan struct{}) {
 			t.logger.Warn().Err(err).Msg("set deadline error")
 		}
 
-		line, err := reader.ReadBytes('\n')
+		line, err := readLine(reader, t.maxMessageSize)
+		if err == errLineTooLong {
+			t.logger.Warn().Str("peer", conn.RemoteAddr().String()).Int("limit", t.maxMessageSize).Msg("line is too long; skipping")
+			t.metrics.Increment("line_too_long")
+			continue
+		}
 		if err != nil {
 			if err == io.EOF {
 				if len(line) > 0 {
@@ -105,10 +220,105 @@ func (t *TCPReceiver) handle(conn net.Conn, done <-chan struct{}) {
 			}
 			break
 		}
-		t.msgChan <- line[:len(line)-1]
+		if hostname != "" {
+			line = replaceHostname(line, hostname)
+		}
+		if source != "" {
+			line = injectSource(line, t.proxy.sourceField, source)
+		}
+		t.overload.send(t.msgChan, line, stats)
+		cnt++
+		if cnt%100 == 0 {
+			t.metrics.Count("lines", 100)
+			if sourceMetrics != nil {
+				sourceMetrics.Count("lines", 100)
+			}
+		}
+		if cnt%10000 == 0 {
+			t.logger.Debug().Msg("10k lines processed")
+			cnt = 0
+		}
+	}
+}
+
+// handleSyslog reads RFC 6587 framed syslog messages and converts them to the TSV format
+func (t *TCPReceiver) handleSyslog(rawConn net.Conn, done <-chan struct{}) {
+	defer t.wg.Done()
+	t.metrics.Increment("accepted")
+	conn, sourceMetrics, err := t.setupConn(rawConn)
+	defer conn.Close()
+	if err != nil {
+		return
+	}
+	source := t.source(conn)
+	peer := peerHost(conn.RemoteAddr())
+	hostname, err := t.tls.connHostname(conn)
+	if err != nil {
+		t.logger.Warn().Err(err).Str("peer", peer).Msg("tls error")
+		t.metrics.Increment("tls_error")
+		return
+	}
+	stats := t.overload.register(statsHost(hostname, conn))
+	defer t.overload.unregister(stats)
+	reader := bufio.NewReader(t.connReader(conn, stats))
+	var cnt uint64
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		err := conn.SetReadDeadline(time.Now().Add(tcpReadTimeout))
+		if err != nil {
+			t.logger.Warn().Err(err).Msg("set deadline error")
+		}
+
+		frame, err := readSyslogFrame(reader, t.maxMessageSize)
+		if err == errLineTooLong {
+			t.logger.Warn().Str("peer", peer).Int("limit", t.maxMessageSize).Msg("line is too long; skipping")
+			t.metrics.Increment("line_too_long")
+			continue
+		}
+		if err != nil {
+			if err == io.EOF {
+				if len(frame) > 0 {
+					t.logger.Warn().Str("line", string(frame)).Msg("unfinished line")
+					t.metrics.Increment("line_error")
+				}
+			} else if errors.Cause(err) == errFraming {
+				// octet counting can't resync after a broken frame
+				t.logger.Warn().Err(err).Str("peer", peer).Msg("closing connection")
+				t.metrics.Increment("framing_error")
+			} else {
+				t.logger.Debug().Err(err).Msg("read error (can be ignored)") // it's ok
+			}
+			break
+		}
+		if len(frame) == 0 {
+			continue
+		}
+
+		msg, err := parseSyslog(frame)
+		if err != nil {
+			t.logger.Warn().Err(err).Str("line", string(frame)).Msg("unable to parse syslog message")
+			t.metrics.Increment("parse_error")
+			continue
+		}
+		if hostname != "" {
+			msg.Hostname = hostname
+		} else if msg.Hostname == "" {
+			msg.Hostname = peer
+		}
+		if source != "" {
+			msg.Content = injectField(msg.Content, t.proxy.sourceField, source)
+		}
+		t.overload.send(t.msgChan, msg.bytes(), stats)
 		cnt++
 		if cnt%100 == 0 {
 			t.metrics.Count("lines", 100)
+			if sourceMetrics != nil {
+				sourceMetrics.Count("lines", 100)
+			}
 		}
 		if cnt%10000 == 0 {
 			t.logger.Debug().Msg("10k lines processed")
@@ -126,8 +336,11 @@ func (t *TCPReceiver) queueMonitoring(done <-chan struct{}) {
 	for {
 		select {
 		case <-ticker.C:
-			t.logger.Debug().Int("tcp_msg_chan_len", len(t.msgChan)).Msg("tcp queue stats")
-			t.metrics.Count("tcp_msg_chan_len", len(t.msgChan))
+			t.logger.Debug().Int("msg_chan_len", len(t.msgChan)).Msg("queue stats")
+			// statsd keeps the legacy bucket
+			metrics.StatsdOnly(t.metrics).Count("tcp_msg_chan_len", len(t.msgChan))
+			metrics.PrometheusOnly(t.metrics).Gauge("msg_chan_len", len(t.msgChan))
+			t.reportOverload()
 		case <-done:
 			t.logger.Debug().Msg("queueMonitoring exit")
 			return
@@ -0,0 +1,132 @@
+package receiver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"nginx-log-collector/config"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsSettings is a server TLS config with client certificate to hostname mapping
+type tlsSettings struct {
+	config         *tls.Config
+	hostnameFromCN bool
+	cnHostnames    map[string]string
+}
+
+// newTLSSettings returns nil if TLS is disabled
+func newTLSSettings(cfg config.TLS) (*tlsSettings, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load certificate")
+	}
+
+	minVersion := uint16(tls.VersionTLS12)
+	if cfg.MinVersion != "" {
+		version, found := tlsVersions[cfg.MinVersion]
+		if !found {
+			return nil, fmt.Errorf("unknown tls version: %s", cfg.MinVersion)
+		}
+		minVersion = version
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+		ClientAuth:   tls.NoClientCert,
+	}
+	if cfg.ClientCA != "" {
+		pem, err := ioutil.ReadFile(cfg.ClientCA)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read client ca")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in client ca")
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if cfg.RequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if cfg.RequireClientCert {
+		return nil, errors.New("client_ca is required to verify client certificates")
+	}
+	if cfg.HostnameFromCN && !cfg.RequireClientCert {
+		return nil, errors.New("hostname_from_cn requires require_client_cert")
+	}
+
+	return &tlsSettings{
+		config:         tlsConfig,
+		hostnameFromCN: cfg.HostnameFromCN,
+		cnHostnames:    cfg.CNHostnames,
+	}, nil
+}
+
+// ValidateTLSConfig checks TLS settings and loads certificates
+func ValidateTLSConfig(cfg config.TLS) error {
+	_, err := newTLSSettings(cfg)
+	return err
+}
+
+// hostname returns hostname enforced by the client certificate
+// or empty string if hostname isn't enforced
+func (s *tlsSettings) hostname(state *tls.ConnectionState) (string, error) {
+	if s == nil || !s.hostnameFromCN {
+		return "", nil
+	}
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return "", errors.New("no client certificate")
+	}
+	cn := state.PeerCertificates[0].Subject.CommonName
+	if cn == "" {
+		return "", errors.New("empty client certificate common name")
+	}
+	if hostname, found := s.cnHostnames[cn]; found {
+		return hostname, nil
+	}
+	return cn, nil
+}
+
+// connHostname completes TLS handshake and returns hostname enforced by the client certificate
+func (s *tlsSettings) connHostname(conn net.Conn) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	if err := conn.SetDeadline(time.Now().Add(tcpReadTimeout)); err != nil {
+		return "", errors.Wrap(err, "set deadline error")
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return "", errors.Wrap(err, "tls handshake error")
+	}
+	state := tlsConn.ConnectionState()
+	return s.hostname(&state)
+}
+
+// replaceHostname replaces hostname field of the TSV message
+func replaceHostname(msg []byte, hostname string) []byte {
+	for i, c := range msg {
+		if c == '\t' {
+			return append([]byte(hostname), msg[i:]...)
+		}
+	}
+	return msg
+}
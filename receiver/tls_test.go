@@ -0,0 +1,169 @@
+package receiver
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, cn string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write stores certificate and key as PEM files and returns their paths
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	assert.Nil(t, ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600))
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certPath, keyPath
+}
+
+func TestTCPReceiverMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil)
+	caPath, _ := ca.write(t, dir, "ca")
+	certPath, keyPath := newTestCert(t, "collector", ca).write(t, dir, "server")
+	client := newTestCert(t, "web1", ca)
+
+	logger := zerolog.Nop()
+	cfg := &config.TCPReceiver{
+		Addr: "127.0.0.1:0",
+		TLS: config.TLS{
+			Enabled:           true,
+			Cert:              certPath,
+			Key:               keyPath,
+			ClientCA:          caPath,
+			RequireClientCert: true,
+			HostnameFromCN:    true,
+			CNHostnames:       map[string]string{"web1": "web1.example.com"},
+		},
+	}
+	receiver, err := NewTCPReceiver(cfg, metrics.Nop(), &logger)
+	assert.Nil(t, err)
+	done := make(chan struct{})
+	go receiver.Start(done)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	conn, err := tls.Dial("tcp", receiver.listener.Addr().String(), &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{{Certificate: [][]byte{client.der}, PrivateKey: client.key}},
+	})
+	assert.Nil(t, err)
+	_, err = conn.Write([]byte("spoofed\tnginx:\t{}\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "web1.example.com\tnginx:\t{}", receiveMsg(t, receiver.MsgChan()))
+	conn.Close()
+
+	close(done)
+	receiver.Stop()
+}
+
+func TestTLSSettingsValidation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil)
+	caPath, _ := ca.write(t, dir, "ca")
+	certPath, keyPath := newTestCert(t, "collector", ca).write(t, dir, "server")
+
+	tests := []struct {
+		name string
+		cfg  config.TLS
+		err  bool
+	}{
+		{"disabled", config.TLS{}, false},
+		{"server only", config.TLS{Enabled: true, Cert: certPath, Key: keyPath, MinVersion: "1.3"}, false},
+		{"missing cert", config.TLS{Enabled: true, Cert: filepath.Join(dir, "none"), Key: keyPath}, true},
+		{"unknown version", config.TLS{Enabled: true, Cert: certPath, Key: keyPath, MinVersion: "2.0"}, true},
+		{"client cert without ca", config.TLS{Enabled: true, Cert: certPath, Key: keyPath, RequireClientCert: true}, true},
+		{"cn without client cert", config.TLS{Enabled: true, Cert: certPath, Key: keyPath, ClientCA: caPath, HostnameFromCN: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateTLSConfig(tt.cfg)
+			assert.Equal(t, tt.err, err != nil, "%v", err)
+		})
+	}
+}
+
+func TestHttpReceiverEnforcedHostname(t *testing.T) {
+	logger := zerolog.Nop()
+	h, err := NewHttpReceiver(&config.HttpReceiver{}, metrics.Nop(), &logger)
+	assert.Nil(t, err)
+	h.tls = &tlsSettings{hostnameFromCN: true}
+
+	body := "2020-04-24 18:14:42 +0300 Puppet (info): Applying configuration\n"
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "text/plain")
+	r.Header.Set(headerHostname, "spoofed")
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "web1"}}}}
+	w := httptest.NewRecorder()
+	h.handle(w, r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	msg := receiveMsg(t, h.MsgChan())
+	assert.True(t, bytes.HasPrefix([]byte(msg), []byte("web1\tpuppet:\t")), msg)
+
+	r = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "text/plain")
+	r.TLS = &tls.ConnectionState{}
+	w = httptest.NewRecorder()
+	h.handle(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
@@ -0,0 +1,146 @@
+package receiver
+
+import (
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+const (
+	defaultUDPWorkers        = 4
+	defaultUDPMaxMessageSize = 64 * 1024 // max udp payload
+)
+
+// UDPReceiver receives syslog datagrams, e.g. from nginx access_log syslog:server=
+type UDPReceiver struct {
+	msgChan        chan []byte
+	conn           *net.UDPConn
+	workers        int
+	maxMessageSize int
+
+	metrics metrics.Metrics
+	logger  zerolog.Logger
+	wg      *sync.WaitGroup
+}
+
+func NewUDPReceiver(cfg *config.UDPReceiver, metrics metrics.Metrics, logger *zerolog.Logger) (*UDPReceiver, error) {
+	resolvedAddr, err := net.ResolveUDPAddr("udp", cfg.Addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to resolve addr")
+	}
+
+	conn, err := net.ListenUDP("udp", resolvedAddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to listen")
+	}
+	if cfg.ReadBufferSize > 0 {
+		if err := conn.SetReadBuffer(cfg.ReadBufferSize); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "unable to set read buffer size")
+		}
+	}
+
+	workers := defaultUDPWorkers
+	if cfg.Workers > 0 {
+		workers = cfg.Workers
+	}
+	maxMessageSize := defaultUDPMaxMessageSize
+	if cfg.MaxMessageSize > 0 {
+		maxMessageSize = cfg.MaxMessageSize
+	}
+
+	return &UDPReceiver{
+		msgChan:        make(chan []byte, 100000),
+		conn:           conn,
+		workers:        workers,
+		maxMessageSize: maxMessageSize,
+		metrics:        receiverMetrics(metrics, "udp"),
+		wg:             &sync.WaitGroup{},
+		logger:         logger.With().Str("component", "receiver.udp").Logger(),
+	}, nil
+}
+
+func (u *UDPReceiver) MsgChan() chan []byte {
+	return u.msgChan
+}
+
+func (u *UDPReceiver) Start(done <-chan struct{}) {
+	u.logger.Info().Msg("starting")
+
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		monitorQueue(done, u.msgChan, u.metrics, &u.logger)
+	}()
+
+	u.wg.Add(u.workers)
+	for i := 0; i < u.workers; i++ {
+		go u.worker(done)
+	}
+	<-done
+	u.conn.Close() // unblocks workers
+}
+
+func (u *UDPReceiver) worker(done <-chan struct{}) {
+	defer u.wg.Done()
+
+	// one extra byte detects datagrams truncated by the buffer size
+	buf := make([]byte, u.maxMessageSize+1)
+	var cnt uint64
+	for {
+		n, addr, err := u.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			u.logger.Warn().Err(err).Msg("read error")
+			u.metrics.Increment("read_error")
+			continue
+		}
+		if n > u.maxMessageSize {
+			u.logger.Warn().Str("peer", addr.IP.String()).Int("limit", u.maxMessageSize).Msg("datagram truncated")
+			u.metrics.Increment("truncated")
+			continue
+		}
+
+		frame := buf[:n]
+		if n > 0 && frame[n-1] == '\n' {
+			frame = frame[:n-1]
+		}
+		msg, err := parseSyslog(frame)
+		if err != nil {
+			u.logger.Warn().Err(err).Str("line", string(frame)).Msg("unable to parse syslog message")
+			u.metrics.Increment("parse_error")
+			continue
+		}
+		if msg.Hostname == "" {
+			msg.Hostname = peerHost(addr)
+		}
+
+		// blocking here only moves drops to the kernel socket buffer where they can't be counted
+		select {
+		case u.msgChan <- msg.bytes():
+		default:
+			u.metrics.Increment("dropped")
+			continue
+		}
+		cnt++
+		if cnt%100 == 0 {
+			u.metrics.Count("lines", 100)
+		}
+	}
+}
+
+func (u *UDPReceiver) Stop() {
+	u.conn.Close()
+	u.logger.Info().Msg("stopping")
+	u.wg.Wait()
+	close(u.msgChan)
+}
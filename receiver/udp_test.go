@@ -0,0 +1,41 @@
+package receiver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+func TestUDPReceiver(t *testing.T) {
+	logger := zerolog.Nop()
+	u, err := NewUDPReceiver(&config.UDPReceiver{Addr: "127.0.0.1:0", Workers: 2, MaxMessageSize: 100}, metrics.Nop(), &logger)
+	assert.Nil(t, err)
+
+	done := make(chan struct{})
+	go u.Start(done)
+
+	conn, err := net.Dial("udp", u.conn.LocalAddr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write(make([]byte, 101)) // truncated, must be skipped
+	assert.Nil(t, err)
+	_, err = conn.Write([]byte(`<190>Oct 17 04:04:19 nginx: {"status":200}`))
+	assert.Nil(t, err)
+
+	select {
+	case msg := <-u.MsgChan():
+		assert.Equal(t, "127.0.0.1\tnginx:\t{\"status\":200}", string(msg))
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+
+	close(done)
+	u.Stop()
+}
@@ -0,0 +1,278 @@
+package receiver
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+const (
+	NetworkUnix     = "unix"
+	NetworkUnixgram = "unixgram"
+
+	defaultSocketMode = 0660
+)
+
+// UnixReceiver receives messages from a unix socket.
+// Stream connections are handled the same way as tcp ones, every datagram contains one or more lines
+type UnixReceiver struct {
+	path string
+
+	stream *TCPReceiver
+
+	conn           *net.UnixConn
+	msgChan        chan []byte
+	format         string
+	maxMessageSize int
+	metrics        metrics.Metrics
+	logger         zerolog.Logger
+	wg             *sync.WaitGroup
+}
+
+type unixSocketSettings struct {
+	network  string
+	mode     os.FileMode
+	uid, gid int
+}
+
+func NewUnixReceiver(cfg *config.UnixReceiver, metrics metrics.Metrics, logger *zerolog.Logger) (*UnixReceiver, error) {
+	format, maxMessageSize, err := streamSettings(cfg.Format, cfg.MaxMessageSize)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := unixSettings(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := removeStaleSocket(settings.network, cfg.Path); err != nil {
+		return nil, err
+	}
+
+	// the socket is created in a private directory and moved into place once permissions are set,
+	// so it's never accessible with permissions derived from umask
+	tmpDir, err := ioutil.TempDir(filepath.Dir(cfg.Path), ".socket")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create socket directory")
+	}
+	defer os.RemoveAll(tmpDir)
+	tmpPath := filepath.Join(tmpDir, "s")
+
+	u := &UnixReceiver{path: cfg.Path}
+	if settings.network == NetworkUnix {
+		listener, err := net.ListenUnix(NetworkUnix, &net.UnixAddr{Name: tmpPath, Net: NetworkUnix})
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to listen")
+		}
+		listener.SetUnlinkOnClose(false) // the socket is moved, Stop removes it
+		u.stream = newStreamReceiver("unix", listener, format, maxMessageSize, metrics, logger)
+	} else {
+		conn, err := net.ListenUnixgram(NetworkUnixgram, &net.UnixAddr{Name: tmpPath, Net: NetworkUnixgram})
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to listen")
+		}
+		u.conn = conn
+		u.msgChan = make(chan []byte, 100000)
+		u.format = format
+		u.maxMessageSize = maxMessageSize
+		u.metrics = receiverMetrics(metrics, "unixgram")
+		u.logger = logger.With().Str("component", "receiver.unixgram").Logger()
+		u.wg = &sync.WaitGroup{}
+		u.wg.Add(1) // reader
+	}
+
+	if err := setSocketPermissions(tmpPath, settings); err != nil {
+		u.close()
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, cfg.Path); err != nil {
+		u.close()
+		return nil, errors.Wrap(err, "unable to move socket into place")
+	}
+	return u, nil
+}
+
+// ValidateUnixConfig checks unix receiver settings without creating the socket
+func ValidateUnixConfig(cfg *config.UnixReceiver) error {
+	if _, _, err := streamSettings(cfg.Format, cfg.MaxMessageSize); err != nil {
+		return err
+	}
+	_, err := unixSettings(cfg)
+	return err
+}
+
+func unixSettings(cfg *config.UnixReceiver) (unixSocketSettings, error) {
+	settings := unixSocketSettings{network: cfg.Network, mode: defaultSocketMode, uid: -1, gid: -1}
+	if cfg.Path == "" {
+		return settings, errors.New("socket path should be set")
+	}
+	switch settings.network {
+	case "":
+		settings.network = NetworkUnix
+	case NetworkUnix, NetworkUnixgram:
+	default:
+		return settings, fmt.Errorf("unknown unix socket network: %s", cfg.Network)
+	}
+	if cfg.Mode != "" {
+		mode, err := strconv.ParseUint(cfg.Mode, 8, 32)
+		if err != nil || mode > 0777 {
+			return settings, fmt.Errorf("invalid socket mode: %s", cfg.Mode)
+		}
+		settings.mode = os.FileMode(mode)
+	}
+	if cfg.Owner != "" {
+		u, err := user.Lookup(cfg.Owner)
+		if err != nil {
+			return settings, errors.Wrap(err, "invalid socket owner")
+		}
+		settings.uid, _ = strconv.Atoi(u.Uid)
+	}
+	if cfg.Group != "" {
+		g, err := user.LookupGroup(cfg.Group)
+		if err != nil {
+			return settings, errors.Wrap(err, "invalid socket group")
+		}
+		settings.gid, _ = strconv.Atoi(g.Gid)
+	}
+	return settings, nil
+}
+
+// removeStaleSocket removes socket file left by a process which didn't exit cleanly
+func removeStaleSocket(network, path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "unable to stat socket")
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial(network, path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	return errors.Wrap(os.Remove(path), "unable to remove stale socket")
+}
+
+func setSocketPermissions(path string, settings unixSocketSettings) error {
+	if err := os.Chmod(path, settings.mode); err != nil {
+		return errors.Wrap(err, "unable to set socket mode")
+	}
+	if settings.uid != -1 || settings.gid != -1 {
+		if err := os.Chown(path, settings.uid, settings.gid); err != nil {
+			return errors.Wrap(err, "unable to set socket owner")
+		}
+	}
+	return nil
+}
+
+func (u *UnixReceiver) MsgChan() chan []byte {
+	if u.stream != nil {
+		return u.stream.MsgChan()
+	}
+	return u.msgChan
+}
+
+func (u *UnixReceiver) Start(done <-chan struct{}) {
+	if u.stream != nil {
+		u.stream.Start(done)
+		return
+	}
+	u.logger.Info().Msg("starting")
+	defer u.wg.Done()
+
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		monitorQueue(done, u.msgChan, u.metrics, &u.logger)
+	}()
+
+	buf := make([]byte, u.maxMessageSize+1)
+	var cnt uint64
+	for {
+		n, err := u.conn.Read(buf)
+		if err != nil {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			u.logger.Warn().Err(err).Msg("read error")
+			u.metrics.Increment("read_error")
+			continue
+		}
+		if n > u.maxMessageSize {
+			u.logger.Warn().Int("limit", u.maxMessageSize).Msg("datagram truncated")
+			u.metrics.Increment("truncated")
+			continue
+		}
+
+		for _, line := range bytes.Split(buf[:n], []byte{'\n'}) {
+			if len(line) == 0 {
+				continue
+			}
+			msg, err := u.convert(line)
+			if err != nil {
+				u.logger.Warn().Err(err).Str("line", string(line)).Msg("unable to parse syslog message")
+				u.metrics.Increment("parse_error")
+				continue
+			}
+			u.msgChan <- msg
+			cnt++
+			if cnt%100 == 0 {
+				u.metrics.Count("lines", 100)
+			}
+		}
+	}
+}
+
+// convert returns a copy of the line in the TSV format
+func (u *UnixReceiver) convert(line []byte) ([]byte, error) {
+	if u.format != FormatSyslog {
+		return append([]byte(nil), line...), nil
+	}
+	msg, err := parseSyslog(line)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Hostname == "" {
+		msg.Hostname = localHostname
+	}
+	return msg.bytes(), nil
+}
+
+func (u *UnixReceiver) Stop() {
+	if u.stream != nil {
+		u.stream.Stop()
+	} else {
+		u.conn.Close()
+		u.logger.Info().Msg("stopping")
+		u.wg.Wait()
+		close(u.msgChan)
+	}
+	if err := os.Remove(u.path); err != nil && !os.IsNotExist(err) {
+		u.logger.Warn().Err(err).Msg("unable to remove socket")
+	}
+}
+
+// close releases the socket of receiver which wasn't started
+func (u *UnixReceiver) close() {
+	if u.stream != nil {
+		u.stream.listener.Close()
+	} else {
+		u.conn.Close()
+	}
+	os.Remove(u.path)
+}
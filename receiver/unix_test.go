@@ -0,0 +1,131 @@
+package receiver
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+func receiveMsg(t *testing.T, msgChan chan []byte) string {
+	select {
+	case msg := <-msgChan:
+		return string(msg)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+		return ""
+	}
+}
+
+func TestUnixReceiver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unix")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	logger := zerolog.Nop()
+
+	tests := []struct {
+		name     string
+		cfg      config.UnixReceiver
+		send     string
+		expected []string
+	}{
+		{
+			name:     "stream",
+			cfg:      config.UnixReceiver{Network: NetworkUnix, Mode: "0600"},
+			send:     "web1\tnginx:\t{}\nweb2\tnginx:\t{}\n",
+			expected: []string{"web1\tnginx:\t{}", "web2\tnginx:\t{}"},
+		},
+		{
+			name:     "stream long line",
+			cfg:      config.UnixReceiver{Network: NetworkUnix, MaxMessageSize: 16},
+			send:     "web1\tnginx:\t" + strings.Repeat("x", 8192) + "\nweb2\tnginx:\t{}\n",
+			expected: []string{"web2\tnginx:\t{}"},
+		},
+		{
+			name:     "datagram",
+			cfg:      config.UnixReceiver{Network: NetworkUnixgram},
+			send:     "web1\tnginx:\t{}\nweb2\tnginx:\t{}",
+			expected: []string{"web1\tnginx:\t{}", "web2\tnginx:\t{}"},
+		},
+		{
+			name:     "datagram syslog",
+			cfg:      config.UnixReceiver{Network: NetworkUnixgram, Format: FormatSyslog},
+			send:     `<190>Oct 17 04:04:19 web1 nginx: {}`,
+			expected: []string{"web1\tnginx:\t{}"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Path = filepath.Join(dir, tt.name+".sock")
+			u, err := NewUnixReceiver(&tt.cfg, metrics.Nop(), &logger)
+			assert.Nil(t, err)
+
+			done := make(chan struct{})
+			go u.Start(done)
+
+			// created with the final mode, the private directory is removed
+			fi, err := os.Stat(tt.cfg.Path)
+			assert.Nil(t, err)
+			mode := os.FileMode(defaultSocketMode)
+			if tt.cfg.Mode != "" {
+				mode = 0600
+			}
+			assert.Equal(t, mode, fi.Mode().Perm())
+			entries, err := ioutil.ReadDir(dir)
+			assert.Nil(t, err)
+			assert.Len(t, entries, 1)
+
+			conn, err := net.Dial(tt.cfg.Network, tt.cfg.Path)
+			assert.Nil(t, err)
+			_, err = conn.Write([]byte(tt.send))
+			assert.Nil(t, err)
+			for _, expected := range tt.expected {
+				assert.Equal(t, expected, receiveMsg(t, u.MsgChan()))
+			}
+			conn.Close()
+
+			close(done)
+			u.Stop()
+			_, err = os.Stat(tt.cfg.Path)
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestUnixReceiverStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unix")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	logger := zerolog.Nop()
+
+	path := filepath.Join(dir, "stale.sock")
+	listener, err := net.Listen(NetworkUnix, path)
+	assert.Nil(t, err)
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	// the socket is still in use
+	_, err = NewUnixReceiver(&config.UnixReceiver{Path: path}, metrics.Nop(), &logger)
+	assert.NotNil(t, err)
+
+	listener.Close()
+	u, err := NewUnixReceiver(&config.UnixReceiver{Path: path}, metrics.Nop(), &logger)
+	assert.Nil(t, err)
+	u.close()
+
+	regular := filepath.Join(dir, "regular")
+	assert.Nil(t, ioutil.WriteFile(regular, nil, 0644))
+	_, err = NewUnixReceiver(&config.UnixReceiver{Path: regular}, metrics.Nop(), &logger)
+	assert.NotNil(t, err)
+	_, err = os.Stat(regular)
+	assert.Nil(t, err)
+}
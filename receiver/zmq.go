@@ -1,6 +1,7 @@
-package receiver
+//go:build zmq
+// +build zmq
 
-/*
+package receiver
 
 import (
 	"sync"
@@ -8,30 +9,37 @@ import (
 
 	"github.com/pebbe/zmq4"
 	"github.com/pkg/errors"
-	"github.com/rs/zerolog/log"
-	"gopkg.in/alexcesaro/statsd.v2"
-)
+	"github.com/rs/zerolog"
 
-const (
-	queueCheckInterval = 30 * time.Second
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
 )
 
+// ZmqSupported reports whether the binary is built with zmq tag
+const ZmqSupported = true
+
+const zmqPollTimeout = time.Second
+
+// ZmqReceiver receives messages from rsyslog omczmq PUSH sockets
 type ZmqReceiver struct {
 	msgChan chan []byte
 	socket  *zmq4.Socket
-	metrics *statsd.Client
-	wg      *sync.WaitGroup
 	poller  *zmq4.Poller
+
+	metrics metrics.Metrics
+	logger  zerolog.Logger
+	wg      *sync.WaitGroup
 }
 
-func NewZmqReceiver(addr string, metrics *statsd.Client) (*ZmqReceiver, error) {
+func NewZmqReceiver(cfg *config.ZmqReceiver, metrics metrics.Metrics, logger *zerolog.Logger) (*ZmqReceiver, error) {
 	socket, err := zmq4.NewSocket(zmq4.PULL)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to init zmq socket")
 	}
-	err = socket.Bind(addr)
+	err = socket.Bind(cfg.Addr)
 	if err != nil {
-		return nil, errors.Wrapf(err, "unable to bind zmq socket with addr: %s", addr)
+		socket.Close()
+		return nil, errors.Wrapf(err, "unable to bind zmq socket with addr: %s", cfg.Addr)
 	}
 	poller := zmq4.NewPoller()
 	poller.Add(socket, zmq4.POLLIN)
@@ -43,9 +51,10 @@ func NewZmqReceiver(addr string, metrics *statsd.Client) (*ZmqReceiver, error) {
 	return &ZmqReceiver{
 		msgChan: msgChan,
 		socket:  socket,
-		metrics: metrics.Clone(statsd.Prefix("receiver.zmq")),
-		wg:      wg,
 		poller:  poller,
+		metrics: receiverMetrics(metrics, "zmq"),
+		wg:      wg,
+		logger:  logger.With().Str("component", "receiver.zmq").Logger(),
 	}, nil
 }
 
@@ -55,65 +64,69 @@ func (z *ZmqReceiver) MsgChan() chan []byte {
 
 func (z *ZmqReceiver) Start(done <-chan struct{}) {
 	defer z.wg.Done()
-	log.Info().Msg("zmq receiver starting")
+	z.logger.Info().Msg("starting")
 
-	ticker := time.NewTicker(queueCheckInterval)
-	defer ticker.Stop()
 	z.wg.Add(1)
-	go z.queueMonitoring(ticker.C, done)
+	go z.queueMonitoring(done)
 
 	var cnt uint64
 	for {
 		select {
 		case <-done:
-			log.Debug().Msg("zmq done")
+			z.logger.Debug().Msg("got done")
 			return
 		default:
-			sockets, err := z.poller.Poll(time.Second)
-			if err != nil {
-				z.metrics.Increment("poll_errors")
-				log.Warn().Err(err).Msg("zmq poll error; ignoring message")
-				continue
-			}
-			if len(sockets) == 0 {
-				continue
-			}
-			msg, err := sockets[0].Socket.RecvBytes(0)
-			if err != nil {
-				z.metrics.Increment("recv_errors")
-				log.Warn().Err(err).Msg("zmq RecvBytes error; ignoring message")
-				continue
-			}
-			z.msgChan <- msg
-			cnt++
-			if cnt%100 == 0 {
-				log.Debug().Msg("100 done")
-				z.metrics.Count("messages", cnt)
-				cnt = 0
-			}
+		}
+
+		sockets, err := z.poller.Poll(zmqPollTimeout)
+		if err != nil {
+			z.metrics.Increment("poll_error")
+			z.logger.Warn().Err(err).Msg("poll error")
+			continue
+		}
+		if len(sockets) == 0 {
+			continue
+		}
+		msg, err := sockets[0].Socket.RecvBytes(0)
+		if err != nil {
+			z.metrics.Increment("recv_error")
+			z.logger.Warn().Err(err).Msg("recv error; ignoring message")
+			continue
+		}
+		z.msgChan <- msg
+		cnt++
+		if cnt%100 == 0 {
+			z.metrics.Count("lines", 100)
+		}
+		if cnt%10000 == 0 {
+			z.logger.Debug().Msg("10k lines processed")
+			cnt = 0
 		}
 	}
 }
 
-func (z *ZmqReceiver) queueMonitoring(ticker <-chan time.Time, done <-chan struct{}) {
+func (z *ZmqReceiver) queueMonitoring(done <-chan struct{}) {
 	defer z.wg.Done()
+
+	ticker := time.NewTicker(queueCheckInterval)
+	defer ticker.Stop()
+
 	for {
 		select {
-		case <-ticker:
-			log.Debug().Int("msg_chan_len", len(z.msgChan)).Msg("queue stats")
-			z.metrics.Count("msg_chan_len", len(z.msgChan))
+		case <-ticker.C:
+			z.logger.Debug().Int("msg_chan_len", len(z.msgChan)).Msg("queue stats")
+			z.metrics.Gauge("msg_chan_len", len(z.msgChan))
 		case <-done:
+			z.logger.Debug().Msg("queueMonitoring exit")
 			return
 		}
 	}
-	log.Debug().Msg("queueMonitoring exit")
 }
 
 func (z *ZmqReceiver) Stop() {
-	log.Info().Msg("zmq receiver stopping")
+	z.logger.Info().Msg("stopping")
 	z.wg.Wait()
 	z.poller.RemoveBySocket(z.socket)
 	z.socket.Close()
 	close(z.msgChan)
 }
-*/
@@ -0,0 +1,32 @@
+//go:build !zmq
+// +build !zmq
+
+package receiver
+
+import (
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+// ZmqSupported reports whether the binary is built with zmq tag
+const ZmqSupported = false
+
+// ZmqReceiver is not available without zmq build tag as it requires libzmq
+type ZmqReceiver struct {
+	msgChan chan []byte
+}
+
+func NewZmqReceiver(_ *config.ZmqReceiver, _ metrics.Metrics, _ *zerolog.Logger) (*ZmqReceiver, error) {
+	return nil, errors.New("built without zmq support, rebuild with -tags zmq")
+}
+
+func (z *ZmqReceiver) MsgChan() chan []byte {
+	return z.msgChan
+}
+
+func (z *ZmqReceiver) Start(_ <-chan struct{}) {}
+
+func (z *ZmqReceiver) Stop() {}
@@ -0,0 +1,38 @@
+//go:build zmq
+// +build zmq
+
+package receiver
+
+import (
+	"testing"
+
+	"github.com/pebbe/zmq4"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+func TestZmqReceiver(t *testing.T) {
+	logger := zerolog.Nop()
+	z, err := NewZmqReceiver(&config.ZmqReceiver{Addr: "inproc://zmq-receiver-test"}, metrics.Nop(), &logger)
+	assert.Nil(t, err)
+
+	done := make(chan struct{})
+	go z.Start(done)
+
+	push, err := zmq4.NewSocket(zmq4.PUSH)
+	assert.Nil(t, err)
+	defer push.Close()
+	assert.Nil(t, push.Connect("inproc://zmq-receiver-test"))
+
+	for _, msg := range []string{"web1\tnginx:\t{}", "web2\tnginx:\t{}"} {
+		_, err = push.SendBytes([]byte(msg), 0)
+		assert.Nil(t, err)
+		assert.Equal(t, msg, receiveMsg(t, z.MsgChan()))
+	}
+
+	close(done)
+	z.Stop()
+}
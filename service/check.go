@@ -0,0 +1,150 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+
+	"nginx-log-collector/backlog"
+	"nginx-log-collector/clickhouse"
+	"nginx-log-collector/config"
+	"nginx-log-collector/processor"
+	"nginx-log-collector/processor/functions"
+	"nginx-log-collector/receiver"
+)
+
+// ConfigError is a config validation error bound to the yaml path
+type ConfigError struct {
+	Path string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Err)
+}
+
+// CheckConfig validates every part of the config without starting anything
+// and returns all the errors found
+func CheckConfig(cfg *config.Config) []error {
+	var errs []error
+	add := func(path string, err error) {
+		if err != nil {
+			errs = append(errs, &ConfigError{Path: path, Err: err})
+		}
+	}
+
+	if _, err := zerolog.ParseLevel(strings.ToLower(cfg.Logging.Level)); err != nil {
+		add("logging.level", err)
+	}
+	if cfg.Processor.Workers <= 0 {
+		add("processor.workers", fmt.Errorf("should be positive, got %d", cfg.Processor.Workers))
+	}
+	if _, err := net.ResolveTCPAddr("tcp", cfg.TCPReceiver.Addr); err != nil {
+		add("tcpReceiver.addr", err)
+	}
+	add("tcpReceiver.format", receiver.ValidateFormat(cfg.TCPReceiver.Format))
+	add("tcpReceiver.tls", receiver.ValidateTLSConfig(cfg.TCPReceiver.TLS))
+	add("tcpReceiver.overload_policy", receiver.ValidateOverloadPolicy(cfg.TCPReceiver.OverloadPolicy))
+	add("tcpReceiver.proxy_protocol", receiver.ValidateProxyProtocol(cfg.TCPReceiver.ProxyProtocol))
+	add("httpReceiver.tls", receiver.ValidateTLSConfig(cfg.HttpReceiver.TLS))
+	add("httpReceiver.parsers", receiver.ValidateLineParsers(&cfg.HttpReceiver))
+	add("httpReceiver.elasticsearch", receiver.ValidateElasticConfig(cfg.HttpReceiver.Elastic))
+	add("httpReceiver.auth", receiver.ValidateAuthConfig(cfg.HttpReceiver.Auth))
+	if cfg.UDPReceiver.Enabled {
+		if _, err := net.ResolveUDPAddr("udp", cfg.UDPReceiver.Addr); err != nil {
+			add("udpReceiver.addr", err)
+		}
+	}
+	if cfg.ZmqReceiver.Enabled && !receiver.ZmqSupported {
+		add("zmqReceiver.enabled", errors.New("built without zmq support, rebuild with -tags zmq"))
+	}
+	if cfg.UnixReceiver.Enabled {
+		add("unixReceiver", receiver.ValidateUnixConfig(&cfg.UnixReceiver))
+	}
+	add("backlog", backlog.ValidateConfig(cfg.Backlog))
+
+	if len(cfg.CollectedLogs) == 0 {
+		add("collected_logs", errors.New("no logs configured"))
+	}
+	tags := make(map[string]bool, len(cfg.CollectedLogs))
+	for i, l := range cfg.CollectedLogs {
+		path := fmt.Sprintf("collected_logs[%d]", i)
+		if l.Tag == "" {
+			add(path+".tag", errors.New("should be set"))
+		} else if tags[l.Tag] {
+			add(path+".tag", fmt.Errorf("duplicate tag %s", l.Tag))
+		}
+		tags[l.Tag] = true
+
+		if l.BufferSize <= 0 {
+			add(path+".buffer_size", fmt.Errorf("should be positive, got %d", l.BufferSize))
+		}
+		if _, err := processor.NewConverter(config.CollectedLog{Format: l.Format}); err != nil {
+			add(path+".format", err)
+		}
+		for field, signature := range l.Transformers {
+			_, err := functions.Dispatch(signature)
+			add(path+".transformers."+field, err)
+		}
+		errs = append(errs, checkUpload(path+".upload", l.Upload, l.AllowErrorRatio)...)
+	}
+
+	checkTag := func(path, tag string) {
+		if tag != "" && !tags[tag] {
+			add(path, fmt.Errorf("unknown tag %s", tag))
+		}
+	}
+	if cfg.FileReceiver.Enabled {
+		add("fileReceiver", receiver.ValidateFileConfig(&cfg.FileReceiver))
+		for i, in := range cfg.FileReceiver.Inputs {
+			checkTag(fmt.Sprintf("fileReceiver.inputs[%d].tag", i), in.Tag)
+		}
+	}
+	if cfg.ForwardReceiver.Enabled {
+		if _, err := net.ResolveTCPAddr("tcp", cfg.ForwardReceiver.Addr); err != nil {
+			add("forwardReceiver.addr", err)
+		}
+		add("forwardReceiver", receiver.ValidateForwardConfig(&cfg.ForwardReceiver))
+		for i, r := range cfg.ForwardReceiver.Routes {
+			checkTag(fmt.Sprintf("forwardReceiver.routes[%d].tag", i), r.Tag)
+		}
+	}
+	if cfg.HttpReceiver.Elastic.Enabled {
+		for i, idx := range cfg.HttpReceiver.Elastic.Indices {
+			checkTag(fmt.Sprintf("httpReceiver.elasticsearch.indices[%d].tag", i), idx.Tag)
+		}
+	}
+	return errs
+}
+
+func checkUpload(path string, cfg config.Upload, allowErrorRatio int) []error {
+	var errs []error
+	add := func(path string, err error) {
+		if err != nil {
+			errs = append(errs, &ConfigError{Path: path, Err: err})
+		}
+	}
+
+	if cfg.Table == "" {
+		add(path+".table", errors.New("should be set"))
+	}
+	if cfg.DSN == "" && len(cfg.DSNs) == 0 {
+		add(path, errors.New("dsn or dsns should be set"))
+	}
+	if cfg.DSN != "" {
+		_, err := clickhouse.MakeUrl(cfg.DSN, cfg.Table, true, allowErrorRatio)
+		add(path+".dsn", err)
+	}
+	for i, dsn := range cfg.DSNs {
+		_, err := clickhouse.MakeUrl(dsn, cfg.Table, true, allowErrorRatio)
+		add(fmt.Sprintf("%s.dsns[%d]", path, i), err)
+	}
+	add(path+".strategy", clickhouse.ValidateStrategy(cfg.Strategy))
+	add(path+".compression", clickhouse.ValidateCompression(cfg.Compression))
+	_, err := clickhouse.NewRetryPolicy(cfg.Retry)
+	add(path+".retry", err)
+	return errs
+}
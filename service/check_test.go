@@ -0,0 +1,59 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"nginx-log-collector/config"
+	"nginx-log-collector/processor/functions"
+)
+
+func TestCheckConfig(t *testing.T) {
+	cfg := &config.Config{
+		Backlog:     config.Backlog{Dir: "/tmp/backlog"},
+		Logging:     config.Logging{Level: "info"},
+		Processor:   config.Processor{Workers: 1},
+		TCPReceiver: config.TCPReceiver{Addr: "localhost:4444"},
+		CollectedLogs: []config.CollectedLog{
+			{
+				Tag:        "nginx:",
+				Format:     "access",
+				BufferSize: 1024,
+				Transformers: functions.FunctionSignatureMap{
+					"request_uri": {"limitMaxLength": 100},
+				},
+				Upload: config.Upload{Table: "nginx.access_log", DSN: "http://localhost:8123/"},
+			},
+		},
+	}
+	assert.Empty(t, CheckConfig(cfg))
+
+	cfg.CollectedLogs = append(cfg.CollectedLogs, config.CollectedLog{
+		Tag:    "nginx:",
+		Format: "unknown",
+		Transformers: functions.FunctionSignatureMap{
+			"ip": {"foo": nil},
+		},
+		Upload: config.Upload{DSNs: []string{"http://localhost:8123/"}, Compression: "brotli"},
+	})
+	cfg.FileReceiver = config.FileReceiver{
+		Enabled:   true,
+		StateFile: "/tmp/state.json",
+		Inputs:    []config.FileInput{{Path: "/var/log/nginx/*.log", Tag: "apache:"}},
+	}
+
+	var paths []string
+	for _, err := range CheckConfig(cfg) {
+		paths = append(paths, err.(*ConfigError).Path)
+	}
+	assert.Equal(t, []string{
+		"collected_logs[1].tag",
+		"collected_logs[1].buffer_size",
+		"collected_logs[1].format",
+		"collected_logs[1].transformers.ip",
+		"collected_logs[1].upload.table",
+		"collected_logs[1].upload.compression",
+		"fileReceiver.inputs[0].tag",
+	}, paths)
+}
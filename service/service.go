@@ -1,12 +1,15 @@
 package service
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
-	"gopkg.in/alexcesaro/statsd.v2"
 
 	"nginx-log-collector/backlog"
 	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
 	"nginx-log-collector/processor"
 	"nginx-log-collector/receiver"
 	"nginx-log-collector/uploader"
@@ -15,25 +18,71 @@ import (
 type Service struct {
 	httpReceiver *receiver.HttpReceiver
 	tcpReceiver  *receiver.TCPReceiver
+	udpReceiver  *receiver.UDPReceiver
+	unixReceiver *receiver.UnixReceiver
+	zmqReceiver  *receiver.ZmqReceiver
+	fileReceiver *receiver.FileReceiver
+	fwdReceiver  *receiver.ForwardReceiver
 	processor    *processor.Processor
 	uploader     *uploader.Uploader
 	backlog      *backlog.Backlog
 
 	logger  zerolog.Logger
-	metrics *statsd.Client
+	metrics metrics.Metrics
 }
 
-func New(cfg *config.Config, metrics *statsd.Client, logger *zerolog.Logger) (*Service, error) {
+func New(cfg *config.Config, metrics metrics.Metrics, logger *zerolog.Logger) (*Service, error) {
 	httpReceiver, err := receiver.NewHttpReceiver(&cfg.HttpReceiver, metrics, logger)
 	if err != nil {
 		return nil, errors.Wrap(err, "http receiver init error")
 	}
+	httpReceiver.SetTags(cfg.CollectedLogs)
 
-	tcpReceiver, err := receiver.NewTCPReceiver(cfg.TCPReceiver.Addr, metrics, logger)
+	tcpReceiver, err := receiver.NewTCPReceiver(&cfg.TCPReceiver, metrics, logger)
 	if err != nil {
 		return nil, errors.Wrap(err, "tcp receiver init error")
 	}
 
+	var udpReceiver *receiver.UDPReceiver
+	if cfg.UDPReceiver.Enabled {
+		udpReceiver, err = receiver.NewUDPReceiver(&cfg.UDPReceiver, metrics, logger)
+		if err != nil {
+			return nil, errors.Wrap(err, "udp receiver init error")
+		}
+	}
+
+	var unixReceiver *receiver.UnixReceiver
+	if cfg.UnixReceiver.Enabled {
+		unixReceiver, err = receiver.NewUnixReceiver(&cfg.UnixReceiver, metrics, logger)
+		if err != nil {
+			return nil, errors.Wrap(err, "unix receiver init error")
+		}
+	}
+
+	var zmqReceiver *receiver.ZmqReceiver
+	if cfg.ZmqReceiver.Enabled {
+		zmqReceiver, err = receiver.NewZmqReceiver(&cfg.ZmqReceiver, metrics, logger)
+		if err != nil {
+			return nil, errors.Wrap(err, "zmq receiver init error")
+		}
+	}
+
+	var fileReceiver *receiver.FileReceiver
+	if cfg.FileReceiver.Enabled {
+		fileReceiver, err = receiver.NewFileReceiver(&cfg.FileReceiver, metrics, logger)
+		if err != nil {
+			return nil, errors.Wrap(err, "file receiver init error")
+		}
+	}
+
+	var fwdReceiver *receiver.ForwardReceiver
+	if cfg.ForwardReceiver.Enabled {
+		fwdReceiver, err = receiver.NewForwardReceiver(&cfg.ForwardReceiver, metrics, logger)
+		if err != nil {
+			return nil, errors.Wrap(err, "forward receiver init error")
+		}
+	}
+
 	proc, err := processor.New(cfg.Processor, cfg.CollectedLogs, metrics, logger)
 	if err != nil {
 		return nil, errors.Wrap(err, "processor init error")
@@ -48,18 +97,61 @@ func New(cfg *config.Config, metrics *statsd.Client, logger *zerolog.Logger) (*S
 	if err != nil {
 		return nil, errors.Wrap(err, "uploader init error")
 	}
+	bl.SetTargets(upl.Targets())
 
 	return &Service{
 		httpReceiver: httpReceiver,
 		tcpReceiver:  tcpReceiver,
+		udpReceiver:  udpReceiver,
+		unixReceiver: unixReceiver,
+		zmqReceiver:  zmqReceiver,
+		fileReceiver: fileReceiver,
+		fwdReceiver:  fwdReceiver,
 		processor:    proc,
 		uploader:     upl,
 		backlog:      bl,
 		logger:       logger.With().Str("component", "service").Logger(),
-		metrics:      metrics.Clone(statsd.Prefix("service")),
+		metrics:      metrics.Clone("service"),
 	}, nil
 }
 
+// Reload atomically replaces collected logs configuration.
+// Receivers and backlog keep running; running config is untouched on error.
+// The config is validated like -check-config does, removed tags are uploaded until drained
+func (s *Service) Reload(cfg *config.Config) error {
+	if errs := CheckConfig(cfg); len(errs) > 0 {
+		s.metrics.Increment("reload.failed")
+		messages := make([]string, 0, len(errs))
+		for _, err := range errs {
+			messages = append(messages, err.Error())
+		}
+		return fmt.Errorf("invalid config: %s", strings.Join(messages, "; "))
+	}
+	procTagContexts, err := processor.NewTagContexts(cfg.CollectedLogs)
+	if err != nil {
+		s.metrics.Increment("reload.failed")
+		return errors.Wrap(err, "processor reload error")
+	}
+	uplTagContexts, err := s.uploader.NewTagContexts(cfg.CollectedLogs)
+	if err != nil {
+		s.metrics.Increment("reload.failed")
+		return errors.Wrap(err, "uploader reload error")
+	}
+
+	s.processor.SetTagContexts(procTagContexts)
+	s.uploader.SetTagContexts(uplTagContexts)
+	s.httpReceiver.SetTags(cfg.CollectedLogs)
+
+	s.metrics.Increment("reload.ok")
+	s.logger.Info().Int("collected_logs", len(cfg.CollectedLogs)).Msg("config reloaded")
+	return nil
+}
+
+// ReloadFailed reports config which can't be even loaded
+func (s *Service) ReloadFailed() {
+	s.metrics.Increment("reload.failed")
+}
+
 func (s *Service) Start(done <-chan struct{}) {
 	s.logger.Info().Msg("starting")
 
@@ -68,7 +160,29 @@ func (s *Service) Start(done <-chan struct{}) {
 		go s.httpReceiver.Start(sDone)
 	}
 	go s.tcpReceiver.Start(sDone)
-	go s.processor.Start(sDone, s.httpReceiver.MsgChan(), s.tcpReceiver.MsgChan())
+	msgChanList := []chan []byte{s.httpReceiver.MsgChan(), s.tcpReceiver.MsgChan()}
+	var ackedChanList []chan processor.Message
+	if s.udpReceiver != nil {
+		go s.udpReceiver.Start(sDone)
+		msgChanList = append(msgChanList, s.udpReceiver.MsgChan())
+	}
+	if s.unixReceiver != nil {
+		go s.unixReceiver.Start(sDone)
+		msgChanList = append(msgChanList, s.unixReceiver.MsgChan())
+	}
+	if s.zmqReceiver != nil {
+		go s.zmqReceiver.Start(sDone)
+		msgChanList = append(msgChanList, s.zmqReceiver.MsgChan())
+	}
+	if s.fileReceiver != nil {
+		go s.fileReceiver.Start(sDone)
+		ackedChanList = append(ackedChanList, s.fileReceiver.MsgChan())
+	}
+	if s.fwdReceiver != nil {
+		go s.fwdReceiver.Start(sDone)
+		msgChanList = append(msgChanList, s.fwdReceiver.MsgChan())
+	}
+	go s.processor.Start(sDone, ackedChanList, msgChanList...)
 	go s.uploader.Start(sDone, s.processor.ResultChan())
 	go s.backlog.Start(done)
 
@@ -85,12 +199,41 @@ func (s *Service) Start(done <-chan struct{}) {
 	s.tcpReceiver.Stop()
 	s.logger.Info().Msg("tcp receiver stopped")
 
+	if s.udpReceiver != nil {
+		s.udpReceiver.Stop()
+		s.logger.Info().Msg("udp receiver stopped")
+	}
+
+	if s.unixReceiver != nil {
+		s.unixReceiver.Stop()
+		s.logger.Info().Msg("unix receiver stopped")
+	}
+
+	if s.zmqReceiver != nil {
+		s.zmqReceiver.Stop()
+		s.logger.Info().Msg("zmq receiver stopped")
+	}
+
+	if s.fileReceiver != nil {
+		s.fileReceiver.Stop()
+		s.logger.Info().Msg("file receiver stopped")
+	}
+
+	if s.fwdReceiver != nil {
+		s.fwdReceiver.Stop()
+		s.logger.Info().Msg("forward receiver stopped")
+	}
+
 	s.processor.Stop()
 	s.logger.Info().Msg("processor stopped")
 
 	s.uploader.Stop()
 	s.logger.Info().Msg("uploader stopped")
 
+	if s.fileReceiver != nil {
+		s.fileReceiver.SaveState()
+	}
+
 	s.backlog.Stop()
 	s.logger.Info().Msg("backlog stopped")
 }
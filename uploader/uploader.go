@@ -3,64 +3,186 @@ package uploader
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
-	"gopkg.in/alexcesaro/statsd.v2"
 
 	"nginx-log-collector/backlog"
 	"nginx-log-collector/clickhouse"
 	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
 	"nginx-log-collector/processor"
 )
 
-const maxResultChanLen = 10
+const (
+	maxResultChanLen = 10
+	// removed tags are kept until processor buffers are flushed and their backlog is replayed
+	retiredDrainDelay    = time.Minute
+	retiredCheckInterval = time.Minute
+)
 
 type Uploader struct {
-	backlog     *backlog.Backlog
-	tagContexts map[string]TagContext
-	logger      zerolog.Logger
-	metrics     *statsd.Client
-	wg          *sync.WaitGroup
+	backlog       *backlog.Backlog
+	tagContextsMu *sync.RWMutex
+	tagContexts   map[string]TagContext
+	retired       map[string]retiredTag // tags removed by config reload which still have data
+	logger        zerolog.Logger
+	metrics       metrics.Metrics
+	wg            *sync.WaitGroup
 }
 
 type TagContext struct {
-	Config config.CollectedLog
-	URL    string
+	Config  config.CollectedLog
+	Cluster *clickhouse.Cluster
+}
+
+type retiredTag struct {
+	TagContext
+	retiredAt time.Time
 }
 
-func New(logs []config.CollectedLog, bl *backlog.Backlog, metrics *statsd.Client, logger *zerolog.Logger) (*Uploader, error) {
-	tagContexts := make(map[string]TagContext)
+func New(logs []config.CollectedLog, bl *backlog.Backlog, metrics metrics.Metrics, logger *zerolog.Logger) (*Uploader, error) {
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	u := &Uploader{
+		tagContextsMu: &sync.RWMutex{},
+		retired:       make(map[string]retiredTag),
+		wg:            wg,
+		backlog:       bl,
+		metrics:       metrics.Clone("uploader"),
+		logger:        logger.With().Str("component", "uploader").Logger(),
+	}
+
+	tagContexts, err := u.NewTagContexts(logs)
+	if err != nil {
+		return nil, err
+	}
+	u.tagContexts = tagContexts
+	return u, nil
+}
+
+// NewTagContexts builds upload targets for every collected log
+func (u *Uploader) NewTagContexts(logs []config.CollectedLog) (map[string]TagContext, error) {
+	tagContexts := make(map[string]TagContext, len(logs))
 	for _, l := range logs {
-		uploadUrl, err := clickhouse.MakeUrl(l.Upload.DSN, l.Upload.Table, true, l.AllowErrorRatio)
+		cluster, err := clickhouse.NewCluster(l.Tag, l.Upload, l.AllowErrorRatio, u.metrics, &u.logger)
 		if err != nil {
-			return nil, errors.Wrap(err, "unable to create uploader")
+			return nil, errors.Wrapf(err, "unable to create uploader for tag %s", l.Tag)
+		}
+
+		tagContexts[l.Tag] = TagContext{Config: l, Cluster: cluster}
+	}
+	return tagContexts, nil
+}
+
+// SetTagContexts atomically replaces upload targets, backlog targets are updated as well.
+// Removed tags are retired: buffered batches and backlog files of them are still uploaded until drained
+func (u *Uploader) SetTagContexts(tagContexts map[string]TagContext) {
+	now := time.Now()
+	u.tagContextsMu.Lock()
+	for tag, tagContext := range u.tagContexts {
+		if _, found := tagContexts[tag]; !found {
+			u.retired[tag] = retiredTag{TagContext: tagContext, retiredAt: now}
 		}
+	}
+	for tag := range tagContexts {
+		delete(u.retired, tag)
+	}
+	u.tagContexts = tagContexts
+	u.backlog.SetTargets(u.targets())
+	u.tagContextsMu.Unlock()
+}
 
-		tagContexts[l.Tag] = TagContext{Config: l, URL: uploadUrl}
+// getTagContext returns context of configured or retired tag
+func (u *Uploader) getTagContext(tag string) (TagContext, bool) {
+	u.tagContextsMu.RLock()
+	defer u.tagContextsMu.RUnlock()
+	if tagContext, found := u.tagContexts[tag]; found {
+		return tagContext, true
 	}
+	retired, found := u.retired[tag]
+	return retired.TagContext, found
+}
 
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-	return &Uploader{
-		tagContexts: tagContexts,
-		wg:          wg,
-		backlog:     bl,
-		metrics:     metrics.Clone(statsd.Prefix("uploader")),
-		logger:      logger.With().Str("component", "uploader").Logger(),
-	}, nil
+// Targets returns upload targets by name for backlog replays, retired tags included
+func (u *Uploader) Targets() map[string]*clickhouse.Cluster {
+	u.tagContextsMu.RLock()
+	defer u.tagContextsMu.RUnlock()
+	return u.targets()
+}
+
+// XXX tagContextsMu should be taken
+func (u *Uploader) targets() map[string]*clickhouse.Cluster {
+	targets := make(map[string]*clickhouse.Cluster, len(u.tagContexts)+len(u.retired))
+	for _, retired := range u.retired {
+		targets[retired.Cluster.Name()] = retired.Cluster
+	}
+	for _, tagContext := range u.tagContexts {
+		targets[tagContext.Cluster.Name()] = tagContext.Cluster
+	}
+	return targets
+}
+
+// releaseRetired forgets retired tags without pending data
+func (u *Uploader) releaseRetired(now time.Time) {
+	u.tagContextsMu.RLock()
+	drained := make(map[string]retiredTag, len(u.retired))
+	for tag, retired := range u.retired {
+		if now.Sub(retired.retiredAt) >= retiredDrainDelay {
+			drained[tag] = retired
+		}
+	}
+	u.tagContextsMu.RUnlock()
+
+	for tag, retired := range drained {
+		if u.backlog.HasTargetFiles(retired.Cluster.Name()) {
+			delete(drained, tag)
+		}
+	}
+	if len(drained) == 0 {
+		return
+	}
+
+	u.tagContextsMu.Lock()
+	for tag, retired := range drained {
+		// the tag may be re-added or retired again meanwhile
+		if current, found := u.retired[tag]; found && current.retiredAt.Equal(retired.retiredAt) {
+			delete(u.retired, tag)
+			u.logger.Info().Str("tag", tag).Msg("removed tag drained")
+		}
+	}
+	u.backlog.SetTargets(u.targets())
+	u.tagContextsMu.Unlock()
+}
+
+func (u *Uploader) watchRetired(done <-chan struct{}) {
+	defer u.wg.Done()
+	ticker := time.NewTicker(retiredCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			u.releaseRetired(now)
+		}
+	}
 }
 
 func (u *Uploader) Start(done <-chan struct{}, resultChan chan processor.Result) {
 	defer u.wg.Done()
 	u.logger.Info().Msg("starting")
+	u.wg.Add(1)
+	go u.watchRetired(done)
 	limiter := u.backlog.GetLimiter()
 	isDone := false
 	for result := range resultChan {
-		tagContext, found := u.tagContexts[result.Tag]
+		tagContext, found := u.getTagContext(result.Tag)
 		if !found {
 			u.metrics.Increment("tag_missing_error")
 			u.logger.Warn().Str("tag", result.Tag).Msg("tag missing in uploader")
+			result.Ack() // the batch can't be uploaded anyway
 			continue
 		}
 
@@ -82,45 +204,60 @@ func (u *Uploader) Start(done <-chan struct{}, resultChan chan processor.Result)
 				u.logger.Error().Str("tag", result.Tag).Msgf("make new backlog job: %s", string(result.Data))
 			}
 
-			if err := u.backlog.MakeNewBacklogJob(tagContext.URL, result.Data); err != nil {
+			if err := u.backlog.MakeNewBacklogJob(tagContext.Cluster.Name(), result.Tag, result.Lines, result.Data); err != nil {
 				u.logger.Fatal().Err(err).Msg("unable to create backlog job")
 			}
+			result.Ack()
 			continue
 		}
 
 		limiter.Enter()
 		u.wg.Add(1)
-		go func(url string, data []byte, tag string, lines int) {
+		go func(cluster *clickhouse.Cluster, data []byte, tag string, lines int, ack func()) {
 			tagTrimmed := tag[:len(tag)-1] // trim :
 
-			u.metrics.Increment(fmt.Sprintf("uploading.batches.%s", tagTrimmed))
-			u.metrics.Count(fmt.Sprintf("uploading.lines.%s", tagTrimmed), lines)
+			u.metrics.Increment("uploading.batches", metrics.Tag(tag))
+			u.metrics.Count("uploading.lines", lines, metrics.Tag(tag))
 
-			err := clickhouse.Upload(url, data)
+			err := cluster.Upload(data)
 			if tagContext.Config.Audit {
 				// level is error because global log level is error
 				u.logger.Error().Str("tag", tag).Err(err).Msgf("upload: %s", string(data))
 			}
-			if err != nil {
-				u.logger.Error().Str("tag", tag).Str("url", tagContext.URL).Err(err).Msg("upload error; creating backlog job")
+			if err != nil && !cluster.Retry().IsRetryable(err) {
+				// permanent errors like schema mismatch would fail on every backlog replay
+				u.logger.Error().Str("tag", tag).Err(err).Msg("permanent upload error; quarantining batch")
 				u.metrics.Increment("upload_error")
-				if err := u.backlog.MakeNewBacklogJob(url, data); err != nil {
+				u.metrics.Increment("permanent_error", metrics.Tag(tag))
+				if err := u.backlog.MakeQuarantineJob(cluster.Name(), tag, lines, data); err != nil {
+					u.logger.Error().Err(err).Str("tag", tag).Int("lines", lines).Msg("unable to quarantine batch; dropping it")
+					u.metrics.Count("dropped.lines", lines, metrics.Tag(tag))
+				}
+				u.metrics.Increment("failed.batches", metrics.Tag(tag))
+				u.metrics.Count("failed.lines", lines, metrics.Tag(tag))
+			} else if err != nil {
+				u.logger.Error().Str("tag", tag).Err(err).Msg("upload error; creating backlog job")
+				u.metrics.Increment("upload_error")
+				if err := u.backlog.MakeNewBacklogJob(cluster.Name(), tag, lines, data); err != nil {
 					u.logger.Fatal().Err(err).Msg("unable to create backlog job")
 				}
-				u.metrics.Increment(fmt.Sprintf("failed.batches.%s", tagTrimmed))
-				u.metrics.Count(fmt.Sprintf("failed.lines.%s", tagTrimmed), lines)
+				u.metrics.Increment("failed.batches", metrics.Tag(tag))
+				u.metrics.Count("failed.lines", lines, metrics.Tag(tag))
 			} else {
-				u.metrics.Increment(fmt.Sprintf("ok.batches.%s", tagTrimmed))
-				u.metrics.Count(fmt.Sprintf("ok.lines.%s", tagTrimmed), lines)
+				u.metrics.Increment("ok.batches", metrics.Tag(tag))
+				u.metrics.Count("ok.lines", lines, metrics.Tag(tag))
 			}
 
-			// old-style metric for compatibility
-			u.metrics.Increment(fmt.Sprintf("upload_tag_%s_", tagTrimmed)) // trim :
+			// old-style metric for compatibility, prometheus has uploading.batches with tag label
+			metrics.StatsdOnly(u.metrics).Increment(fmt.Sprintf("upload_tag_%s_", tagTrimmed)) // trim :
+
+			// the batch is uploaded, stored to backlog or quarantine, or dropped by their quota
+			ack()
 
 			limiter.Leave()
 			u.wg.Done()
 
-		}(tagContext.URL, result.Data, result.Tag, result.Lines)
+		}(tagContext.Cluster, result.Data, result.Tag, result.Lines, result.Ack)
 	}
 	<-done
 }
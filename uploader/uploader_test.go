@@ -0,0 +1,57 @@
+package uploader
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+
+	"nginx-log-collector/backlog"
+	"nginx-log-collector/config"
+	"nginx-log-collector/metrics"
+)
+
+func TestRetiredTags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backlog")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	logger := zerolog.Nop()
+	bl, err := backlog.New(config.Backlog{Dir: dir}, metrics.Nop(), &logger)
+	assert.Nil(t, err)
+	logs := []config.CollectedLog{
+		{Tag: "nginx:", Upload: config.Upload{DSN: "http://localhost:8123/", Table: "db.nginx"}},
+		{Tag: "nginx_error:", Upload: config.Upload{DSN: "http://localhost:8123/", Table: "db.nginx_error"}},
+	}
+	u, err := New(logs, bl, metrics.Nop(), &logger)
+	assert.Nil(t, err)
+
+	tagContexts, err := u.NewTagContexts(logs[:1])
+	assert.Nil(t, err)
+	u.SetTagContexts(tagContexts)
+	_, found := u.getTagContext("nginx_error:")
+	assert.True(t, found)
+	assert.Len(t, u.Targets(), 2)
+
+	// kept while backlog of the tag is pending
+	assert.Nil(t, bl.MakeNewBacklogJob("nginx_error:", "nginx_error:", 1, []byte("{}\n")))
+	u.releaseRetired(time.Now().Add(retiredDrainDelay))
+	_, found = u.getTagContext("nginx_error:")
+	assert.True(t, found)
+
+	// re-added tag isn't retired anymore, removed tag without backlog is released after the delay
+	tagContexts, err = u.NewTagContexts(logs[1:])
+	assert.Nil(t, err)
+	u.SetTagContexts(tagContexts)
+	u.releaseRetired(time.Now())
+	_, found = u.getTagContext("nginx:")
+	assert.True(t, found)
+	u.releaseRetired(time.Now().Add(retiredDrainDelay))
+	_, found = u.getTagContext("nginx:")
+	assert.False(t, found)
+	assert.Len(t, u.Targets(), 1)
+	assert.Len(t, u.retired, 0)
+}
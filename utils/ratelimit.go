@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket which can be shared between goroutines.
+// nil RateLimiter means no limit
+type RateLimiter struct {
+	mu     *sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate int64) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		mu:     &sync.Mutex{},
+		rate:   float64(rate),
+		burst:  float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until n tokens are available and returns the time spent waiting
+func (r *RateLimiter) Wait(n int) time.Duration {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	now := time.Now()
+	r.tokens = math.Min(r.burst, r.tokens+now.Sub(r.last).Seconds()*r.rate)
+	r.last = now
+	r.tokens -= float64(n)
+	var wait time.Duration
+	if r.tokens < 0 {
+		wait = time.Duration(-r.tokens / r.rate * float64(time.Second))
+	}
+	r.mu.Unlock()
+
+	time.Sleep(wait)
+	return wait
+}
+
+type rateLimitedReader struct {
+	r        io.Reader
+	limiters []*RateLimiter
+}
+
+// NewRateLimitedReader returns reader which takes tokens from every limiter for each byte read
+func NewRateLimitedReader(r io.Reader, limiters ...*RateLimiter) io.Reader {
+	return &rateLimitedReader{r: r, limiters: limiters}
+}
+
+func (l *rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	for _, limiter := range l.limiters {
+		limiter.Wait(n)
+	}
+	return n, err
+}
@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitedReader(t *testing.T) {
+	limiter := NewRateLimiter(1000)
+	data := bytes.Repeat([]byte{'x'}, 1500)
+
+	start := time.Now()
+	read, err := ioutil.ReadAll(NewRateLimitedReader(bytes.NewReader(data), limiter))
+	elapsed := time.Since(start)
+
+	assert.Nil(t, err)
+	assert.Equal(t, data, read)
+	// first 1000 bytes are the burst, the rest takes about half a second
+	assert.True(t, elapsed >= 400*time.Millisecond, elapsed.String())
+	assert.True(t, elapsed < 2*time.Second, elapsed.String())
+}
+
+func TestNilRateLimiter(t *testing.T) {
+	var limiter *RateLimiter
+	assert.Nil(t, NewRateLimiter(0))
+	assert.Equal(t, time.Duration(0), limiter.Wait(100))
+}